@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cardDeletion is the verdict on one file on the SD card: whether it has been
+// verified as safely imported and may be deleted, and why (or why not).
+type cardDeletion struct {
+	Source      string `json:"source"` // relative to the card mount point, e.g. DCIM/100CANON/IMG_0001.JPG
+	Size        int64  `json:"size"`
+	Delete      bool   `json:"delete"`
+	Reason      string `json:"reason"`
+	LibraryFile string `json:"library_file,omitempty"` // verified copy, relative to photoBaseDir
+	IsRaw       bool   `json:"is_raw"`
+}
+
+// libraryCopy is a file in a session directory that may hold the same bytes
+// as a card file, together with the manifest entry recorded when it was
+// copied (nil for sessions imported before manifests existed).
+type libraryCopy struct {
+	directory string
+	file      string
+	entry     *manifestEntry
+}
+
+// libraryCopies indexes every session's files by where they came from on the
+// card (from import manifests) and, as a fallback for sessions without a
+// manifest, by their prefixed file name.
+type libraryCopies struct {
+	bySource map[string][]libraryCopy
+	byName   map[string][]libraryCopy
+}
+
+func loadLibraryCopies() libraryCopies {
+	lib := libraryCopies{bySource: map[string][]libraryCopy{}, byName: map[string][]libraryCopy{}}
+	for _, dir := range indexedSessionNames() {
+		m, err := loadManifest(dir)
+		if err != nil {
+			log.Printf("Ignoring unreadable import manifest in %s: %v", dir, err)
+		}
+		recorded := make(map[string]bool)
+		for i := range m.Entries {
+			e := &m.Entries[i]
+			recorded[e.File] = true
+			if e.Source != "" {
+				lib.bySource[e.Source] = append(lib.bySource[e.Source], libraryCopy{directory: dir, file: e.File, entry: e})
+			}
+		}
+		files, _, err := indexedSessionFiles(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if !recorded[file] {
+				lib.byName[file] = append(lib.byName[file], libraryCopy{directory: dir, file: file})
+			}
+		}
+	}
+	return lib
+}
+
+// verifyCardFile decides whether the card file at mountPoint/source has a
+// byte-identical copy in the library. A copy counts only if its size matches
+// and its SHA-256 equals that of the card file — a same-named file from
+// another camera, or one written after a counter rollover, never does.
+// Manifest entries are tried first; their recorded hash must also still match
+// the library copy, which catches copies that were modified or damaged since.
+func verifyCardFile(ctx context.Context, lib libraryCopies, mountPoint, source, destName string, size int64) cardDeletion {
+	result := cardDeletion{Source: source, Size: size, IsRaw: isRawFile(source)}
+
+	candidates := append([]libraryCopy{}, lib.bySource[source]...)
+	candidates = append(candidates, lib.byName[destName]...)
+	if len(candidates) == 0 {
+		result.Reason = "not imported: no copy in the library"
+		return result
+	}
+
+	var cardHash string
+	reason := ""
+	for _, c := range candidates {
+		if c.entry != nil && c.entry.Size != size {
+			reason = "size differs from the imported copy in " + c.directory
+			continue
+		}
+		libPath, err := safePhotoPath(c.directory, c.file)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(libPath)
+		if err != nil {
+			reason = "imported copy " + c.directory + "/" + c.file + " is missing"
+			continue
+		}
+		if info.Size() != size {
+			reason = "size differs from " + c.directory + "/" + c.file
+			continue
+		}
+		if cardHash == "" {
+			if _, cardHash, err = hashFileUncached(ctx, filepath.Join(mountPoint, source)); err != nil {
+				result.Reason = "could not read card file: " + err.Error()
+				return result
+			}
+		}
+		if c.entry != nil && c.entry.SHA256 != cardHash {
+			reason = "content differs from the file imported as " + c.directory + "/" + c.file
+			continue
+		}
+		_, libHash, err := hashFileUncached(ctx, libPath)
+		if err != nil {
+			reason = "could not read " + c.directory + "/" + c.file + ": " + err.Error()
+			continue
+		}
+		if libHash != cardHash {
+			reason = "content differs from " + c.directory + "/" + c.file
+			continue
+		}
+		result.Delete = true
+		result.LibraryFile = c.directory + "/" + c.file
+		result.Reason = "verified: size and SHA-256 match the library copy"
+		return result
+	}
+	result.Reason = reason
+	return result
+}
+
+// planCardDeletion checks every JPEG, video and RAW in the card's camera
+// directories against the library. Each file is judged on its own: a RAW is
+// only deleted if the RAW itself was imported or exported, never just because
+// its JPEG was.
+func planCardDeletion(ctx context.Context, mountPoint string, cameraDirs []string) []cardDeletion {
+	lib := loadLibraryCopies()
+	plan := []cardDeletion{}
+	for _, cameraDir := range cameraDirs {
+		sourceDir := filepath.Join(mountPoint, "DCIM", cameraDir)
+		files, err := ioutil.ReadDir(sourceDir)
+		if err != nil {
+			log.Printf("Failed to read directory %s: %v", sourceDir, err)
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), "._") {
+				continue
+			}
+			lowerName := strings.ToLower(file.Name())
+			if !strings.HasSuffix(lowerName, ".jpg") && !strings.HasSuffix(lowerName, ".mp4") && !isRawFile(file.Name()) && !isCompanionFile(file.Name()) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return plan
+			}
+			source := filepath.ToSlash(filepath.Join("DCIM", cameraDir, file.Name()))
+			plan = append(plan, verifyCardFile(ctx, lib, mountPoint, source, legacyImportName(cameraDir, file.Name()), file.Size()))
+		}
+	}
+	return plan
+}
+
+// deleteImportedHandler removes files from the SD card that have a verified
+// copy in the library. GET is a dry run that reports, per file, what would be
+// deleted and why anything would be kept; POST performs the deletion.
+func deleteImportedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Find the USB/SD card mount point
+	card := r.URL.Query().Get("card")
+	usbMountPoint, err := cardMountPoint(card)
+	if err != nil {
+		message, status := cardErrorResponse(err, card)
+		http.Error(w, message, status)
+		return
+	}
+
+	cameraDirs := findCameraDirectories(usbMountPoint)
+	if len(cameraDirs) == 0 {
+		http.Error(w, "Could not find a supported camera DCIM directory on USB device", http.StatusNotFound)
+		return
+	}
+
+	plan := planCardDeletion(r.Context(), usbMountPoint, cameraDirs)
+	if r.Context().Err() != nil {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		toDelete := 0
+		for _, item := range plan {
+			if item.Delete {
+				toDelete++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"dry_run":   true,
+			"to_delete": toDelete,
+			"skipped":   len(plan) - toDelete,
+			"files":     plan,
+		})
+		return
+	}
+
+	deletedCount := 0
+	deletedRawCount := 0
+	notFoundCount := 0
+	errorCount := 0
+	skippedCount := 0
+	for i, item := range plan {
+		if !item.Delete {
+			skippedCount++
+			continue
+		}
+		filePath := filepath.Join(usbMountPoint, filepath.FromSlash(item.Source))
+		if err := os.Remove(filePath); err != nil {
+			plan[i].Delete = false
+			if os.IsNotExist(err) {
+				notFoundCount++
+				plan[i].Reason = "already gone from the card"
+			} else {
+				log.Printf("Failed to delete file %s: %v", filePath, err)
+				errorCount++
+				plan[i].Reason = "delete failed: " + err.Error()
+			}
+			continue
+		}
+		log.Printf("Deleted imported file: %s (verified against %s)", item.Source, item.LibraryFile)
+		if item.IsRaw {
+			deletedRawCount++
+		} else {
+			deletedCount++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Delete operation complete",
+		"deleted":     deletedCount,
+		"deleted_raw": deletedRawCount,
+		"not_found":   notFoundCount,
+		"errors":      errorCount,
+		"skipped":     skippedCount,
+		"total_found": deletedCount + deletedRawCount + notFoundCount + errorCount,
+		"files":       plan,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanCardDeletionRequiresContentMatch(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	card := t.TempDir()
+	cardDir := filepath.Join(card, "DCIM", "100CANON")
+	os.MkdirAll(cardDir, 0755)
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(cardDir, "IMG_0001.JPG"), "imported-with-manifest")
+	write(filepath.Join(cardDir, "IMG_0002.JPG"), "this-camera")
+	write(filepath.Join(cardDir, "IMG_0003.JPG"), "legacy-import")
+	write(filepath.Join(cardDir, "IMG_0003.CR3"), "raw-never-imported")
+	write(filepath.Join(cardDir, "IMG_0004.JPG"), "not-imported")
+
+	// A session imported with a manifest.
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+	dst := filepath.Join(photoBaseDir, "batch", "100_IMG_0001.JPG")
+	size, sum, err := copyFileVerified(context.Background(), filepath.Join(cardDir, "IMG_0001.JPG"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordManifestEntries("batch", []manifestEntry{{File: "100_IMG_0001.JPG", Source: "DCIM/100CANON/IMG_0001.JPG", Size: size, SHA256: sum}})
+
+	// Another camera's IMG_0002 with the same prefixed name but other bytes,
+	// and a legacy session without a manifest holding a true copy of IMG_0003.
+	os.MkdirAll(filepath.Join(photoBaseDir, "other-camera"), 0755)
+	write(filepath.Join(photoBaseDir, "other-camera", "100_IMG_0002.JPG"), "other-body")
+	write(filepath.Join(photoBaseDir, "other-camera", "100_IMG_0003.JPG"), "legacy-import")
+
+	plan := planCardDeletion(context.Background(), card, []string{"100CANON"})
+	got := map[string]bool{}
+	for _, item := range plan {
+		got[item.Source] = item.Delete
+		if item.Reason == "" {
+			t.Errorf("%s has no reason", item.Source)
+		}
+	}
+	want := map[string]bool{
+		"DCIM/100CANON/IMG_0001.JPG": true,
+		"DCIM/100CANON/IMG_0002.JPG": false,
+		"DCIM/100CANON/IMG_0003.JPG": true,
+		"DCIM/100CANON/IMG_0003.CR3": false,
+		"DCIM/100CANON/IMG_0004.JPG": false,
+	}
+	for source, wantDelete := range want {
+		if del, ok := got[source]; !ok || del != wantDelete {
+			t.Errorf("%s delete = %v (present %v), want %v", source, del, ok, wantDelete)
+		}
+	}
+
+	// A library copy damaged after import no longer matches its manifest.
+	write(dst, "imported-with-manifesT")
+	for _, item := range planCardDeletion(context.Background(), card, []string{"100CANON"}) {
+		if item.Source == "DCIM/100CANON/IMG_0001.JPG" && item.Delete {
+			t.Error("IMG_0001 still marked for deletion after its library copy changed")
+		}
+	}
+}
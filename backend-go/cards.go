@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cardPollInterval is how often the card watcher looks for cards being
+// inserted or removed. On Linux a change to the mount table wakes it sooner.
+const cardPollInterval = 3 * time.Second
+
+// sdCard identifies a mounted card (or any storage with a camera DCIM
+// folder). ID is the filesystem UUID where it can be found, and the volume
+// label otherwise; requests name cards by it.
+type sdCard struct {
+	ID         string   `json:"id"`
+	MountPoint string   `json:"mount_point"`
+	Label      string   `json:"label"`
+	UUID       string   `json:"uuid,omitempty"`
+	Brands     []string `json:"brands"`
+	Capacity   uint64   `json:"capacity,omitempty"` // bytes; only filled in by listCards
+	Free       uint64   `json:"free,omitempty"`
+}
+
+var (
+	errNoCard         = errors.New("no card with a camera DCIM directory connected")
+	errSeveralCards   = errors.New("several cards are connected")
+	errCardNotPresent = errors.New("card not connected")
+)
+
+// listCards returns every connected card, with its capacity and free space.
+func listCards() []sdCard {
+	cards := []sdCard{}
+	for _, mountPoint := range findCardMountPoints() {
+		card := identifyCard(mountPoint)
+		card.Capacity, card.Free = diskSpace(mountPoint)
+		cards = append(cards, card)
+	}
+	return cards
+}
+
+// cardMountPoint returns the mount point of the connected card with the given
+// ID or, without one, of the only card connected. It fails with errNoCard
+// when no card is connected, with errCardNotPresent when none has the ID,
+// and with errSeveralCards when the choice is ambiguous: no ID and several
+// cards, or an ID shared by several cards, such as two cards with the same
+// label and no UUID.
+func cardMountPoint(id string) (string, error) {
+	mountPoints := findCardMountPoints()
+	if len(mountPoints) == 0 {
+		return "", errNoCard
+	}
+	if id == "" {
+		if len(mountPoints) > 1 {
+			return "", errSeveralCards
+		}
+		return mountPoints[0], nil
+	}
+	var found []string
+	for _, mountPoint := range mountPoints {
+		if identifyCard(mountPoint).ID == id {
+			found = append(found, mountPoint)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: %q", errCardNotPresent, id)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w: %d share the ID %q", errSeveralCards, len(found), id)
+}
+
+// cardErrorResponse returns the message and HTTP status to answer an error
+// from cardMountPoint(id) with.
+func cardErrorResponse(err error, id string) (string, int) {
+	switch {
+	case errors.Is(err, errNoCard):
+		return "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is it connected?", http.StatusNotFound
+	case errors.Is(err, errSeveralCards) && id != "":
+		return fmt.Sprintf("Several connected cards have the ID %q; unplug all but one", id), http.StatusConflict
+	case errors.Is(err, errSeveralCards):
+		return "Several cards are connected; choose one with 'card'", http.StatusConflict
+	case errors.Is(err, errCardNotPresent):
+		return fmt.Sprintf("Card %q is not connected", id), http.StatusNotFound
+	}
+	return "Failed to find the card", http.StatusInternalServerError
+}
+
+// cardsHandler lists the connected cards (see sdCard).
+func cardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listCards())
+}
+
+// cardMediaRoots are the folders removable media are mounted in. Cards are
+// looked for there too, besides the FAT and exFAT filesystems in the mount
+// table, for systems without one and for cards mounted through FUSE.
+var cardMediaRoots = defaultCardMediaRoots()
+
+func defaultCardMediaRoots() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"/Volumes"}
+	case "linux":
+		// Without a user name these would be /media and /run/media
+		// themselves, which hold the per-user folders rather than cards.
+		if user := os.Getenv("USER"); user != "" {
+			return []string{filepath.Join("/media", user), filepath.Join("/run/media", user)}
+		}
+	}
+	return nil
+}
+
+// cardFilesystemTypes are the filesystems cameras format cards with, as the
+// mount table names them.
+var cardFilesystemTypes = map[string]bool{"vfat": true, "exfat": true}
+
+// cardFilesystemMounts returns the mount points of the FAT and exFAT
+// filesystems among mount table entries.
+func cardFilesystemMounts(entries []mountEntry) []string {
+	var mountPoints []string
+	for _, m := range entries {
+		if cardFilesystemTypes[m.fsType] {
+			mountPoints = append(mountPoints, m.mountPoint)
+		}
+	}
+	return mountPoints
+}
+
+// findCardMountPoints returns, sorted, every mounted FAT or exFAT filesystem
+// and every folder under the media roots that holds a supported camera
+// folder.
+func findCardMountPoints() []string {
+	candidates := mountedCardFilesystems()
+	for _, root := range cardMediaRoots {
+		dirs, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				candidates = append(candidates, filepath.Join(root, dir.Name()))
+			}
+		}
+	}
+	sort.Strings(candidates)
+	var mountPoints []string
+	for i, mountPoint := range candidates {
+		if i > 0 && mountPoint == candidates[i-1] {
+			continue
+		}
+		if findCameraDirectory(mountPoint) != "" {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	return mountPoints
+}
+
+// identifyCard reads the label, UUID and camera brands of the card mounted
+// at mountPoint.
+func identifyCard(mountPoint string) sdCard {
+	card := sdCard{MountPoint: mountPoint, Label: filepath.Base(mountPoint), UUID: cardUUID(mountPoint), Brands: []string{}}
+	card.ID = card.UUID
+	if card.ID == "" {
+		card.ID = card.Label
+	}
+	seen := make(map[string]bool)
+	for _, dir := range findCameraDirectories(mountPoint) {
+		if brand := detectCameraBrand(dir); brand != nil && !seen[brand.name] {
+			seen[brand.name] = true
+			card.Brands = append(card.Brands, brand.name)
+		}
+	}
+	sort.Strings(card.Brands)
+	return card
+}
+
+// mountEntry is a line of /proc/self/mountinfo.
+type mountEntry struct {
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// parseMountInfo parses the contents of /proc/self/mountinfo (see proc(5)).
+func parseMountInfo(data string) []mountEntry {
+	var entries []mountEntry
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		entries = append(entries, mountEntry{
+			mountPoint: unescapeMountField(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountField(fields[sep+2]),
+		})
+	}
+	return entries
+}
+
+// unescapeMountField undoes the octal escapes (\040 for a space) the kernel
+// writes in mount table fields.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// countNewCardFiles counts the files on a card the import would consider
+// with each camera's default options, and how many of them aren't in the
+// library yet.
+func countNewCardFiles(mountPoint string) (total, newFiles int) {
+	library := refreshLibraryIndex()
+	for _, cameraDir := range findCameraDirectories(mountPoint) {
+		opts := resolveImportOptions(cameraDir, nil, nil, nil)
+		sourceDir := filepath.Join(mountPoint, "DCIM", cameraDir)
+		entries, err := os.ReadDir(sourceDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			lowerName := strings.ToLower(name)
+			if entry.IsDir() || strings.HasPrefix(name, "._") {
+				continue
+			}
+			isJpg := strings.HasSuffix(lowerName, ".jpg")
+			isMp4 := strings.HasSuffix(lowerName, ".mp4")
+			if !isJpg && (!isMp4 || !opts.importVideos) && (!isRawFile(name) || !opts.importRaws) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			total++
+			if duplicateClass(library, filepath.Join(sourceDir, name), info, cameraDir) != duplicateTrue {
+				newFiles++
+			}
+		}
+	}
+	return total, newFiles
+}
+
+// cardScanner remembers the cards found by the last scan.
+type cardScanner struct {
+	mu    sync.Mutex
+	cards map[string]sdCard // by mount point; nil before the first scan
+}
+
+// scan compares the cards mounted at mountPoints with those of the last scan
+// and returns the cards inserted and removed since. Cards present at the
+// first scan count as neither.
+func (s *cardScanner) scan(mountPoints []string) (inserted, removed []sdCard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := s.cards == nil
+	current := make(map[string]sdCard, len(mountPoints))
+	for _, mountPoint := range mountPoints {
+		if card, ok := s.cards[mountPoint]; ok {
+			current[mountPoint] = card
+			continue
+		}
+		card := identifyCard(mountPoint)
+		current[mountPoint] = card
+		if !first {
+			inserted = append(inserted, card)
+		}
+	}
+	for mountPoint, card := range s.cards {
+		if _, ok := current[mountPoint]; !ok {
+			removed = append(removed, card)
+		}
+	}
+	s.cards = current
+	return inserted, removed
+}
+
+// watchCards looks for cards being inserted and removed until ctx is done,
+// and tells connected clients. An inserted card is announced with how many
+// of its files haven't been imported yet, once they are counted.
+func watchCards(ctx context.Context) {
+	changes, err := mountChanges(ctx)
+	if err != nil {
+		log.Printf("Polling for SD cards every %v: %v", cardPollInterval, err)
+	}
+	ticker := time.NewTicker(cardPollInterval)
+	defer ticker.Stop()
+	var scanner cardScanner
+	for {
+		inserted, removed := scanner.scan(findCardMountPoints())
+		for _, card := range removed {
+			log.Printf("Card %s removed from %s", card.Label, card.MountPoint)
+			publishEvent(map[string]interface{}{
+				"type":    "card_removed",
+				"card":    card,
+				"message": fmt.Sprintf("Card %s removed", card.Label),
+			})
+		}
+		for _, card := range inserted {
+			go announceCard(card)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+	}
+}
+
+func announceCard(card sdCard) {
+	total, newFiles := countNewCardFiles(card.MountPoint)
+	log.Printf("Card %s inserted at %s: %d new files of %d", card.Label, card.MountPoint, newFiles, total)
+	publishEvent(map[string]interface{}{
+		"type":        "card_inserted",
+		"card":        card,
+		"total_files": total,
+		"new_files":   newFiles,
+		"message":     fmt.Sprintf("Card %s inserted: %d new files since last import", card.Label, newFiles),
+	})
+}
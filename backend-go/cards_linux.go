@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// mountChanges signals on the returned channel whenever the mount table
+// changes, until ctx is done. The kernel flags /proc/self/mountinfo with
+// POLLPRI on every mount and unmount.
+func mountChanges(ctx context.Context) (<-chan struct{}, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fd := int(f.Fd())
+	event := syscall.EpollEvent{Events: syscall.EPOLLPRI | syscall.EPOLLERR, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		syscall.Close(epfd)
+		f.Close()
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer f.Close()
+		defer syscall.Close(epfd)
+		events := make([]syscall.EpollEvent, 1)
+		// Wake up every second to notice ctx being done.
+		for ctx.Err() == nil {
+			n, err := syscall.EpollWait(epfd, events, 1000)
+			if err != nil && err != syscall.EINTR {
+				return
+			}
+			if n > 0 {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// mountedCardFilesystems returns the mount points of the FAT and exFAT
+// filesystems in the mount table, wherever they are mounted: udisks2 uses
+// /run/media/$USER on some distributions and /media/$USER on others.
+func mountedCardFilesystems() []string {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	return cardFilesystemMounts(parseMountInfo(string(data)))
+}
+
+// cardUUID returns the filesystem UUID of the device mounted at mountPoint,
+// as udev lists it in /dev/disk/by-uuid, or "" if it can't be found.
+func cardUUID(mountPoint string) string {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	var device string
+	for _, m := range parseMountInfo(string(data)) {
+		if m.mountPoint == mountPoint {
+			device = m.source // the last mount wins, as in the mount table
+		}
+	}
+	if device == "" {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	links, err := os.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return ""
+	}
+	for _, link := range links {
+		target, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-uuid", link.Name()))
+		if err == nil && target == device {
+			return link.Name()
+		}
+	}
+	return ""
+}
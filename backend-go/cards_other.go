@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// mountChanges has no implementation here; watchCards polls.
+func mountChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("mount table notifications are only available on Linux")
+}
+
+// mountedCardFilesystems has no mount table to read here; cards are found
+// under cardMediaRoots.
+func mountedCardFilesystems() []string {
+	return nil
+}
+
+// cardUUID isn't known here; cards are identified by their label.
+func cardUUID(mountPoint string) string {
+	return ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	data := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"98 22 179:1 / /media/ana/EOS\\040R6 rw,nosuid,nodev shared:50 - exfat /dev/mmcblk0p1 rw,uid=1000\n"
+	entries := parseMountInfo(data)
+	if len(entries) != 2 {
+		t.Fatalf("parseMountInfo() = %+v, want 2 entries", entries)
+	}
+	if m := entries[1]; m.mountPoint != "/media/ana/EOS R6" || m.fsType != "exfat" || m.source != "/dev/mmcblk0p1" {
+		t.Errorf("card entry = %+v, want /media/ana/EOS R6 on exfat /dev/mmcblk0p1", m)
+	}
+
+	data += "99 22 8:17 / /run/media/ana/NIKON\\040Z6 rw,nosuid,nodev shared:51 - vfat /dev/sdb1 rw\n"
+	if got := cardFilesystemMounts(parseMountInfo(data)); !reflect.DeepEqual(got, []string{"/media/ana/EOS R6", "/run/media/ana/NIKON Z6"}) {
+		t.Errorf("cardFilesystemMounts() = %q, want the exFAT and FAT mounts", got)
+	}
+}
+
+func TestCardScannerReportsInsertedAndRemovedCards(t *testing.T) {
+	canon := filepath.Dir(filepath.Dir(writeCardFiles(t, "100CANON", sampleNameFields.taken, "IMG_0001.JPG")))
+	fuji := filepath.Dir(filepath.Dir(writeCardFiles(t, "100_FUJI", sampleNameFields.taken, "DSCF0001.JPG")))
+
+	var s cardScanner
+	if inserted, removed := s.scan([]string{canon}); len(inserted) != 0 || len(removed) != 0 {
+		t.Errorf("first scan = %v, %v; want cards already present left alone", inserted, removed)
+	}
+	inserted, removed := s.scan([]string{fuji})
+	if len(inserted) != 1 || inserted[0].MountPoint != fuji || len(inserted[0].Brands) != 1 || inserted[0].Brands[0] != "Fujifilm" {
+		t.Errorf("inserted = %+v, want the Fujifilm card", inserted)
+	}
+	if len(removed) != 1 || removed[0].MountPoint != canon || removed[0].ID == "" {
+		t.Errorf("removed = %+v, want the Canon card", removed)
+	}
+}
+
+func TestCountNewCardFiles(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	cardDir := writeCardFiles(t, "100CANON", sampleNameFields.taken, "IMG_0001.JPG", "IMG_0002.JPG", "IMG_0002.CR3")
+	data, _ := os.ReadFile(filepath.Join(cardDir, "IMG_0001.JPG"))
+	os.WriteFile(filepath.Join(session, "100_IMG_0001.JPG"), data, 0644)
+
+	// RAWs aren't imported by default, so only the JPEGs count.
+	if total, newFiles := countNewCardFiles(filepath.Dir(filepath.Dir(cardDir))); total != 2 || newFiles != 1 {
+		t.Errorf("countNewCardFiles() = %d, %d; want 2 files, 1 new", total, newFiles)
+	}
+}
+
+func TestCardMountPointChoosesCard(t *testing.T) {
+	root := t.TempDir()
+	saved := cardMediaRoots
+	cardMediaRoots = []string{root}
+	t.Cleanup(func() { cardMediaRoots = saved })
+
+	if _, err := cardMountPoint(""); !errors.Is(err, errNoCard) {
+		t.Errorf("with no card cardMountPoint() error = %v, want errNoCard", err)
+	}
+	os.MkdirAll(filepath.Join(root, "EOS", "DCIM", "100CANON"), 0755)
+	if mountPoint, err := cardMountPoint(""); err != nil || mountPoint != filepath.Join(root, "EOS") {
+		t.Errorf("with one card cardMountPoint() = %q, %v; want it", mountPoint, err)
+	}
+
+	os.MkdirAll(filepath.Join(root, "X-T5", "DCIM", "100_FUJI"), 0755)
+	if _, err := cardMountPoint(""); !errors.Is(err, errSeveralCards) {
+		t.Errorf("with two cards cardMountPoint() error = %v, want a conflict", err)
+	}
+	cards := listCards()
+	if len(cards) != 2 || cards[1].Label != "X-T5" || cards[1].Brands[0] != "Fujifilm" || cards[1].Capacity == 0 {
+		t.Fatalf("listCards() = %+v, want both cards with their brand and capacity", cards)
+	}
+	if mountPoint, err := cardMountPoint(cards[1].ID); err != nil || mountPoint != filepath.Join(root, "X-T5") {
+		t.Errorf("cardMountPoint(%q) = %q, %v; want the Fujifilm card", cards[1].ID, mountPoint, err)
+	}
+	if _, err := cardMountPoint("nope"); !errors.Is(err, errCardNotPresent) {
+		t.Errorf("cardMountPoint(nope) error = %v, want errCardNotPresent", err)
+	}
+	if message, status := cardErrorResponse(errSeveralCards, ""); status != http.StatusConflict || !strings.Contains(message, "'card'") {
+		t.Errorf("cardErrorResponse(errSeveralCards) = %q, %d; want a conflict asking for 'card'", message, status)
+	}
+}
+
+func TestCardMountPointRefusesSharedID(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	saved := cardMediaRoots
+	cardMediaRoots = roots
+	t.Cleanup(func() { cardMediaRoots = saved })
+	// Two cards with the camera's default label and, outside a real mount,
+	// no UUID.
+	for _, root := range roots {
+		os.MkdirAll(filepath.Join(root, "EOS_DIGITAL", "DCIM", "100CANON"), 0755)
+	}
+
+	_, err := cardMountPoint("EOS_DIGITAL")
+	if !errors.Is(err, errSeveralCards) {
+		t.Fatalf("cardMountPoint(EOS_DIGITAL) error = %v, want errSeveralCards", err)
+	}
+	if _, status := cardErrorResponse(err, "EOS_DIGITAL"); status != http.StatusConflict {
+		t.Errorf("status = %d, want 409", status)
+	}
+}
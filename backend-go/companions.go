@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultCompanionExts are files cameras write next to a photo or video and
+// which share its base name: THM thumbnails of videos, WAV voice memos and
+// audio notes, in-camera XMP and LRV low-resolution proxy videos. Camera
+// profiles can add more with sidecar_extensions.
+var defaultCompanionExts = []string{".THM", ".WAV", ".XMP", ".LRV"}
+
+// isCompanionFile reports whether name has the extension of a companion file.
+func isCompanionFile(name string) bool {
+	ext := strings.ToUpper(filepath.Ext(name))
+	for _, e := range defaultCompanionExts {
+		if ext == e {
+			return true
+		}
+	}
+	for _, brand := range cameraBrands() {
+		for _, e := range brand.sidecarExts {
+			if ext == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPrimaryFile reports whether name is a file companions belong to: a
+// photo, a RAW or a video.
+func isPrimaryFile(name string) bool {
+	lowerName := strings.ToLower(name)
+	return strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".mp4") || isRawFile(name)
+}
+
+// companionStem returns the base name of the file a companion belongs to:
+// IMG_0001 for IMG_0001.WAV, and also for IMG_0001.JPG.xmp, the form some
+// programs name sidecars in.
+func companionStem(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	if isPrimaryFile(stem) {
+		stem = strings.TrimSuffix(stem, filepath.Ext(stem))
+	}
+	return stem
+}
+
+// groupCompanions indexes the companion files among a DCIM folder's files by
+// the upper-cased base name of the file they belong to.
+func groupCompanions(files []os.FileInfo) map[string][]os.FileInfo {
+	groups := make(map[string][]os.FileInfo)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), "._") || isPrimaryFile(file.Name()) || !isCompanionFile(file.Name()) {
+			continue
+		}
+		stem := strings.ToUpper(companionStem(file.Name()))
+		groups[stem] = append(groups[stem], file)
+	}
+	return groups
+}
+
+// companionDestName names a companion after the session name of its primary
+// file: IMG_0001.WAV next to 100_IMG_0001.JPG becomes 100_IMG_0001.WAV.
+func companionDestName(primaryDest, companion string) string {
+	return strings.TrimSuffix(primaryDest, filepath.Ext(primaryDest)) + companion[len(companionStem(companion)):]
+}
+
+// deleteOrphanedCompanions removes the companion files in dir that belong to
+// one of the given base names once no photo, RAW or video of that base name
+// is left, and returns how many it removed.
+func deleteOrphanedCompanions(dir string, bases map[string]bool) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	remaining := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() && isPrimaryFile(entry.Name()) {
+			remaining[strings.ToUpper(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))] = true
+		}
+	}
+	deleted := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		stem := strings.ToUpper(companionStem(name))
+		if entry.IsDir() || isPrimaryFile(name) || !isCompanionFile(name) || !bases[stem] || remaining[stem] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("Failed to delete companion file %s: %v", name, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestGroupCompanions(t *testing.T) {
+	cardDir := writeCardFiles(t, "100CANON", sampleNameFields.taken,
+		"IMG_0001.JPG", "IMG_0001.CR3", "IMG_0001.WAV", "IMG_0001.JPG.xmp",
+		"MVI_0002.MP4", "MVI_0002.THM", "MVI_0002.LRV", "NOTES.TXT")
+	entries, _ := os.ReadDir(cardDir)
+	var files []os.FileInfo
+	for _, e := range entries {
+		info, _ := e.Info()
+		files = append(files, info)
+	}
+
+	groups := groupCompanions(files)
+	got := map[string][]string{}
+	for stem, group := range groups {
+		for _, f := range group {
+			got[stem] = append(got[stem], f.Name())
+		}
+		sort.Strings(got[stem])
+	}
+	if len(got) != 2 || len(got["IMG_0001"]) != 2 || len(got["MVI_0002"]) != 2 {
+		t.Fatalf("groupCompanions() = %v, want the WAV and XMP of IMG_0001 and the THM and LRV of MVI_0002", got)
+	}
+
+	for companion, want := range map[string]string{
+		"IMG_0001.WAV":     "trip_0007.WAV",
+		"IMG_0001.JPG.xmp": "trip_0007.JPG.xmp",
+	} {
+		if got := companionDestName("trip_0007.JPG", companion); got != want {
+			t.Errorf("companionDestName(%q) = %q, want %q", companion, got, want)
+		}
+	}
+}
+
+func TestDeleteOrphanedCompanions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"100_IMG_0001.CR3", "100_IMG_0001.WAV", "100_IMG_0002.WAV", "100_IMG_0003.WAV"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	// The JPEGs of 0001 and 0002 were just deleted; 0001 still has its RAW.
+	deleted := deleteOrphanedCompanions(dir, map[string]bool{"100_IMG_0001": true, "100_IMG_0002": true})
+	if deleted != 1 {
+		t.Errorf("deleted %d companions, want 1", deleted)
+	}
+	for name, want := range map[string]bool{"100_IMG_0001.WAV": true, "100_IMG_0002.WAV": false, "100_IMG_0003.WAV": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestExportRawCompanions(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(filepath.Join(session, "selected", "raw"), 0755)
+	for _, name := range []string{"100_IMG_0001.CR3", "100_IMG_0001.WAV", "100_IMG_0001.xmp", "100_IMG_0002.WAV"} {
+		os.WriteFile(filepath.Join(session, name), []byte(name), 0644)
+	}
+
+	src := rawSource{path: filepath.Join(session, "100_IMG_0001.CR3"), kind: rawSourceSession}
+	dest := filepath.Join(session, "selected", "raw", "100_IMG_0001.CR3")
+	entries := exportRawCompanions(context.Background(), "batch", src, dest, map[string][]os.DirEntry{})
+	if len(entries) != 1 || entries[0].File != "selected/raw/100_IMG_0001.WAV" {
+		t.Fatalf("exported %+v, want only the voice memo of 100_IMG_0001", entries)
+	}
+	if data, err := os.ReadFile(filepath.Join(session, "selected", "raw", "100_IMG_0001.WAV")); err != nil || string(data) != "100_IMG_0001.WAV" {
+		t.Errorf("exported voice memo = %q (err %v)", data, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// appConfig is the user configuration file, by default
+// ~/.config/camera_rip/config.json. Every field is optional.
+type appConfig struct {
+	// Cameras adds camera profiles, or replaces a built-in profile with the
+	// same name (e.g. "Canon").
+	Cameras []cameraConfig `json:"cameras,omitempty"`
+
+	// SelectionMode is how saving a selection puts photos into selected/:
+	// "copy" (the default), "hardlink", "symlink" or "virtual".
+	SelectionMode string `json:"selection_mode,omitempty"`
+
+	// ArchiveDirs are absolute paths searched for RAWs on export when the
+	// session directory doesn't have them, before falling back to the card.
+	ArchiveDirs []string `json:"archive_dirs,omitempty"`
+
+	// ExportPresets render a session's selection as resized JPEGs.
+	ExportPresets []exportPreset `json:"export_presets,omitempty"`
+
+	// ImportFilenameTemplate names imported files (see nameFields), e.g.
+	// "{date}_{seq}{ext}". Empty keeps <dcim>_<original>.
+	ImportFilenameTemplate string `json:"import_filename_template,omitempty"`
+}
+
+// cameraConfig is a camera profile as written in the config file.
+type cameraConfig struct {
+	Name              string         `json:"name"`
+	FolderPattern     string         `json:"folder_pattern"` // regexp matched against the upper-cased DCIM folder name
+	RawExtensions     []string       `json:"raw_extensions"`
+	SidecarExtensions []string       `json:"sidecar_extensions,omitempty"`
+	ImportDefaults    importDefaults `json:"import_defaults,omitempty"`
+}
+
+// importDefaults are per-camera import options used when an import or preview
+// request does not set them explicitly. Nil means "not configured".
+type importDefaults struct {
+	ImportRaws     *bool `json:"import_raws,omitempty"`
+	ImportVideos   *bool `json:"import_videos,omitempty"`
+	SkipDuplicates *bool `json:"skip_duplicates,omitempty"`
+}
+
+var (
+	configPath string
+
+	// configMu guards currentConfig and activeBrands, which are replaced
+	// wholesale on reload; readers take a snapshot and never mutate it.
+	configMu      sync.RWMutex
+	currentConfig appConfig
+	activeBrands  = supportedBrands
+)
+
+// cameraBrands returns the camera profiles in effect: those from the config
+// file first, then the built-in supportedBrands they don't override.
+func cameraBrands() []cameraBrand {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return activeBrands
+}
+
+// configuredSelectionMode returns the selection mode new selections use when
+// a save request doesn't name one.
+func configuredSelectionMode() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if currentConfig.SelectionMode == "" {
+		return selectionCopy
+	}
+	return currentConfig.SelectionMode
+}
+
+// defaultConfigPath returns ~/.config/camera_rip/config.json (or the
+// platform's equivalent user config directory).
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "camera_rip", "config.json")
+}
+
+// loadConfig reads and validates the config file at path and returns it with
+// the merged camera profiles. A missing file is not an error.
+func loadConfig(path string) (appConfig, []cameraBrand, error) {
+	var cfg appConfig
+	if path == "" {
+		return cfg, supportedBrands, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, supportedBrands, nil
+	}
+	if err != nil {
+		return cfg, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.SelectionMode != "" && !selectionModes[cfg.SelectionMode] {
+		return cfg, nil, fmt.Errorf("%s: selection_mode must be copy, hardlink, symlink or virtual", path)
+	}
+	for i, dir := range cfg.ArchiveDirs {
+		if !filepath.IsAbs(dir) {
+			return cfg, nil, fmt.Errorf("%s: archive_dirs[%d]: %q is not an absolute path", path, i, dir)
+		}
+	}
+	if err := validateExportPresets(cfg.ExportPresets); err != nil {
+		return cfg, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateImportTemplate(cfg.ImportFilenameTemplate); err != nil {
+		return cfg, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	brands, err := mergeCameraBrands(cfg.Cameras)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, brands, nil
+}
+
+// mergeCameraBrands validates configured camera profiles and merges them with
+// the built-in table. Configured profiles come first so their folder patterns
+// win over a built-in one that would also match.
+func mergeCameraBrands(cameras []cameraConfig) ([]cameraBrand, error) {
+	var brands []cameraBrand
+	overridden := make(map[string]bool)
+	for i, c := range cameras {
+		if strings.TrimSpace(c.Name) == "" {
+			return nil, fmt.Errorf("cameras[%d]: name is required", i)
+		}
+		key := strings.ToLower(c.Name)
+		if overridden[key] {
+			return nil, fmt.Errorf("cameras[%d]: duplicate camera %q", i, c.Name)
+		}
+		overridden[key] = true
+		if c.FolderPattern == "" {
+			return nil, fmt.Errorf("camera %q: folder_pattern is required", c.Name)
+		}
+		folder, err := regexp.Compile(c.FolderPattern)
+		if err != nil {
+			return nil, fmt.Errorf("camera %q: invalid folder_pattern: %w", c.Name, err)
+		}
+		rawExts, err := normalizeExtensions(c.RawExtensions)
+		if err != nil {
+			return nil, fmt.Errorf("camera %q: raw_extensions: %w", c.Name, err)
+		}
+		if len(rawExts) == 0 {
+			return nil, fmt.Errorf("camera %q: raw_extensions must list at least one extension", c.Name)
+		}
+		sidecarExts, err := normalizeExtensions(c.SidecarExtensions)
+		if err != nil {
+			return nil, fmt.Errorf("camera %q: sidecar_extensions: %w", c.Name, err)
+		}
+		brands = append(brands, cameraBrand{
+			name:        c.Name,
+			folder:      folder,
+			rawExts:     rawExts,
+			sidecarExts: sidecarExts,
+			defaults:    c.ImportDefaults,
+		})
+	}
+	for _, b := range supportedBrands {
+		if !overridden[strings.ToLower(b.name)] {
+			brands = append(brands, b)
+		}
+	}
+	return brands, nil
+}
+
+// normalizeExtensions upper-cases extensions and adds a missing leading dot.
+func normalizeExtensions(exts []string) ([]string, error) {
+	var out []string
+	for _, ext := range exts {
+		ext = strings.ToUpper(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(ext) < 2 || strings.ContainsAny(ext[1:], `./\ `) {
+			return nil, fmt.Errorf("invalid extension %q", ext)
+		}
+		out = append(out, ext)
+	}
+	return out, nil
+}
+
+// reloadConfig re-reads configPath and swaps in the new configuration. On
+// error the configuration in effect is left untouched.
+func reloadConfig() error {
+	cfg, brands, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	configMu.Lock()
+	currentConfig = cfg
+	activeBrands = brands
+	configMu.Unlock()
+	log.Printf("Loaded configuration from %s (%d camera profiles)", configPath, len(brands))
+	return nil
+}
+
+// configuredArchiveDirs returns the archive directories searched for RAWs.
+func configuredArchiveDirs() []string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig.ArchiveDirs
+}
+
+// configuredImportTemplate returns the filename template for imports, empty
+// for the default <dcim>_<original> names.
+func configuredImportTemplate() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig.ImportFilenameTemplate
+}
+
+// currentExportPresets returns the configured export presets, never nil.
+func currentExportPresets() []exportPreset {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return append([]exportPreset{}, currentConfig.ExportPresets...)
+}
+
+// configuredExportPreset returns the export preset with the given name.
+func configuredExportPreset(name string) (exportPreset, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, p := range currentConfig.ExportPresets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return exportPreset{}, false
+}
+
+// configHandler returns the configuration in effect (GET), or reloads it from
+// disk (POST) so edits apply without restarting the server.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := reloadConfig(); err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+			http.Error(w, "Invalid configuration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cameras := []cameraConfig{}
+	for _, b := range cameraBrands() {
+		cameras = append(cameras, cameraConfig{
+			Name:              b.name,
+			FolderPattern:     b.folder.String(),
+			RawExtensions:     b.rawExts,
+			SidecarExtensions: b.sidecarExts,
+			ImportDefaults:    b.defaults,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":                     configPath,
+		"cameras":                  cameras,
+		"selection_mode":           configuredSelectionMode(),
+		"archive_dirs":             configuredArchiveDirs(),
+		"export_presets":           currentExportPresets(),
+		"import_filename_template": configuredImportTemplate(),
+	})
+}
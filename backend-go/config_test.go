@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigMergesCameraProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"cameras": [
+			{"name": "Leica", "folder_pattern": "^[0-9]{3}LEICA$", "raw_extensions": ["dng"], "sidecar_extensions": [".xmp"],
+			 "import_defaults": {"import_raws": true}},
+			{"name": "canon", "folder_pattern": "^[0-9]{3}EOS[0-9]{2}$", "raw_extensions": [".cr3"]}
+		]
+	}`), 0644)
+
+	_, brands, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if len(brands) != len(supportedBrands)+1 {
+		t.Fatalf("got %d camera profiles, want %d", len(brands), len(supportedBrands)+1)
+	}
+	leica := brands[0]
+	if leica.name != "Leica" || leica.rawExts[0] != ".DNG" || leica.sidecarExts[0] != ".XMP" {
+		t.Errorf("Leica profile = %+v, want upper-cased extensions with a leading dot", leica)
+	}
+	if leica.defaults.ImportRaws == nil || !*leica.defaults.ImportRaws || leica.defaults.SkipDuplicates != nil {
+		t.Errorf("Leica import defaults = %+v, want only import_raws set", leica.defaults)
+	}
+	canons := 0
+	for _, b := range brands {
+		if strings.EqualFold(b.name, "canon") {
+			canons++
+			if b.folder.MatchString("100CANON") {
+				t.Error("built-in Canon pattern still in effect after being overridden")
+			}
+		}
+	}
+	if canons != 1 {
+		t.Errorf("found %d Canon profiles, want the configured one only", canons)
+	}
+}
+
+func TestLoadConfigRejectsInvalidProfiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"bad regexp", `{"cameras": [{"name": "X", "folder_pattern": "([", "raw_extensions": [".X3F"]}]}`, "invalid folder_pattern"},
+		{"no raw extensions", `{"cameras": [{"name": "X", "folder_pattern": "SIGMA"}]}`, "raw_extensions"},
+		{"bad extension", `{"cameras": [{"name": "X", "folder_pattern": "SIGMA", "raw_extensions": ["x/3f"]}]}`, "invalid extension"},
+		{"missing name", `{"cameras": [{"folder_pattern": "SIGMA", "raw_extensions": [".X3F"]}]}`, "name is required"},
+		{"duplicate", `{"cameras": [{"name": "X", "folder_pattern": "A", "raw_extensions": [".X3F"]}, {"name": "x", "folder_pattern": "B", "raw_extensions": [".X3F"]}]}`, "duplicate camera"},
+		{"unknown field", `{"camera": []}`, "unknown field"},
+		{"bad selection mode", `{"selection_mode": "move"}`, "selection_mode"},
+		{"relative archive dir", `{"archive_dirs": ["nas/raws"]}`, "archive_dirs[0]"},
+		{"duplicate preset", `{"export_presets": [{"name": "web", "long_edge": 2048}, {"name": "web", "long_edge": 1024}]}`, "duplicate preset"},
+		{"bad preset metadata", `{"export_presets": [{"name": "web", "metadata": "gps_only"}]}`, "metadata"},
+		{"preset output outside session", `{"export_presets": [{"name": "web", "output_dir": "../web"}]}`, "output_dir"},
+		{"import template without ext", `{"import_filename_template": "{date}_{seq}"}`, "must end with {ext}"},
+		{"unknown template token", `{"import_filename_template": "{lens}_{seq}{ext}"}`, "unknown token {lens}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(tt.config), 0644)
+			_, _, err := loadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfig() error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfigKeepsPreviousOnError(t *testing.T) {
+	defer func(path string, brands []cameraBrand) {
+		configPath = path
+		activeBrands = brands
+	}(configPath, activeBrands)
+
+	configPath = filepath.Join(t.TempDir(), "config.json")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig() with no config file error = %v", err)
+	}
+	if len(cameraBrands()) != len(supportedBrands) {
+		t.Errorf("got %d camera profiles without a config file, want the built-in %d", len(cameraBrands()), len(supportedBrands))
+	}
+
+	os.WriteFile(configPath, []byte(`{"cameras": [{"name": "Sigma", "folder_pattern": "SIGMA", "raw_extensions": [".X3F"],
+		"import_defaults": {"import_videos": true}}]}`), 0644)
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	if brand := detectCameraBrand("100SIGMA"); brand == nil || brand.name != "Sigma" {
+		t.Fatalf("detectCameraBrand(100SIGMA) = %v, want Sigma", brand)
+	}
+	if !isRawFile("SDIM0001.x3f") {
+		t.Error("isRawFile(SDIM0001.x3f) = false after adding the Sigma profile")
+	}
+
+	yes, no := true, false
+	opts := resolveImportOptions("100SIGMA", nil, nil, nil)
+	if !opts.importVideos || opts.importRaws || opts.skipDuplicates {
+		t.Errorf("resolveImportOptions() = %+v, want only the configured import_videos", opts)
+	}
+	if opts := resolveImportOptions("100SIGMA", &yes, &no, nil); !opts.importRaws || opts.importVideos {
+		t.Errorf("resolveImportOptions() = %+v, want request values to win over defaults", opts)
+	}
+
+	os.WriteFile(configPath, []byte(`{"cameras": [{"name": "Sigma", "folder_pattern": "(", "raw_extensions": [".X3F"]}]}`), 0644)
+	if err := reloadConfig(); err == nil {
+		t.Fatal("reloadConfig() accepted an invalid folder_pattern")
+	}
+	if brand := detectCameraBrand("100SIGMA"); brand == nil {
+		t.Error("a failed reload replaced the configuration in effect")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// isoTestBox encodes an ISOBMFF box with a 32-bit size.
+func isoTestBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func isoTestUUIDBox(uuid [16]byte, payload ...[]byte) []byte {
+	return isoTestBox("uuid", append(uuid[:], bytes.Join(payload, nil)...))
+}
+
+// buildCR3 lays out a minimal CR3: ftyp, a free box holding a decoy "CMT2",
+// moov (Canon uuid with CMT1/CMT2/THMB, and a trak pointing at the full-size
+// JPEG), the PRVW uuid, and mdat holding the full-size JPEG followed by
+// sensor data that contains a larger bogus SOI..EOI run.
+func buildCR3(cmt1, cmt2, thumb, preview, full []byte, sensor int) []byte {
+	be := binary.BigEndian
+	ftyp := isoTestBox("ftyp", []byte("crx "), make([]byte, 4), []byte("crx isom"))
+	free := isoTestBox("free", []byte("CMT2 not a TIFF block"))
+
+	thmb := make([]byte, 16)
+	be.PutUint16(thmb[4:], 160)
+	be.PutUint16(thmb[6:], 120)
+	be.PutUint32(thmb[8:], uint32(len(thumb)))
+	canon := isoTestUUIDBox(cr3CanonUUID,
+		isoTestBox("CMT1", cmt1),
+		isoTestBox("CMT2", cmt2),
+		isoTestBox("THMB", thmb, thumb))
+
+	prvw := make([]byte, 16)
+	be.PutUint16(prvw[6:], 1620)
+	be.PutUint16(prvw[8:], 1080)
+	be.PutUint32(prvw[12:], uint32(len(preview)))
+	prvwUUID := isoTestUUIDBox(cr3PreviewUUID, make([]byte, 8), isoTestBox("PRVW", prvw, preview))
+
+	// The chunk offset depends on the moov size, which doesn't depend on the
+	// offset's value, so build moov once to measure it.
+	trak := func(off uint64) []byte {
+		stsz := make([]byte, 16)
+		be.PutUint32(stsz[8:], 1)
+		be.PutUint32(stsz[12:], uint32(len(full)))
+		co64 := make([]byte, 16)
+		be.PutUint32(co64[4:], 1)
+		be.PutUint64(co64[8:], off)
+		stbl := isoTestBox("stbl", isoTestBox("stsz", stsz), isoTestBox("co64", co64))
+		return isoTestBox("trak", isoTestBox("mdia", isoTestBox("minf", stbl)))
+	}
+	moovLen := len(isoTestBox("moov", canon, trak(0)))
+	fullOff := len(ftyp) + len(free) + moovLen + len(prvwUUID) + 8
+	moov := isoTestBox("moov", canon, trak(uint64(fullOff)))
+
+	raw := make([]byte, sensor)
+	if sensor > len(full)+8 {
+		copy(raw[4:], testJPEG(len(full)+4))
+	}
+	mdat := isoTestBox("mdat", full, raw)
+	return bytes.Join([][]byte{ftyp, free, moov, prvwUUID, mdat}, nil)
+}
+
+// countingReaderAt records how many bytes were read through it.
+type countingReaderAt struct {
+	r *bytes.Reader
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestParseCR3(t *testing.T) {
+	cmt1 := buildTIFF(nil, nil)
+	cmt2 := buildTestExifTIFF()
+	thumb, preview, full := testJPEG(300), testJPEG(2000), testJPEG(5000)
+	data := buildCR3(cmt1, cmt2, thumb, preview, full, 1<<20)
+
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	c, err := parseCR3(r, int64(len(data)))
+	if err != nil {
+		t.Fatalf("parseCR3() error = %v", err)
+	}
+	for name, tt := range map[string]struct {
+		rg   byteRange
+		want []byte
+	}{
+		"THMB": {c.thumbnail, thumb},
+		"PRVW": {c.preview, preview},
+		"full": {c.fullJPEG, full},
+	} {
+		got, err := c.read(tt.rg)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s JPEG = %d bytes (err %v), want the %d-byte JPEG", name, len(got), err, len(tt.want))
+		}
+	}
+	for n, want := range map[int][]byte{1: cmt1, 2: cmt2} {
+		if got, err := c.cmtBlock(n); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("cmtBlock(%d) = %d bytes (err %v), want %d", n, len(got), err, len(want))
+		}
+	}
+	if _, err := c.cmtBlock(4); err == nil {
+		t.Error("cmtBlock(4) succeeded for a file without CMT4")
+	}
+	if r.n > 16*1024 {
+		t.Errorf("parseCR3() read %d bytes of a %d-byte file, want only box headers", r.n, len(data))
+	}
+
+	if _, err := parseCR3(bytes.NewReader(buildTestExifTIFF()), 100); err != errNotCR3 {
+		t.Errorf("parseCR3(TIFF) error = %v, want errNotCR3", err)
+	}
+}
+
+func TestExtractCR3PreviewAndMetadata(t *testing.T) {
+	full := testJPEG(5000)
+	path := filepath.Join(t.TempDir(), "IMG_0001.CR3")
+	data := buildCR3(buildTIFF(nil, nil), buildTestExifTIFF(), testJPEG(300), testJPEG(2000), full, 1<<16)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := extractEmbeddedJPEG(path)
+	if err != nil || !bytes.Equal(got, full) {
+		t.Errorf("extractEmbeddedJPEG() = %d bytes (err %v), want the %d-byte full-size JPEG", len(got), err, len(full))
+	}
+
+	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm", Raw: testExifRaw}
+	if meta, err := extractPhotoMetadata(path); err != nil || meta != want {
+		t.Errorf("extractPhotoMetadata() = %+v (err %v), want %+v", meta, err, want)
+	}
+	// Capture-time lookups only read the head of the file.
+	if meta, err := readPhotoMetadata(bytes.NewReader(data[:4096]), 4096, path); err != nil || meta != want {
+		t.Errorf("readPhotoMetadata(head) = %+v (err %v), want %+v", meta, err, want)
+	}
+}
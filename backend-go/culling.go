@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// cullingStateFile holds a session's star ratings, color labels and
+// pick/reject flags, keyed by photo file name.
+const cullingStateFile = ".culling.json"
+
+// Pick/reject flags.
+const (
+	flagPick   = "pick"
+	flagReject = "reject"
+)
+
+// cullingLabels are the color labels a photo can carry, as in Lightroom and
+// Bridge.
+var cullingLabels = map[string]bool{"red": true, "yellow": true, "green": true, "blue": true, "purple": true}
+
+// photoCull is the culling state of one photo. The zero value means
+// "unrated, unlabelled, unflagged".
+type photoCull struct {
+	Rating   int      `json:"rating,omitempty"` // 0-5 stars
+	Label    string   `json:"label,omitempty"`  // one of cullingLabels
+	Flag     string   `json:"flag,omitempty"`   // flagPick, flagReject or ""
+	Keywords []string `json:"keywords,omitempty"`
+	Caption  string   `json:"caption,omitempty"`
+}
+
+func (c photoCull) isZero() bool {
+	return c.Rating == 0 && c.Label == "" && c.Flag == "" && len(c.Keywords) == 0 && c.Caption == ""
+}
+
+type cullingState struct {
+	Photos map[string]photoCull `json:"photos"`
+}
+
+// cullingLocks serializes read-modify-write cycles on a session's culling
+// state; ratings arrive one keystroke at a time and may overlap.
+var cullingLocks sync.Map
+
+func lockCulling(directory string) func() {
+	lockAny, _ := cullingLocks.LoadOrStore(directory, &sync.Mutex{})
+	lock := lockAny.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// loadCulling reads a session's culling state. A session nobody has rated yet
+// yields an empty state.
+func loadCulling(directory string) (cullingState, error) {
+	state := cullingState{Photos: map[string]photoCull{}}
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return state, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cullingStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.Photos == nil {
+		state.Photos = map[string]photoCull{}
+	}
+	return state, nil
+}
+
+func saveCulling(directory string, state cullingState) error {
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, cullingStateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, cullingStateFile))
+}
+
+// cullingUpdate changes some fields of several photos' culling state; nil
+// fields are left as they are.
+type cullingUpdate struct {
+	Rating   *int      `json:"rating"`
+	Label    *string   `json:"label"`
+	Flag     *string   `json:"flag"`
+	Keywords *[]string `json:"keywords"`
+	Caption  *string   `json:"caption"`
+}
+
+func (u cullingUpdate) validate() string {
+	if u.Rating != nil && (*u.Rating < 0 || *u.Rating > 5) {
+		return "rating must be between 0 and 5"
+	}
+	if u.Label != nil && *u.Label != "" && !cullingLabels[*u.Label] {
+		return "label must be one of red, yellow, green, blue, purple or empty"
+	}
+	if u.Flag != nil && *u.Flag != "" && *u.Flag != flagPick && *u.Flag != flagReject {
+		return "flag must be pick, reject or empty"
+	}
+	if u.Rating == nil && u.Label == nil && u.Flag == nil && u.Keywords == nil && u.Caption == nil {
+		return "nothing to update: set rating, label, flag, keywords or caption"
+	}
+	return ""
+}
+
+func (u cullingUpdate) apply(c photoCull) photoCull {
+	if u.Rating != nil {
+		c.Rating = *u.Rating
+	}
+	if u.Label != nil {
+		c.Label = *u.Label
+	}
+	if u.Flag != nil {
+		c.Flag = *u.Flag
+	}
+	if u.Keywords != nil {
+		c.Keywords = *u.Keywords
+	}
+	if u.Caption != nil {
+		c.Caption = *u.Caption
+	}
+	return c
+}
+
+// updateCulling applies an update to the named photos and saves the state.
+// It returns the photos' new culling state.
+func updateCulling(directory string, photos []string, u cullingUpdate) (map[string]photoCull, error) {
+	defer lockCulling(directory)()
+	state, err := loadCulling(directory)
+	if err != nil {
+		return nil, err
+	}
+	updated := make(map[string]photoCull, len(photos))
+	for _, photo := range photos {
+		c := u.apply(state.Photos[photo])
+		if c.isZero() {
+			delete(state.Photos, photo)
+		} else {
+			state.Photos[photo] = c
+		}
+		updated[photo] = c
+	}
+	return updated, saveCulling(directory, state)
+}
+
+// mergeCulling adds culling state read from elsewhere (e.g. XMP sidecars on
+// the card) to a session. Photos that already have a state keep it.
+func mergeCulling(directory string, photos map[string]photoCull) error {
+	if len(photos) == 0 {
+		return nil
+	}
+	defer lockCulling(directory)()
+	state, err := loadCulling(directory)
+	if err != nil {
+		return err
+	}
+	for name, c := range photos {
+		if !c.isZero() && state.Photos[name].isZero() {
+			state.Photos[name] = c
+		}
+	}
+	return saveCulling(directory, state)
+}
+
+// pruneCulling drops the culling state of photos no longer in the session,
+// deleted through the app or outside it, and returns what is left.
+func pruneCulling(directory string) (cullingState, error) {
+	defer lockCulling(directory)()
+	state, err := loadCulling(directory)
+	if err != nil {
+		return state, err
+	}
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return state, err
+	}
+	pruned := false
+	for name := range state.Photos {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			delete(state.Photos, name)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return state, nil
+	}
+	return state, saveCulling(directory, state)
+}
+
+// culledPhotos returns, sorted, the session's photos rated at least minRating
+// stars (and at least one) and not rejected.
+func culledPhotos(directory string, minRating int) ([]string, error) {
+	state, err := pruneCulling(directory)
+	if err != nil {
+		return nil, err
+	}
+	var photos []string
+	for name, c := range state.Photos {
+		if c.Rating >= minRating && c.Rating > 0 && c.Flag != flagReject {
+			photos = append(photos, name)
+		}
+	}
+	sort.Strings(photos)
+	return photos, nil
+}
+
+// cullingHandler reads (GET) or changes (POST) a session's culling state.
+//
+// GET ?directory=...[&min_rating=N][&label=red][&flag=pick] returns
+// {"photos": {name: {rating, label, flag, keywords, caption}}}, optionally
+// filtered.
+//
+// POST {"directory", "photos": [...], "rating"?, "label"?, "flag"?,
+// "keywords"?, "caption"?} sets the given fields on every listed photo and
+// returns their new state.
+func cullingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		directory := r.URL.Query().Get("directory")
+		if !validDirName(directory) {
+			http.Error(w, "Missing or invalid 'directory' query parameter", http.StatusBadRequest)
+			return
+		}
+		minRating := 0
+		if v := r.URL.Query().Get("min_rating"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 5 {
+				http.Error(w, "min_rating must be between 0 and 5", http.StatusBadRequest)
+				return
+			}
+			minRating = n
+		}
+		label := r.URL.Query().Get("label")
+		flag := r.URL.Query().Get("flag")
+
+		state, err := pruneCulling(directory)
+		if err != nil {
+			http.Error(w, "Failed to read culling state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		photos := make(map[string]photoCull)
+		for name, c := range state.Photos {
+			if c.Rating >= minRating && (label == "" || c.Label == label) && (flag == "" || c.Flag == flag) {
+				photos[name] = c
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"photos": photos})
+
+	case http.MethodPost:
+		var data struct {
+			Directory string   `json:"directory"`
+			Photos    []string `json:"photos"`
+			cullingUpdate
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validDirName(data.Directory) || len(data.Photos) == 0 {
+			http.Error(w, "Missing 'directory' or 'photos' in request", http.StatusBadRequest)
+			return
+		}
+		if msg := data.cullingUpdate.validate(); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		dir, err := safePhotoPath(data.Directory)
+		if err != nil {
+			http.Error(w, "Invalid directory", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(dir); err != nil {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		for _, photo := range data.Photos {
+			if !validDirName(photo) {
+				http.Error(w, "Invalid photo name: "+photo, http.StatusBadRequest)
+				return
+			}
+		}
+		updated, err := updateCulling(data.Directory, data.Photos, data.cullingUpdate)
+		if err != nil {
+			http.Error(w, "Failed to save culling state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"photos": updated})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func intPtr(n int) *int          { return &n }
+func stringPtr(s string) *string { return &s }
+
+func TestUpdateCulling(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+
+	if _, err := updateCulling("batch", []string{"a.JPG", "b.JPG"}, cullingUpdate{Rating: intPtr(4)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updateCulling("batch", []string{"a.JPG"}, cullingUpdate{Label: stringPtr("red"), Flag: stringPtr(flagPick)}); err != nil {
+		t.Fatal(err)
+	}
+	// Clearing every field of b removes it from the state file.
+	if _, err := updateCulling("batch", []string{"b.JPG"}, cullingUpdate{Rating: intPtr(0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadCulling("batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]photoCull{"a.JPG": {Rating: 4, Label: "red", Flag: flagPick}}
+	if !reflect.DeepEqual(state.Photos, want) {
+		t.Errorf("culling state = %+v, want %+v", state.Photos, want)
+	}
+}
+
+func TestCullingUpdateValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		u     cullingUpdate
+		valid bool
+	}{
+		{"rating", cullingUpdate{Rating: intPtr(5)}, true},
+		{"clear label", cullingUpdate{Label: stringPtr("")}, true},
+		{"reject", cullingUpdate{Flag: stringPtr(flagReject)}, true},
+		{"rating too high", cullingUpdate{Rating: intPtr(6)}, false},
+		{"negative rating", cullingUpdate{Rating: intPtr(-1)}, false},
+		{"unknown label", cullingUpdate{Label: stringPtr("orange")}, false},
+		{"unknown flag", cullingUpdate{Flag: stringPtr("maybe")}, false},
+		{"empty", cullingUpdate{}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.u.validate() == ""; got != tt.valid {
+			t.Errorf("%s: validate() valid = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestSaveSelectedPhotosMinRating(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	dir := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"1.JPG", "2.JPG", "3.JPG", "4.JPG", "5.JPG"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	updateCulling("batch", []string{"1.JPG"}, cullingUpdate{Rating: intPtr(2)})
+	updateCulling("batch", []string{"2.JPG", "3.JPG"}, cullingUpdate{Rating: intPtr(3)})
+	updateCulling("batch", []string{"3.JPG"}, cullingUpdate{Flag: stringPtr(flagReject)})
+	updateCulling("batch", []string{"4.JPG"}, cullingUpdate{Rating: intPtr(5), Flag: stringPtr(flagPick)})
+
+	rated, err := culledPhotos("batch", 3)
+	if err != nil || !reflect.DeepEqual(rated, []string{"2.JPG", "4.JPG"}) {
+		t.Fatalf("culledPhotos(3) = %v (err %v), want [2.JPG 4.JPG]", rated, err)
+	}
+
+	body := `{"directory": "batch", "selected_files": ["5.JPG"], "min_rating": 3}`
+	rec := httptest.NewRecorder()
+	saveSelectedPhotosHandler(rec, httptest.NewRequest(http.MethodPost, "/api/save", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "selected"))
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	if want := []string{"2.JPG", "4.JPG", "5.JPG"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("selected/ = %v, want %v", got, want)
+	}
+}
+
+func TestCulledPhotosSkipsGoneAndUnratedPhotos(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	dir := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"1.JPG", "2.JPG", "3.JPG"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	updateCulling("batch", []string{"1.JPG", "2.JPG"}, cullingUpdate{Rating: intPtr(4)})
+	updateCulling("batch", []string{"3.JPG"}, cullingUpdate{Label: stringPtr("red")})
+	os.Remove(filepath.Join(dir, "2.JPG"))
+
+	rated, err := culledPhotos("batch", 1)
+	if err != nil || !reflect.DeepEqual(rated, []string{"1.JPG"}) {
+		t.Errorf("culledPhotos(1) = %v (err %v), want [1.JPG]", rated, err)
+	}
+	if state, _ := loadCulling("batch"); len(state.Photos) != 2 {
+		t.Errorf("culling state = %v, want the deleted photo's entry dropped", state.Photos)
+	}
+
+	body := `{"directory": "batch", "selected_files": [], "min_rating": 0}`
+	rec := httptest.NewRecorder()
+	saveSelectedPhotosHandler(rec, httptest.NewRequest(http.MethodPost, "/api/save", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("min_rating 0: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
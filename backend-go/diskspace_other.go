@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// diskSpace isn't available here; cards are listed without their size.
+func diskSpace(path string) (capacity, free uint64) {
+	return 0, 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// downloadFile is one file put into a selection download.
+type downloadFile struct {
+	name string // path inside the archive, e.g. IMG_0001.JPG or raw/IMG_0001.CR3
+	path string
+	info os.FileInfo
+}
+
+// selectionDownloadFiles lists what a selection download of a session
+// contains: the selected photos, and optionally the exported RAWs (with
+// their companion files) and/or XMP sidecars in selected/raw/ under raw/.
+// Selected photos are read from wherever the selection mode keeps them,
+// falling back to the session's own copy for virtual selections.
+func selectionDownloadFiles(directory string, includeRaws, includeSidecars bool) ([]downloadFile, error) {
+	sourceDir, err := safePhotoPath(directory)
+	if err != nil {
+		return nil, err
+	}
+	names, err := selectedFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []downloadFile
+	for _, name := range names {
+		for _, path := range []string{filepath.Join(sourceDir, "selected", name), filepath.Join(sourceDir, name)} {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				files = append(files, downloadFile{name: name, path: path, info: info})
+				break
+			}
+		}
+	}
+
+	if includeRaws || includeSidecars {
+		rawDir := filepath.Join(sourceDir, "selected", "raw")
+		entries, err := os.ReadDir(rawDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			isSidecar := strings.EqualFold(filepath.Ext(name), ".xmp")
+			isRaw := isRawFile(name) || isCompanionFile(name) && !isSidecar
+			if entry.IsDir() || strings.HasPrefix(name, ".") || !(includeRaws && isRaw || includeSidecars && isSidecar) {
+				continue
+			}
+			path := filepath.Join(rawDir, name)
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, downloadFile{name: "raw/" + name, path: path, info: info})
+		}
+	}
+	return files, nil
+}
+
+// archiveWriter abstracts the ZIP and tar writers used for downloads.
+type archiveWriter interface {
+	add(f downloadFile) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+// add stores files without compressing them: JPEGs and RAWs don't shrink, and
+// deflating gigabytes would only slow the download down.
+func (z zipArchive) add(f downloadFile) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(f.info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = f.name
+	header.Method = zip.Store
+	return z.CreateHeader(header)
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (t tarArchive) add(f downloadFile) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(f.info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = f.name
+	header.Format = tar.FormatPAX
+	if err := t.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return t.Writer, nil
+}
+
+// writeSelectionArchive streams files into a ZIP or tar archive on w. Files are
+// copied straight from disk, so nothing is buffered or written to a temp file.
+func writeSelectionArchive(ctx context.Context, w io.Writer, format string, files []downloadFile) error {
+	var archive archiveWriter
+	if format == "tar" {
+		archive = tarArchive{tar.NewWriter(w)}
+	} else {
+		archive = zipArchive{zip.NewWriter(w)}
+	}
+	for _, f := range files {
+		if err := addArchiveFile(ctx, archive, f); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func addArchiveFile(ctx context.Context, archive archiveWriter, f downloadFile) error {
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := archive.add(f)
+	if err != nil {
+		return err
+	}
+	// A tar header promises exactly info.Size() bytes, so a file that grew
+	// since it was listed is cut to that size.
+	_, err = io.Copy(dst, io.LimitReader(contextReader{ctx: ctx, r: src}, f.info.Size()))
+	return err
+}
+
+// downloadSelectionHandler streams a session's selection as an archive.
+//
+// GET ?directory=...[&format=zip|tar][&raw=1][&sidecars=1]
+//
+// The archive is written as it is built, without a Content-Length, so the
+// response is chunked and its size is only bounded by the disk.
+func downloadSelectionHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	directory := query.Get("directory")
+	if !validDirName(directory) {
+		http.Error(w, "Missing or invalid 'directory' query parameter", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		http.Error(w, "format must be zip or tar", http.StatusBadRequest)
+		return
+	}
+
+	files, err := selectionDownloadFiles(directory, query.Get("raw") == "1", query.Get("sidecars") == "1")
+	if err != nil {
+		http.Error(w, "Failed to read selected photos", http.StatusInternalServerError)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "No selected photos to download", http.StatusNotFound)
+		return
+	}
+
+	contentType := "application/zip"
+	if format == "tar" {
+		contentType = "application/x-tar"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": directory + "-selected." + format}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Once the archive has started the status can't change any more; a
+	// failure just truncates the download, which the client will notice.
+	if err := writeSelectionArchive(r.Context(), w, format, files); err != nil {
+		log.Printf("Selection download of %s stopped: %v", directory, err)
+	}
+}
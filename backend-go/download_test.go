@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDownloadSelectionHandler(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	rawDir := filepath.Join(session, "selected", "raw")
+	os.MkdirAll(rawDir, 0755)
+	for _, name := range []string{"a.JPG", "b.JPG", "c.JPG"} {
+		os.WriteFile(filepath.Join(session, name), []byte("jpeg "+name), 0644)
+	}
+	os.WriteFile(filepath.Join(rawDir, "a.CR3"), []byte("raw"), 0644)
+	os.WriteFile(filepath.Join(rawDir, "a.xmp"), []byte("xmp"), 0644)
+	ctx := context.Background()
+	addToSelection(ctx, "batch", []string{"a.JPG"}, selectionSymlink)
+	addToSelection(ctx, "batch", []string{"b.JPG"}, selectionVirtual)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"directory=batch", []string{"a.JPG", "b.JPG"}},
+		{"directory=batch&format=tar&raw=1", []string{"a.JPG", "b.JPG", "raw/a.CR3"}},
+		{"directory=batch&raw=1&sidecars=1", []string{"a.JPG", "b.JPG", "raw/a.CR3", "raw/a.xmp"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		downloadSelectionHandler(rec, httptest.NewRequest("GET", "/api/download-selection?"+tt.query, nil))
+		if rec.Code != 200 {
+			t.Fatalf("%s: status %d: %s", tt.query, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: response has a Content-Length", tt.query)
+		}
+		contents := readTestArchive(t, rec.Header().Get("Content-Type"), rec.Body.Bytes())
+		var names []string
+		for name := range contents {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: archive holds %v, want %v", tt.query, names, tt.want)
+		}
+		if contents["a.JPG"] != "jpeg a.JPG" {
+			t.Errorf("%s: a.JPG = %q, want the session photo's bytes", tt.query, contents["a.JPG"])
+		}
+	}
+}
+
+func readTestArchive(t *testing.T, contentType string, data []byte) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	if contentType == "application/x-tar" {
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(tr)
+			contents[header.Name] = string(b)
+		}
+		return contents
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[f.Name] = string(b)
+	}
+	return contents
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventHeartbeat is how often an idle event stream gets a comment line, so
+// proxies and browsers don't time the connection out.
+const eventHeartbeat = 30 * time.Second
+
+// eventBuffer is how many events a slow client may fall behind before new
+// ones are dropped for it.
+const eventBuffer = 64
+
+// eventClients are the channels of the connected /api/events streams.
+var (
+	eventClientsMu sync.Mutex
+	eventClients   = make(map[chan map[string]interface{}]bool)
+)
+
+// publishEvent sends an event to every connected client. A client whose
+// buffer is full misses it rather than holding up the others.
+func publishEvent(event map[string]interface{}) {
+	eventClientsMu.Lock()
+	defer eventClientsMu.Unlock()
+	for ch := range eventClients {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func subscribeEvents() chan map[string]interface{} {
+	ch := make(chan map[string]interface{}, eventBuffer)
+	eventClientsMu.Lock()
+	eventClients[ch] = true
+	eventClientsMu.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan map[string]interface{}) {
+	eventClientsMu.Lock()
+	delete(eventClients, ch)
+	eventClientsMu.Unlock()
+}
+
+// eventsHandler streams server events as Server-Sent Events, one JSON object
+// with a "type" field per message, until the client goes away.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
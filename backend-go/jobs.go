@@ -0,0 +1,659 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// importJobStateFile is written into the session directory when an import
+// starts and updated when it finishes, so an import interrupted by a crash,
+// a cancel or a removed card can be resumed later.
+const importJobStateFile = ".import-job.json"
+
+// Import job statuses. Every status other than jobRunning and jobDone can be
+// resumed with /api/import-resume.
+const (
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobCancelled   = "cancelled"
+	jobInterrupted = "interrupted"
+)
+
+// importJobFile is one file planned for copying by an import job.
+type importJobFile struct {
+	Src      string `json:"src"` // relative to the card mount point, e.g. DCIM/100CANON/IMG_0001.JPG
+	DestName string `json:"dest_name"`
+	Size     int64  `json:"size"`
+	IsMedia  bool   `json:"is_media"`          // jpg or raw — included in thumbnail generation
+	Sidecar  string `json:"sidecar,omitempty"` // XMP sidecar on the card, relative like Src
+
+	// Companion marks a file imported along with its shot, such as a voice
+	// memo; see defaultCompanionExts.
+	Companion bool `json:"companion,omitempty"`
+}
+
+// importJobState is the persisted form of an import job.
+type importJobState struct {
+	ID                string          `json:"id"`
+	Directory         string          `json:"directory"`
+	Status            string          `json:"status"`
+	IsNewBatch        bool            `json:"is_new_batch"`
+	SkippedDuplicates int             `json:"skipped_duplicates"`
+	NameCollisions    int             `json:"name_collisions,omitempty"` // planned files sharing a name with different content in the library
+	Card              string          `json:"card,omitempty"`            // ID of the card imported from, see sdCard
+	Started           time.Time       `json:"started"`
+	Files             []importJobFile `json:"files"`
+}
+
+// importJob is an import running in the background, decoupled from the HTTP
+// request that started it. Clients observe it through its NDJSON event log,
+// which any number of requests can replay and follow (see streamImportJob).
+type importJob struct {
+	state  importJobState
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	events []map[string]interface{}
+	copied int
+	notify chan struct{} // closed and replaced whenever events or status change
+}
+
+// importJobs holds the import jobs started since the server came up, keyed by
+// job ID. Finished jobs are kept for finishedJobRetention so a client can
+// still fetch the outcome; after that their state file in the session has it.
+var importJobs sync.Map
+
+// runningImports maps a session directory to the job importing into it, so
+// at most one job copies into a directory at a time.
+var runningImports sync.Map
+
+// finishedJobRetention is how long a finished job stays in importJobs.
+const finishedJobRetention = time.Hour
+
+// errImportRunning is returned by startImportJob when another job is already
+// importing into the directory.
+var errImportRunning = errors.New("an import into this directory is already running")
+
+func newImportJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (j *importJob) emit(event map[string]interface{}) {
+	event["job_id"] = j.state.ID
+	j.mu.Lock()
+	j.events = append(j.events, event)
+	close(j.notify)
+	j.notify = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// snapshot returns the events after the first n, a channel closed on the next
+// change, and whether the job has finished.
+func (j *importJob) snapshot(n int) ([]map[string]interface{}, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var events []map[string]interface{}
+	if n < len(j.events) {
+		events = append(events, j.events[n:]...)
+	}
+	return events, j.notify, j.state.Status != jobRunning
+}
+
+func (j *importJob) summary() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return map[string]interface{}{
+		"id":        j.state.ID,
+		"directory": j.state.Directory,
+		"status":    j.state.Status,
+		"copied":    j.copied,
+		"total":     len(j.state.Files),
+		"started":   j.state.Started,
+	}
+}
+
+func (j *importJob) setStatus(status string) {
+	j.mu.Lock()
+	j.state.Status = status
+	close(j.notify)
+	j.notify = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// saveImportJobState writes state into its session directory.
+func saveImportJobState(state importJobState) error {
+	dir, err := safePhotoPath(state.Directory)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, importJobStateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, importJobStateFile))
+}
+
+// loadImportJobState reads the persisted job of a session directory.
+func loadImportJobState(directory string) (importJobState, error) {
+	var state importJobState
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return state, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, importJobStateFile))
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	// A state still marked running with no live job means the server stopped
+	// mid-import.
+	if state.Status == jobRunning && findImportJob(state.ID) == nil {
+		state.Status = jobInterrupted
+	}
+	state.Directory = directory
+	return state, nil
+}
+
+func findImportJob(id string) *importJob {
+	if v, ok := importJobs.Load(id); ok {
+		return v.(*importJob)
+	}
+	return nil
+}
+
+// runningJobForDirectory returns the live job importing into directory, if any.
+func runningJobForDirectory(directory string) *importJob {
+	if v, ok := runningImports.Load(directory); ok {
+		return v.(*importJob)
+	}
+	return nil
+}
+
+// startImportJob registers state as a running job, persists it, and copies
+// its files from the card at mountPoint in the background. It fails with
+// errImportRunning if a job is already importing into the same directory.
+func startImportJob(state importJobState, mountPoint string) (*importJob, error) {
+	state.Status = jobRunning
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &importJob{state: state, cancel: cancel, notify: make(chan struct{})}
+	if _, loaded := runningImports.LoadOrStore(state.Directory, job); loaded {
+		cancel()
+		return nil, errImportRunning
+	}
+	if err := saveImportJobState(state); err != nil {
+		runningImports.Delete(state.Directory)
+		cancel()
+		return nil, err
+	}
+	importJobs.Store(state.ID, job)
+	go runImportJob(ctx, job, mountPoint)
+	return job, nil
+}
+
+// runImportJob performs the copy loop of an import job. Every copy is
+// checksum-verified and recorded in the session's import manifest. Files
+// already present in the destination with the expected size are counted as
+// copied without copying them again, which is what lets a resumed job pick up
+// where it stopped; anything else (missing or truncated) is copied again.
+func runImportJob(ctx context.Context, job *importJob, mountPoint string) {
+	state := job.state
+	destinationDir, err := safePhotoPath(state.Directory)
+	if err != nil {
+		job.emit(map[string]interface{}{"type": "error", "message": "Invalid destination directory"})
+		job.finish(jobInterrupted)
+		return
+	}
+	total := len(state.Files)
+	job.emit(map[string]interface{}{"type": "start", "total": total})
+
+	// Throttle progress events to at most ~100 over the whole import.
+	step := total / 100
+	if step < 1 {
+		step = 1
+	}
+
+	// Files recorded by an earlier attempt don't need to be hashed again when
+	// resuming.
+	recorded := make(map[string]manifestEntry)
+	if m, err := loadManifest(state.Directory); err == nil {
+		for _, e := range m.Entries {
+			recorded[e.File] = e
+		}
+	}
+	var pending []manifestEntry
+	flushManifest := func() {
+		if err := recordManifestEntries(state.Directory, pending); err != nil {
+			log.Printf("Failed to update import manifest for %s: %v", state.Directory, err)
+		}
+		pending = pending[:0]
+	}
+
+	// Ratings and keywords from XMP sidecars on the card are added to the
+	// session's culling state once the files are in.
+	sidecars := make(map[string]photoCull)
+	readSidecar := func(item importJobFile) {
+		if item.Sidecar == "" {
+			return
+		}
+		c, _, err := readXMPSidecar(filepath.Join(mountPoint, item.Sidecar))
+		if err != nil {
+			log.Printf("Failed to read XMP sidecar %s: %v", item.Sidecar, err)
+			return
+		}
+		sidecars[item.DestName] = c
+	}
+	flushSidecars := func() {
+		if err := mergeCulling(state.Directory, sidecars); err != nil {
+			log.Printf("Failed to import XMP sidecars into %s: %v", state.Directory, err)
+		}
+	}
+
+	copiedCount := 0
+	companionCount := 0
+	resumedCount := 0
+	verifyFailed := 0
+	var copiedFiles []string
+	stop := func(status string, event map[string]interface{}) {
+		flushManifest()
+		flushSidecars()
+		job.emit(event)
+		job.finish(status)
+		go preGenerateThumbnails(state.Directory, copiedFiles)
+	}
+	cancelled := func() {
+		stop(jobCancelled, map[string]interface{}{
+			"type":    "cancelled",
+			"message": "Import cancelled after " + strconv.Itoa(copiedCount) + " of " + strconv.Itoa(total) + " files.",
+			"copied":  copiedCount,
+			"total":   total,
+		})
+	}
+	for _, item := range state.Files {
+		if ctx.Err() != nil {
+			cancelled()
+			return
+		}
+
+		src := filepath.Join(mountPoint, item.Src)
+		dest := filepath.Join(destinationDir, item.DestName)
+		entry, err := resumedManifestEntry(ctx, item, src, dest, recorded)
+		if err == nil {
+			resumedCount++
+		} else {
+			entry, err = importFileVerified(ctx, item, src, dest)
+			if err == nil {
+				copiedCount++
+				if item.Companion {
+					companionCount++
+				}
+				if item.IsMedia {
+					copiedFiles = append(copiedFiles, item.DestName)
+				}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				cancelled()
+				return
+			}
+			var vErr *verifyError
+			if errors.As(err, &vErr) {
+				log.Printf("Verification failed for %s: %v", item.Src, err)
+				verifyFailed++
+				job.emit(map[string]interface{}{
+					"type":    "verify_failed",
+					"file":    item.DestName,
+					"source":  item.Src,
+					"message": "Copy of " + item.Src + " did not match the card and was discarded.",
+				})
+				continue
+			}
+			log.Printf("Failed to copy %s: %v", item.Src, err)
+			// A source that has vanished mid-import almost always means the
+			// card was removed; stop so the job can be resumed once it is back.
+			if _, statErr := os.Stat(src); statErr != nil {
+				stop(jobInterrupted, map[string]interface{}{
+					"type":    "error",
+					"message": "Import interrupted after " + strconv.Itoa(copiedCount) + " of " + strconv.Itoa(total) + " files. Reconnect the card and resume the import.",
+					"copied":  copiedCount,
+					"total":   total,
+				})
+				return
+			}
+			continue
+		}
+		if _, ok := recorded[entry.File]; !ok {
+			pending = append(pending, entry)
+		}
+		readSidecar(item)
+
+		// Progress counts files already in place too, so a resumed job's bar
+		// starts where the interrupted one stopped.
+		processed := copiedCount + resumedCount
+		job.mu.Lock()
+		job.copied = processed
+		job.mu.Unlock()
+		if processed == total || processed%step == 0 {
+			flushManifest()
+			job.emit(map[string]interface{}{"type": "progress", "copied": processed, "total": total})
+		}
+	}
+	flushManifest()
+	flushSidecars()
+
+	// Start async thumbnail generation for imported photos
+	go func() {
+		log.Printf("Starting background thumbnail generation for imported directory: %s (%d photos)", state.Directory, len(copiedFiles))
+		preGenerateThumbnails(state.Directory, copiedFiles)
+	}()
+
+	message := "Successfully copied " + strconv.Itoa(copiedCount) + " new files"
+	if companionCount > 0 {
+		message += " (including " + strconv.Itoa(companionCount) + " companion files)"
+	}
+	if !state.IsNewBatch {
+		message += " to " + state.Directory
+	}
+	message += "."
+	if resumedCount > 0 {
+		message += " " + strconv.Itoa(resumedCount) + " were already copied by an earlier attempt."
+	}
+	if state.SkippedDuplicates > 0 {
+		message += " Skipped " + strconv.Itoa(state.SkippedDuplicates) + " already imported."
+	}
+	if state.NameCollisions > 0 {
+		message += " " + strconv.Itoa(state.NameCollisions) + " share a name with a different photo in the library and were imported anyway."
+	}
+	if verifyFailed > 0 {
+		message += " " + strconv.Itoa(verifyFailed) + " failed checksum verification and were not imported — check the card reader and resume the import."
+	}
+
+	var newDirectory interface{}
+	if state.IsNewBatch {
+		newDirectory = state.Directory
+	}
+	status := jobDone
+	if verifyFailed > 0 {
+		// Leave the job resumable so the failed files can be retried.
+		status = jobInterrupted
+	}
+	job.emit(map[string]interface{}{
+		"type":               "done",
+		"message":            message,
+		"new_directory":      newDirectory,
+		"copied":             copiedCount,
+		"companions":         companionCount,
+		"resumed":            resumedCount,
+		"verify_failed":      verifyFailed,
+		"skipped_duplicates": state.SkippedDuplicates,
+		"name_collisions":    state.NameCollisions,
+	})
+	job.finish(status)
+}
+
+// importFileVerified copies one planned file and returns its manifest entry.
+func importFileVerified(ctx context.Context, item importJobFile, src, dest string) (manifestEntry, error) {
+	size, sum, err := copyFileVerified(ctx, src, dest)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return newImportManifestEntry(item, dest, size, sum), nil
+}
+
+// resumedManifestEntry returns the manifest entry for a file an earlier
+// attempt already copied in full. A file the manifest doesn't know about yet
+// (the server stopped before recording it) is hashed on both sides before it
+// is trusted. Returns an error if the file has to be copied (again).
+func resumedManifestEntry(ctx context.Context, item importJobFile, src, dest string, recorded map[string]manifestEntry) (manifestEntry, error) {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if info.Size() != item.Size {
+		return manifestEntry{}, fmt.Errorf("%s is truncated (%d of %d bytes)", dest, info.Size(), item.Size)
+	}
+	if e, ok := recorded[item.DestName]; ok && e.Size == item.Size && e.Source == filepath.ToSlash(item.Src) {
+		return e, nil
+	}
+	sum, err := verifyCopy(ctx, src, dest)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return newImportManifestEntry(item, dest, info.Size(), sum), nil
+}
+
+func newImportManifestEntry(item importJobFile, dest string, size int64, sum string) manifestEntry {
+	entry := manifestEntry{
+		File:       item.DestName,
+		Source:     filepath.ToSlash(item.Src),
+		DCIMFolder: filepath.Base(filepath.Dir(item.Src)),
+		Size:       size,
+		SHA256:     sum,
+		Kind:       manifestKindImport,
+		Copied:     time.Now(),
+	}
+	if info, err := os.Stat(dest); err == nil {
+		entry.CaptureTime, _ = fileCaptureTime(dest, info)
+	}
+	return entry
+}
+
+// finish records the final status of a job, both on disk and in memory. The
+// state file is written and the session indexed again first, so whoever sees
+// the job finished also finds its final status on disk and its files in the
+// library index. The directory is free for another import from then on.
+func (j *importJob) finish(status string) {
+	j.mu.Lock()
+	state := j.state
+	j.mu.Unlock()
+	state.Status = status
+	if err := saveImportJobState(state); err != nil {
+		log.Printf("Failed to save import job state for %s: %v", state.Directory, err)
+	}
+	updateLibrarySession(state.Directory)
+	runningImports.CompareAndDelete(state.Directory, j)
+	j.setStatus(status)
+	time.AfterFunc(finishedJobRetention, func() { importJobs.CompareAndDelete(state.ID, j) })
+}
+
+// contextReader aborts a copy as soon as its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// streamImportJob writes the job's NDJSON events after the first from to w,
+// then follows the job until it finishes or the client goes away. A client
+// disconnecting only stops the stream; the job itself keeps running.
+func streamImportJob(w http.ResponseWriter, r *http.Request, job *importJob, from int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	next := from
+	for {
+		events, changed, finished := job.snapshot(next)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return
+			}
+		}
+		next += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished && len(events) == 0 {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// importJobsHandler lists live import jobs and persisted jobs that can be resumed.
+func importJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs := []map[string]interface{}{}
+	seen := make(map[string]bool)
+	importJobs.Range(func(_, v interface{}) bool {
+		job := v.(*importJob)
+		summary := job.summary()
+		seen[job.state.ID] = true
+		jobs = append(jobs, summary)
+		return true
+	})
+
+	// Jobs from before a restart only exist on disk.
+	if entries, err := os.ReadDir(photoBaseDir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() || !validDirName(entry.Name()) {
+				continue
+			}
+			state, err := loadImportJobState(entry.Name())
+			if err != nil || seen[state.ID] || state.Status == jobDone {
+				continue
+			}
+			jobs = append(jobs, map[string]interface{}{
+				"id":        state.ID,
+				"directory": state.Directory,
+				"status":    state.Status,
+				"total":     len(state.Files),
+				"started":   state.Started,
+			})
+		}
+	}
+
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a]["started"].(time.Time).After(jobs[b]["started"].(time.Time))
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// importJobHandler re-attaches to a job's progress stream. The optional
+// "from" parameter skips events the client has already seen.
+func importJobHandler(w http.ResponseWriter, r *http.Request) {
+	job := findImportJob(r.URL.Query().Get("id"))
+	if job == nil {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	if from < 0 {
+		from = 0
+	}
+	streamImportJob(w, r, job, from)
+}
+
+func importCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	job := findImportJob(data.ID)
+	if job == nil {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	job.cancel()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cancelling import " + data.ID})
+}
+
+// importResumeHandler restarts the persisted import job of a session
+// directory and streams its progress like importFromUSBHandler.
+func importResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		Directory string `json:"directory"`
+		Card      string `json:"card"` // see cardMountPoint; defaults to the card the import started from
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !validDirName(data.Directory) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if runningJobForDirectory(data.Directory) != nil {
+		http.Error(w, "An import into this directory is already running", http.StatusConflict)
+		return
+	}
+	state, err := loadImportJobState(data.Directory)
+	if err != nil {
+		http.Error(w, "No import to resume in this directory", http.StatusNotFound)
+		return
+	}
+	if state.Status == jobDone {
+		http.Error(w, "The last import into this directory already completed", http.StatusConflict)
+		return
+	}
+
+	card := data.Card
+	if card == "" {
+		card = state.Card
+	}
+	usbMountPoint, err := cardMountPoint(card)
+	if err != nil {
+		message, status := cardErrorResponse(err, card)
+		http.Error(w, message, status)
+		return
+	}
+
+	// Resuming keeps the original plan but runs under a new ID so clients
+	// following the old job see it end and the new one start cleanly.
+	state.ID = newImportJobID()
+	state.Started = time.Now()
+	job, err := startImportJob(state, usbMountPoint)
+	if errors.Is(err, errImportRunning) {
+		http.Error(w, "An import into this directory is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resume import into %s: %v", data.Directory, err)
+		http.Error(w, fmt.Sprintf("Failed to resume import: %v", err), http.StatusInternalServerError)
+		return
+	}
+	streamImportJob(w, r, job, 0)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportJobResumeSkipsCompleteAndRecopiesTruncated(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	thumbnailCacheDir = filepath.Join(photoBaseDir, ".thumbnails")
+	card := t.TempDir()
+
+	cardDir := filepath.Join(card, "DCIM", "100CANON")
+	if err := os.MkdirAll(cardDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"IMG_0001.JPG": "complete-copy",
+		"IMG_0002.JPG": "truncated-copy",
+		"IMG_0003.JPG": "never-copied",
+	}
+	var plan []importJobFile
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cardDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, importJobFile{
+			Src:      filepath.Join("DCIM", "100CANON", name),
+			DestName: "100_" + name,
+			Size:     int64(len(content)),
+		})
+	}
+
+	// Simulate an earlier attempt that finished one file and died mid-way
+	// through the second.
+	session := filepath.Join(photoBaseDir, "batch")
+	if err := os.MkdirAll(session, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(session, "100_IMG_0001.JPG"), []byte("complete-copy"), 0644)
+	os.WriteFile(filepath.Join(session, "100_IMG_0002.JPG"), []byte("trunc"), 0644)
+
+	job, err := startImportJob(importJobState{ID: newImportJobID(), Directory: "batch", Started: time.Now(), Files: plan}, card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		events, changed, finished := job.snapshot(0)
+		if finished {
+			last := events[len(events)-1]
+			if last["type"] != "done" || last["copied"] != 2 || last["resumed"] != 1 {
+				t.Errorf("final event = %v, want done with 2 copied and 1 resumed", last)
+			}
+			break
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatal("import job did not finish")
+		}
+	}
+
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(session, "100_"+name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s = %q (err %v), want %q", name, got, err, content)
+		}
+	}
+	state, err := loadImportJobState("batch")
+	if err != nil || state.Status != jobDone {
+		t.Errorf("persisted state = %q (err %v), want %q", state.Status, err, jobDone)
+	}
+	if runningJobForDirectory("batch") != nil {
+		t.Error("finished job still holds its directory")
+	}
+}
+
+func TestStartImportJobRefusesSecondJobForDirectory(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+	running := &importJob{state: importJobState{ID: "first", Directory: "batch", Status: jobRunning}}
+	runningImports.Store("batch", running)
+	t.Cleanup(func() { runningImports.Delete("batch") })
+
+	if _, err := startImportJob(importJobState{ID: "second", Directory: "batch"}, t.TempDir()); !errors.Is(err, errImportRunning) {
+		t.Errorf("second startImportJob() error = %v, want errImportRunning", err)
+	}
+	if _, err := os.Stat(filepath.Join(photoBaseDir, "batch", importJobStateFile)); !os.IsNotExist(err) {
+		t.Error("refused job overwrote the running job's state file")
+	}
+}
+
+func TestLoadImportJobStateMarksOrphanedJobInterrupted(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveImportJobState(importJobState{ID: "gone", Directory: "batch", Status: jobRunning}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadImportJobState("batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != jobInterrupted {
+		t.Errorf("status = %q, want %q", state.Status, jobInterrupted)
+	}
+}
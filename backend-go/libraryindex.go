@@ -0,0 +1,686 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// libraryIndexDir, in photoBaseDir, holds the library index: one JSON file
+// per session with its files, their fingerprints and EXIF fields, and its
+// selection. It spares duplicate detection from rehashing the library, and
+// the session and photo listings from reading every directory on every
+// request. A change to a session rewrites that session's file only.
+const libraryIndexDir = ".library-index"
+
+// libraryReconcileInterval is how often the whole library is checked for
+// files changed in place outside the app, which leave no trace in their
+// directory's modification time.
+const libraryReconcileInterval = 10 * time.Minute
+
+// partialHashChunk is how much of the start and of the end of a file goes
+// into its partial hash.
+const partialHashChunk = 32 << 10
+
+// fileFingerprint identifies a file's content without hashing all of it. Two
+// different photos practically never share size, partial hash, capture time
+// and body serial; a renamed copy always does.
+type fileFingerprint struct {
+	Size        int64  `json:"size"`
+	PartialHash string `json:"partial_hash"`           // SHA-256 of the size and the first and last partialHashChunk bytes
+	CaptureTime string `json:"capture_time,omitempty"` // EXIF, as in photoMetadata
+	Serial      string `json:"serial,omitempty"`       // camera body serial number
+}
+
+func (f fileFingerprint) key() string {
+	return fmt.Sprintf("%d/%s/%s/%s", f.Size, f.PartialHash, f.CaptureTime, f.Serial)
+}
+
+// fingerprintFile reads the fingerprint of the file at path.
+func fingerprintFile(path string, info os.FileInfo) (fileFingerprint, error) {
+	fp, _, err := fingerprintFileMetadata(path, info)
+	return fp, err
+}
+
+// fingerprintFileMetadata reads the fingerprint of the file at path along with
+// the EXIF metadata it was taken from, which is zero for files without any.
+func fingerprintFileMetadata(path string, info os.FileInfo) (fileFingerprint, photoMetadata, error) {
+	fp := fileFingerprint{Size: info.Size()}
+	var meta photoMetadata
+	f, err := os.Open(path)
+	if err != nil {
+		return fp, meta, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, fp.Size)
+	if fp.Size <= 2*partialHashChunk {
+		_, err = io.Copy(h, f)
+	} else {
+		_, err = io.Copy(h, io.NewSectionReader(f, 0, partialHashChunk))
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(f, fp.Size-partialHashChunk, partialHashChunk))
+		}
+	}
+	if err != nil {
+		return fp, meta, err
+	}
+	fp.PartialHash = hex.EncodeToString(h.Sum(nil))
+
+	if isPrimaryFile(path) && !strings.HasSuffix(strings.ToLower(path), ".mp4") {
+		if m, err := readPhotoMetadata(f, fp.Size, path); err == nil {
+			meta = m
+			fp.CaptureTime, fp.Serial = meta.CaptureTime, meta.SerialNumber
+		}
+	}
+	return fp, meta, nil
+}
+
+// cardFingerprints caches the fingerprints of card files by path, size and
+// modification time, so a preview followed by an import reads each file once.
+var cardFingerprints sync.Map
+
+func cardFingerprint(path string, info os.FileInfo) (fileFingerprint, error) {
+	cacheKey := fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())
+	if fp, ok := cardFingerprints.Load(cacheKey); ok {
+		return fp.(fileFingerprint), nil
+	}
+	fp, err := fingerprintFile(path, info)
+	if err == nil {
+		cardFingerprints.Store(cacheKey, fp)
+	}
+	return fp, err
+}
+
+// indexedFile is a session file in the library index. Listing a session
+// records size and modification time only; the fingerprint, capture time
+// and camera are filled in by fingerprintPendingFiles.
+type indexedFile struct {
+	ModTime time.Time `json:"mod_time"`
+	Camera  string    `json:"camera,omitempty"` // EXIF model
+	fileFingerprint
+}
+
+// fingerprinted reports whether the file's content has been read.
+func (f indexedFile) fingerprinted() bool {
+	return f.PartialHash != ""
+}
+
+// sameVersion reports whether f and g describe the same version of a file.
+func (f indexedFile) sameVersion(g indexedFile) bool {
+	return f.Size == g.Size && f.ModTime.Equal(g.ModTime)
+}
+
+// indexedSession is a session directory in the library index. ModTime is the
+// directory's own, which changes whenever a file is added or removed, and
+// SelectedModTime that of its selected/ folder; Selected is what
+// selectedFiles returned when either last changed.
+type indexedSession struct {
+	ModTime         time.Time              `json:"mod_time"`
+	SelectedModTime time.Time              `json:"selected_mod_time,omitempty"`
+	Files           map[string]indexedFile `json:"files"`
+	Selected        []string               `json:"selected,omitempty"`
+}
+
+// pending reports whether any of the session's files lacks a fingerprint.
+func (s *indexedSession) pending() bool {
+	for _, f := range s.Files {
+		if !f.fingerprinted() {
+			return true
+		}
+	}
+	return false
+}
+
+// libraryIndex is the whole index. ModTime is photoBaseDir's when it was
+// last listed, which changes whenever a session is created, renamed or
+// removed; it is not saved, so photoBaseDir is listed once per run.
+type libraryIndex struct {
+	ModTime  time.Time
+	Sessions map[string]*indexedSession
+}
+
+// errSessionNotFound is returned for a session that isn't in photoBaseDir.
+var errSessionNotFound = errors.New("session not found")
+
+var (
+	libraryIndexMu   sync.Mutex
+	libIndex         *libraryIndex
+	libraryIndexBase string // the photoBaseDir libIndex was loaded from
+
+	// libraryFingerprintMu serializes fingerprinting passes, which read files
+	// without holding libraryIndexMu.
+	libraryFingerprintMu sync.Mutex
+
+	// libraryFingerprintWake wakes fingerprintLibraryInBackground when a
+	// listing found new or changed files.
+	libraryFingerprintWake = make(chan struct{}, 1)
+)
+
+// libraryLookup is a read-only view of the library index for one import or
+// preview.
+type libraryLookup struct {
+	byKey  map[string][]string // fingerprint key -> session/file
+	byName map[string][]string // upper-cased file name -> session/file
+}
+
+// Duplicate classes reported by libraryLookup.classify.
+const (
+	duplicateTrue      = "duplicate"      // same content already in the library
+	duplicateCollision = "name_collision" // a library file has its name but different content
+	duplicateNew       = "new"
+)
+
+// classify tells whether a card file with fingerprint fp is already in the
+// library, under any name, and otherwise whether one of names is used by a
+// different file.
+func (l libraryLookup) classify(fp fileFingerprint, names ...string) string {
+	if len(l.byKey[fp.key()]) > 0 {
+		return duplicateTrue
+	}
+	for _, name := range names {
+		if len(l.byName[strings.ToUpper(name)]) > 0 {
+			return duplicateCollision
+		}
+	}
+	return duplicateNew
+}
+
+// loadedLibraryIndex returns the library index, loading it from disk the
+// first time and whenever photoBaseDir changed. The caller holds
+// libraryIndexMu.
+func loadedLibraryIndex() *libraryIndex {
+	if libIndex == nil || libraryIndexBase != photoBaseDir {
+		libIndex = loadLibraryIndex(photoBaseDir)
+		libraryIndexBase = photoBaseDir
+	}
+	return libIndex
+}
+
+// sessionModTimes returns the modification times of a session directory and
+// of its selected/ folder (zero when there is none).
+func sessionModTimes(directory string) (dir, selected time.Time, err error) {
+	info, err := os.Stat(filepath.Join(photoBaseDir, directory))
+	if err != nil {
+		return dir, selected, err
+	}
+	if !info.IsDir() {
+		return dir, selected, fmt.Errorf("%s is not a directory", directory)
+	}
+	dir = info.ModTime()
+	if info, err := os.Stat(filepath.Join(photoBaseDir, directory, "selected")); err == nil {
+		selected = info.ModTime()
+	}
+	return dir, selected, nil
+}
+
+// syncIndexedSessions brings the set of sessions in the index up to date with
+// photoBaseDir: new sessions are indexed, vanished ones dropped, and, with
+// all set, every session whose directory changed is indexed again. Without
+// all, the base directory is only listed when its own modification time
+// changed. The caller holds libraryIndexMu.
+func syncIndexedSessions(all bool) {
+	index := loadedLibraryIndex()
+	base, err := os.Stat(photoBaseDir)
+	if err != nil {
+		log.Printf("Failed to read photo directory: %v", err)
+		return
+	}
+	if !all && index.ModTime.Equal(base.ModTime()) {
+		return
+	}
+	dirs, err := os.ReadDir(photoBaseDir)
+	if err != nil {
+		log.Printf("Failed to read photo directory: %v", err)
+		return
+	}
+	index.ModTime = base.ModTime()
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if !dir.IsDir() || !validDirName(dir.Name()) {
+			continue
+		}
+		seen[dir.Name()] = true
+		if s := index.Sessions[dir.Name()]; s != nil && !all {
+			continue
+		}
+		refreshIndexedSession(dir.Name(), false)
+	}
+	for name := range index.Sessions {
+		if !seen[name] {
+			delete(index.Sessions, name)
+			saveIndexedSession(photoBaseDir, name, nil)
+		}
+	}
+}
+
+// refreshIndexedSession lists a session again if its directory or its
+// selected/ folder changed since it was last indexed, or regardless with
+// force, and drops it from the index when it no longer exists. Files new or
+// changed since the last listing are left to the background fingerprinter.
+// It reports whether the index changed, and saves the session's file if so.
+// The caller holds libraryIndexMu.
+func refreshIndexedSession(directory string, force bool) bool {
+	index := loadedLibraryIndex()
+	previous := index.Sessions[directory]
+	modTime, selectedModTime, err := sessionModTimes(directory)
+	if err != nil {
+		if previous == nil {
+			return false
+		}
+		delete(index.Sessions, directory)
+		saveIndexedSession(photoBaseDir, directory, nil)
+		return true
+	}
+	if !force && previous != nil && previous.ModTime.Equal(modTime) && previous.SelectedModTime.Equal(selectedModTime) {
+		return false
+	}
+	s := indexSession(directory, modTime, previous)
+	s.SelectedModTime = selectedModTime
+	index.Sessions[directory] = s
+	if s.pending() {
+		select {
+		case libraryFingerprintWake <- struct{}{}:
+		default:
+		}
+	}
+	if sameIndexedSession(previous, s) {
+		return false
+	}
+	saveIndexedSession(photoBaseDir, directory, s)
+	return true
+}
+
+// refreshLibraryIndex brings the library index up to date and returns a view
+// of it. Only sessions whose directory changed since the last refresh are
+// listed again, and only files whose size or modification time changed are
+// fingerprinted again, without holding up listings meanwhile.
+func refreshLibraryIndex() libraryLookup {
+	libraryIndexMu.Lock()
+	syncIndexedSessions(true)
+	libraryIndexMu.Unlock()
+	fingerprintPendingFiles()
+
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+	lookup := libraryLookup{byKey: make(map[string][]string), byName: make(map[string][]string)}
+	for session, s := range loadedLibraryIndex().Sessions {
+		for name, f := range s.Files {
+			rel := session + "/" + name
+			if f.fingerprinted() {
+				lookup.byKey[f.key()] = append(lookup.byKey[f.key()], rel)
+			}
+			lookup.byName[strings.ToUpper(name)] = append(lookup.byName[strings.ToUpper(name)], rel)
+		}
+	}
+	return lookup
+}
+
+// fingerprintPendingFiles fingerprints the indexed files that have no
+// fingerprint yet: files new or changed since they were last read. Files are
+// read without holding libraryIndexMu, a session at a time, so listings go
+// on meanwhile and an interrupted pass keeps what it did.
+func fingerprintPendingFiles() {
+	libraryFingerprintMu.Lock()
+	defer libraryFingerprintMu.Unlock()
+
+	libraryIndexMu.Lock()
+	var sessions []string
+	for name, s := range loadedLibraryIndex().Sessions {
+		if s.pending() {
+			sessions = append(sessions, name)
+		}
+	}
+	libraryIndexMu.Unlock()
+
+	sort.Strings(sessions)
+	for _, directory := range sessions {
+		fingerprintSession(directory)
+	}
+}
+
+// fingerprintSession fingerprints the pending files of one session.
+func fingerprintSession(directory string) {
+	libraryIndexMu.Lock()
+	base := photoBaseDir
+	var pending []string
+	if s := loadedLibraryIndex().Sessions[directory]; s != nil {
+		for name, f := range s.Files {
+			if !f.fingerprinted() {
+				pending = append(pending, name)
+			}
+		}
+	}
+	libraryIndexMu.Unlock()
+
+	read := make(map[string]indexedFile, len(pending))
+	for _, name := range pending {
+		path := filepath.Join(base, directory, name)
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue // gone; the next listing drops it
+		}
+		fp, meta, err := fingerprintFileMetadata(path, info)
+		if err != nil {
+			log.Printf("Failed to fingerprint %s/%s: %v", directory, name, err)
+			continue
+		}
+		read[name] = indexedFile{ModTime: info.ModTime(), Camera: meta.Model, fileFingerprint: fp}
+	}
+
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+	s := loadedLibraryIndex().Sessions[directory]
+	if s == nil || libraryIndexBase != base {
+		return
+	}
+	changed := false
+	for name, f := range read {
+		// A file that changed again while it was read waits for the next
+		// listing and pass.
+		if g, ok := s.Files[name]; ok && !g.fingerprinted() && g.sameVersion(f) {
+			s.Files[name] = f
+			changed = true
+		}
+	}
+	if changed {
+		saveIndexedSession(base, directory, s)
+	}
+}
+
+// fingerprintLibraryInBackground fingerprints new and changed files whenever
+// a listing found some, for the lifetime of the server.
+func fingerprintLibraryInBackground() {
+	for range libraryFingerprintWake {
+		fingerprintPendingFiles()
+	}
+}
+
+// reconcileLibraryIndex checks every file of every session against the index
+// and picks up whatever changed outside the app, including files modified in
+// place. Sessions are listed one at a time, so requests aren't held up for
+// the whole library, and the files found changed are fingerprinted after.
+func reconcileLibraryIndex() {
+	libraryIndexMu.Lock()
+	syncIndexedSessions(false)
+	names := make([]string, 0, len(libIndex.Sessions))
+	for name := range libIndex.Sessions {
+		names = append(names, name)
+	}
+	libraryIndexMu.Unlock()
+
+	for _, name := range names {
+		libraryIndexMu.Lock()
+		refreshIndexedSession(name, true)
+		libraryIndexMu.Unlock()
+	}
+	fingerprintPendingFiles()
+}
+
+// sameIndexedSession reports whether indexing a session again found nothing
+// new.
+func sameIndexedSession(a, b *indexedSession) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !a.ModTime.Equal(b.ModTime) || !a.SelectedModTime.Equal(b.SelectedModTime) || len(a.Files) != len(b.Files) || strings.Join(a.Selected, "/") != strings.Join(b.Selected, "/") {
+		return false
+	}
+	for name, f := range a.Files {
+		if g, ok := b.Files[name]; !ok || g != f {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcileLibraryIndexPeriodically reconciles the library index now and
+// then every libraryReconcileInterval, for the lifetime of the server.
+func reconcileLibraryIndexPeriodically() {
+	for {
+		start := time.Now()
+		reconcileLibraryIndex()
+		log.Printf("Reconciled library index in %v", time.Since(start).Round(time.Millisecond))
+		time.Sleep(libraryReconcileInterval)
+	}
+}
+
+// indexedSessionNames returns the names of all sessions, listing photoBaseDir
+// again only when it changed.
+func indexedSessionNames() []string {
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	syncIndexedSessions(false)
+	names := make([]string, 0, len(libIndex.Sessions))
+	for name := range libIndex.Sessions {
+		names = append(names, name)
+	}
+	return names
+}
+
+// indexedSessionFiles returns, sorted, the names of a session's files and of
+// its selected files, listing the session again first if it changed.
+func indexedSessionFiles(directory string) (files, selected []string, err error) {
+	if !validDirName(directory) {
+		return nil, nil, fmt.Errorf("invalid session name %q", directory)
+	}
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	refreshIndexedSession(directory, false)
+	s := libIndex.Sessions[directory]
+	if s == nil {
+		return nil, nil, fmt.Errorf("%w: %s", errSessionNotFound, directory)
+	}
+	for name := range s.Files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, append([]string(nil), s.Selected...), nil
+}
+
+// updateLibrarySession indexes a session again right away. Handlers that add,
+// delete or select files call it so the index never lags behind them, even
+// within the resolution of the directory's modification time.
+func updateLibrarySession(directory string) {
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	refreshIndexedSession(directory, true)
+}
+
+// sessionChanges is what indexing a session again found different.
+type sessionChanges struct {
+	Added, Removed, Modified []string
+	SelectionChanged         bool
+}
+
+func (c sessionChanges) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0 && !c.SelectionChanged
+}
+
+// reindexLibrarySession indexes a session again right away, like
+// updateLibrarySession, and reports which of its files and whether its
+// selection changed since it was last indexed.
+func reindexLibrarySession(directory string) sessionChanges {
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	var changes sessionChanges
+	previous := loadedLibraryIndex().Sessions[directory]
+	if !refreshIndexedSession(directory, true) {
+		return changes
+	}
+	current := libIndex.Sessions[directory]
+	var before, after map[string]indexedFile
+	var selectedBefore, selectedAfter []string
+	if previous != nil {
+		before, selectedBefore = previous.Files, previous.Selected
+	}
+	if current != nil {
+		after, selectedAfter = current.Files, current.Selected
+	}
+	for name, f := range after {
+		if g, ok := before[name]; !ok {
+			changes.Added = append(changes.Added, name)
+		} else if !g.sameVersion(f) {
+			changes.Modified = append(changes.Modified, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	changes.SelectionChanged = strings.Join(selectedBefore, "/") != strings.Join(selectedAfter, "/")
+	return changes
+}
+
+// syncLibrarySessions brings the set of sessions in the index up to date
+// with photoBaseDir and reports the sessions that appeared and disappeared.
+func syncLibrarySessions() (added, removed []string) {
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	index := loadedLibraryIndex()
+	before := make(map[string]bool, len(index.Sessions))
+	for name := range index.Sessions {
+		before[name] = true
+	}
+	// List photoBaseDir even if its modification time looks unchanged, but
+	// leave existing sessions to reindexLibrarySession, which reports what
+	// changed in them.
+	index.ModTime = time.Time{}
+	syncIndexedSessions(false)
+	for name := range index.Sessions {
+		if !before[name] {
+			added = append(added, name)
+		}
+		delete(before, name)
+	}
+	for name := range before {
+		removed = append(removed, name)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// renameLibrarySession moves a renamed session's entry in the index, so its
+// files aren't fingerprinted again under the new name.
+func renameLibrarySession(oldName, newName string) {
+	libraryIndexMu.Lock()
+	defer libraryIndexMu.Unlock()
+
+	index := loadedLibraryIndex()
+	if s := index.Sessions[oldName]; s != nil {
+		delete(index.Sessions, oldName)
+		index.Sessions[newName] = s
+		saveIndexedSession(photoBaseDir, oldName, nil)
+		saveIndexedSession(photoBaseDir, newName, s)
+	}
+	refreshIndexedSession(newName, true)
+	syncIndexedSessions(false)
+}
+
+// indexSession lists a session directory, keeping the entries in previous of
+// files that haven't changed, and reads its selection. Other files are
+// recorded with their size and modification time, to be fingerprinted later.
+func indexSession(directory string, modTime time.Time, previous *indexedSession) *indexedSession {
+	s := &indexedSession{ModTime: modTime, Files: make(map[string]indexedFile)}
+	entries, err := os.ReadDir(filepath.Join(photoBaseDir, directory))
+	if err != nil {
+		return s
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f := indexedFile{ModTime: info.ModTime(), fileFingerprint: fileFingerprint{Size: info.Size()}}
+		if previous != nil {
+			if g, ok := previous.Files[name]; ok && g.sameVersion(f) {
+				f = g
+			}
+		}
+		s.Files[name] = f
+	}
+	if s.Selected, err = selectedFiles(directory); err != nil {
+		log.Printf("Failed to read selection of %s: %v", directory, err)
+	}
+	return s
+}
+
+// loadLibraryIndex reads the index file of every session in base. Sessions
+// whose file is missing or unreadable are indexed again when photoBaseDir is
+// first listed.
+func loadLibraryIndex(base string) *libraryIndex {
+	index := &libraryIndex{Sessions: make(map[string]*indexedSession)}
+	dir := filepath.Join(base, libraryIndexDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read library index: %v", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validDirName(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("Failed to read library index of %s: %v", name, err)
+			continue
+		}
+		s := &indexedSession{}
+		if err := json.Unmarshal(data, s); err != nil {
+			log.Printf("Rebuilding unreadable library index of %s: %v", name, err)
+			continue
+		}
+		if s.Files == nil {
+			s.Files = make(map[string]indexedFile)
+		}
+		index.Sessions[name] = s
+	}
+	return index
+}
+
+// saveIndexedSession writes a session's entry in the index of base to its
+// file, or removes the file when s is nil. Failures are logged: the index is
+// only a cache.
+func saveIndexedSession(base, directory string, s *indexedSession) {
+	dir := filepath.Join(base, libraryIndexDir)
+	path := filepath.Join(dir, directory+".json")
+	if s == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove library index of %s: %v", directory, err)
+		}
+		return
+	}
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = writeFileAtomic(dir, path, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save library index of %s: %v", directory, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJPEGTakenAt encodes a JPEG whose EXIF holds the given DateTimeOriginal
+// ("2006:01:02 15:04:05") and body serial number.
+func testJPEGTakenAt(t *testing.T, taken, serial string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := buildTIFF(nil, []testIFDEntry{asciiEntry(0x9003, taken), asciiEntry(0xA431, serial)})
+	return insertEXIF(buf.Bytes(), tiff)
+}
+
+func TestLibraryIndexClassifiesCardFiles(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	imported := testJPEGTakenAt(t, "2025:11:01 14:30:45", "111")
+	os.WriteFile(filepath.Join(session, "100_IMG_0001.JPG"), imported, 0644)
+
+	card := t.TempDir()
+	files := map[string][]byte{
+		"IMG_0001.JPG": imported,                                         // copied before, maybe renamed
+		"IMG_0002.JPG": testJPEGTakenAt(t, "2025:11:02 09:00:00", "111"), // new
+	}
+	for name, data := range files {
+		os.WriteFile(filepath.Join(card, name), data, 0644)
+	}
+	// After a counter rollover the card holds a different IMG_0001.
+	rolledOver := filepath.Join(card, "rolled", "IMG_0001.JPG")
+	os.MkdirAll(filepath.Dir(rolledOver), 0755)
+	os.WriteFile(rolledOver, testJPEGTakenAt(t, "2026:03:04 10:11:12", "111"), 0644)
+
+	library := refreshLibraryIndex()
+	for path, want := range map[string]string{
+		filepath.Join(card, "IMG_0001.JPG"): duplicateTrue,
+		filepath.Join(card, "IMG_0002.JPG"): duplicateNew,
+		rolledOver:                          duplicateCollision,
+	} {
+		info, _ := os.Stat(path)
+		if got := duplicateClass(library, path, info, "100CANON"); got != want {
+			t.Errorf("duplicateClass(%s) = %q, want %q", path, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(photoBaseDir, libraryIndexDir, "trip.json")); err != nil {
+		t.Errorf("library index not saved: %v", err)
+	}
+}
+
+func TestLibraryIndexOnlyRescansChangedSessions(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "a.JPG"), []byte("a"), 0644)
+	refreshLibraryIndex()
+
+	// Tamper with the saved fingerprint: as long as the session directory is
+	// unchanged the index must trust it rather than rehash the file.
+	indexPath := filepath.Join(photoBaseDir, libraryIndexDir, "trip.json")
+	data, _ := os.ReadFile(indexPath)
+	fp, _ := fingerprintFile(filepath.Join(session, "a.JPG"), mustStat(t, filepath.Join(session, "a.JPG")))
+	os.WriteFile(indexPath, []byte(strings.Replace(string(data), fp.PartialHash, "stale", 1)), 0644)
+	libIndex = nil
+
+	if library := refreshLibraryIndex(); len(library.byKey[fp.key()]) != 0 {
+		t.Error("unchanged session was fingerprinted again")
+	}
+
+	// A new file changes the directory: the session is listed again, but
+	// only the new file is fingerprinted.
+	os.WriteFile(filepath.Join(session, "b.JPG"), []byte("b"), 0644)
+	library := refreshLibraryIndex()
+	if len(library.byName["B.JPG"]) != 1 {
+		t.Errorf("changed session not rescanned: %v", library.byName)
+	}
+	if len(library.byKey[fp.key()]) != 0 {
+		t.Error("unchanged file in a changed session was fingerprinted again")
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestImportNamerRenamesRolledOverShots(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+	os.WriteFile(filepath.Join(photoBaseDir, "batch", "100_IMG_0001.JPG"), testJPEGTakenAt(t, "2025:11:01 14:30:45", "111"), 0644)
+
+	for taken, want := range map[string]string{
+		"2025:11:01 14:30:45": "100_IMG_0001.JPG",   // the same shot
+		"2026:03:04 10:11:12": "100_IMG_0001_2.JPG", // after a counter rollover
+	} {
+		cardDir := filepath.Join(t.TempDir(), "DCIM", "100CANON")
+		os.MkdirAll(cardDir, 0755)
+		os.WriteFile(filepath.Join(cardDir, "IMG_0001.JPG"), testJPEGTakenAt(t, taken, "111"), 0644)
+		if got := nameCardFiles(t, newImportNamer("", "batch"), cardDir, "IMG_0001.JPG"); got[0] != want {
+			t.Errorf("IMG_0001.JPG taken %s named %q, want %q", taken, got[0], want)
+		}
+	}
+}
+
+func TestIndexedSessionsFollowHandlers(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "a.JPG"), testJPEGTakenAt(t, "2025:11:01 14:30:45", "111"), 0644)
+	os.WriteFile(filepath.Join(session, "b.JPG"), []byte("b"), 0644)
+	if names := indexedSessionNames(); len(names) != 1 || names[0] != "trip" {
+		t.Fatalf("indexedSessionNames() = %v, want [trip]", names)
+	}
+
+	saveSelection("trip", selectionState{Mode: selectionVirtual, Photos: []string{"a.JPG"}})
+	updateLibrarySession("trip")
+	files, selected, err := indexedSessionFiles("trip")
+	if err != nil || len(files) != 2 || len(selected) != 1 || selected[0] != "a.JPG" {
+		t.Fatalf("indexedSessionFiles(trip) = %v, %v, %v; want both files and a.JPG selected", files, selected, err)
+	}
+
+	refreshLibraryIndex()
+	os.Rename(session, filepath.Join(photoBaseDir, "holiday"))
+	renameLibrarySession("trip", "holiday")
+	if names := indexedSessionNames(); len(names) != 1 || names[0] != "holiday" {
+		t.Errorf("after a rename indexedSessionNames() = %v, want [holiday]", names)
+	}
+	if _, err := os.Stat(filepath.Join(photoBaseDir, libraryIndexDir, "trip.json")); !os.IsNotExist(err) {
+		t.Errorf("index file of the old name left behind: %v", err)
+	}
+	libraryIndexMu.Lock()
+	a := libIndex.Sessions["holiday"].Files["a.JPG"]
+	libraryIndexMu.Unlock()
+	if a.CaptureTime == "" || a.Serial != "111" {
+		t.Errorf("indexed a.JPG = %+v, want its EXIF capture time and serial", a)
+	}
+
+	// A file dropped in by hand shows up as soon as the session is listed.
+	os.WriteFile(filepath.Join(photoBaseDir, "holiday", "c.JPG"), []byte("c"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(photoBaseDir, "holiday"), future, future)
+	if files, _, _ := indexedSessionFiles("holiday"); len(files) != 3 {
+		t.Errorf("indexedSessionFiles(holiday) = %v, want the new file too", files)
+	}
+}
+
+func TestReconcileLibraryIndexPicksUpModifiedFiles(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	path := filepath.Join(session, "a.JPG")
+	os.WriteFile(path, []byte("before"), 0644)
+	indexedSessionNames()
+
+	// Rewriting a file in place leaves its directory's modification time
+	// alone; only a reconcile pass notices.
+	dirInfo := mustStat(t, session)
+	os.WriteFile(path, []byte("after, and longer"), 0644)
+	os.Chtimes(session, dirInfo.ModTime(), dirInfo.ModTime())
+	reconcileLibraryIndex()
+
+	fp, _ := fingerprintFile(path, mustStat(t, path))
+	if library := refreshLibraryIndex(); len(library.byKey[fp.key()]) != 1 {
+		t.Error("reconcile did not fingerprint the modified file again")
+	}
+}
+
+func TestListingsLeaveFingerprintingForLater(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "a.JPG"), testJPEGTakenAt(t, "2025:11:01 14:30:45", "111"), 0644)
+	indexedSessionNames()
+	if files, _, err := indexedSessionFiles("trip"); err != nil || len(files) != 1 {
+		t.Fatalf("indexedSessionFiles(trip) = %v, %v; want a.JPG", files, err)
+	}
+	libraryIndexMu.Lock()
+	a := libIndex.Sessions["trip"].Files["a.JPG"]
+	libraryIndexMu.Unlock()
+	if a.fingerprinted() {
+		t.Error("listing the session fingerprinted a.JPG")
+	}
+
+	fingerprintPendingFiles()
+	libraryIndexMu.Lock()
+	a = libIndex.Sessions["trip"].Files["a.JPG"]
+	libraryIndexMu.Unlock()
+	if !a.fingerprinted() || a.Serial != "111" {
+		t.Errorf("after a fingerprinting pass a.JPG = %+v, want its fingerprint and serial", a)
+	}
+}
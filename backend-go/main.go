@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
@@ -13,19 +15,22 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nfnt/resize"
-	"regexp"
 )
 
 //go:embed all:frontend/build
@@ -38,111 +43,366 @@ var (
 )
 
 type cameraBrand struct {
-	suffix string // DCIM folder suffix, e.g. "CANON", "OLYMP"
-	rawExt string // RAW file extension including dot, e.g. ".CR3", ".ORF"
+	name        string         // e.g. "Canon", "Sony"
+	folder      *regexp.Regexp // DCIM folder name, matched upper-cased, e.g. 100CANON
+	rawExts     []string       // RAW file extensions including dot, e.g. ".CR3", ".ORF"
+	sidecarExts []string       // companion file extensions including dot, e.g. ".WAV"
+	defaults    importDefaults // per-camera import options from the config file
 }
 
+// supportedBrands is the built-in camera table. The config file can add
+// profiles or replace these by name; see cameraBrands.
 var supportedBrands = []cameraBrand{
-	{suffix: "CANON", rawExt: ".CR3"},
-	{suffix: "OLYMP", rawExt: ".ORF"},
-	{suffix: "OMSYS", rawExt: ".ORF"},
+	{name: "Canon", folder: regexp.MustCompile(`^[0-9]{3}CANON$`), rawExts: []string{".CR3", ".CR2"}},
+	{name: "Olympus", folder: regexp.MustCompile(`^[0-9]{3}(OLYMP|OMSYS)$`), rawExts: []string{".ORF"}},
+	{name: "Sony", folder: regexp.MustCompile(`^[0-9]{3}MSDCF$`), rawExts: []string{".ARW"}},
+	// Nikon names folders after the brand (100NIKON) or the body (100ND850, 100NZ_6_).
+	{name: "Nikon", folder: regexp.MustCompile(`^[0-9]{3}N[A-Z0-9_]{4}$`), rawExts: []string{".NEF", ".NRW"}},
+	{name: "Fujifilm", folder: regexp.MustCompile(`^[0-9]{3}_FUJI$`), rawExts: []string{".RAF"}},
+	{name: "Panasonic", folder: regexp.MustCompile(`^[0-9]{3}_PANA$`), rawExts: []string{".RW2"}},
+	// Pentax uses 100PENTX, or 100_MMDD when date-based folders are enabled.
+	{name: "Pentax", folder: regexp.MustCompile(`^[0-9]{3}(PENTX|_[0-9]{4})$`), rawExts: []string{".PEF", ".DNG"}},
 }
 
 func detectCameraBrand(folderName string) *cameraBrand {
 	upper := strings.ToUpper(folderName)
-	for i := range supportedBrands {
-		if strings.HasSuffix(upper, supportedBrands[i].suffix) {
-			return &supportedBrands[i]
+	brands := cameraBrands()
+	for i := range brands {
+		if brands[i].folder.MatchString(upper) {
+			return &brands[i]
 		}
 	}
 	return nil
 }
 
+// importOptions are the import switches in effect for one DCIM folder.
+type importOptions struct {
+	importRaws     bool
+	importVideos   bool
+	skipDuplicates bool
+}
+
+// resolveImportOptions picks the options for files in a DCIM folder: a value
+// set in the request wins, then the camera profile's configured default, and
+// otherwise the option is off.
+func resolveImportOptions(cameraDir string, importRaws, importVideos, skipDuplicates *bool) importOptions {
+	var defaults importDefaults
+	if brand := detectCameraBrand(cameraDir); brand != nil {
+		defaults = brand.defaults
+	}
+	pick := func(requested, configured *bool) bool {
+		if requested != nil {
+			return *requested
+		}
+		return configured != nil && *configured
+	}
+	return importOptions{
+		importRaws:     pick(importRaws, defaults.ImportRaws),
+		importVideos:   pick(importVideos, defaults.ImportVideos),
+		skipDuplicates: pick(skipDuplicates, defaults.SkipDuplicates),
+	}
+}
+
 func isRawFile(name string) bool {
-	lower := strings.ToLower(name)
-	for _, b := range supportedBrands {
-		if strings.HasSuffix(lower, strings.ToLower(b.rawExt)) {
-			return true
+	ext := strings.ToUpper(filepath.Ext(name))
+	for _, b := range cameraBrands() {
+		for _, rawExt := range b.rawExts {
+			if ext == rawExt {
+				return true
+			}
 		}
 	}
 	return false
 }
 
 // extractEmbeddedJPEG returns the embedded JPEG preview bytes from a RAW file.
+// Only the container's headers and the JPEG itself are read, never the sensor
+// data, so memory use is bounded by the size of the preview.
 //
 // Strategy:
-//   - TIFF-based RAWs (ORF, etc.): parse TIFF IFDs and use tags 0x0201/0x0202
-//     (JPEGInterchangeFormat / Length) for exact offset and length. This avoids
-//     including raw sensor data that follows the JPEG in the file.
-//   - ISOBMFF-based RAWs (CR3, etc.): scan for all JPEG SOI markers and return
-//     the largest segment bounded by the next SOI (or EOF).
+//   - TIFF-based RAWs (ORF, ARW, NEF, PEF, DNG, RW2, CR2): walk the TIFF IFDs
+//     (see tiffExtractJPEG) for the exact offset and length of the largest
+//     preview. This avoids including raw sensor data that follows the JPEG.
+//   - Fujifilm RAF: the header records the preview's offset and length.
+//   - Canon CR3: walk the ISOBMFF boxes (see parseCR3) and read just the
+//     largest JPEG.
+//   - Anything else: scan for all JPEG SOI markers and return the largest
+//     segment bounded by the next SOI (or EOF).
 func extractEmbeddedJPEG(rawPath string) ([]byte, error) {
-	data, err := os.ReadFile(rawPath)
+	f, err := os.Open(rawPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(data) < 8 {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < 8 {
 		return nil, fmt.Errorf("file too small: %s", rawPath)
 	}
 
-	// TIFF magic: "II" (little-endian) or "MM" (big-endian)
-	if (data[0] == 'I' && data[1] == 'I') || (data[0] == 'M' && data[1] == 'M') {
-		if j, err := tiffExtractJPEG(data); err == nil {
-			return j, nil
+	if t, err := newTIFFReader(f, size); err == nil {
+		if rg, err := tiffExtractJPEG(t); err == nil {
+			return readByteRange(f, rg)
 		}
 	}
+	if rg, ok := rafPreviewRange(f, size); ok {
+		return readByteRange(f, rg)
+	}
+	if c, err := parseCR3(f, size); err == nil {
+		return c.previewJPEG()
+	}
 
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
 	return scanExtractJPEG(data, rawPath)
 }
 
-// tiffExtractJPEG walks TIFF IFD chains looking for tags 0x0201/0x0202 that
-// point to an embedded JPEG preview (standard in EXIF / Olympus ORF IFD1).
-func tiffExtractJPEG(data []byte) ([]byte, error) {
+// byteRange is a span of a file; n == 0 means "not present".
+type byteRange struct {
+	off, n int64
+}
+
+// readAtFull reads exactly len(buf) bytes at off. io.ReaderAt may report
+// io.EOF alongside a complete read at the end of the file, which is fine.
+func readAtFull(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readByteRange(r io.ReaderAt, rg byteRange) ([]byte, error) {
+	if rg.n <= 0 {
+		return nil, fmt.Errorf("block not present")
+	}
+	buf := make([]byte, rg.n)
+	if err := readAtFull(r, buf, rg.off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// rafPreviewRange locates the preview JPEG of a Fujifilm RAF file, whose fixed
+// big-endian header stores the JPEG's offset and length at bytes 84 and 88.
+func rafPreviewRange(r io.ReaderAt, size int64) (byteRange, bool) {
+	var hdr [92]byte
+	if size < int64(len(hdr)) || readAtFull(r, hdr[:], 0) != nil || !bytes.HasPrefix(hdr[:], []byte("FUJIFILMCCD-RAW")) {
+		return byteRange{}, false
+	}
+	rg := byteRange{off: int64(binary.BigEndian.Uint32(hdr[84:])), n: int64(binary.BigEndian.Uint32(hdr[88:]))}
+	var soi [1]byte
+	if rg.off <= 0 || rg.n <= 0 || rg.off >= size || readAtFull(r, soi[:], rg.off) != nil || soi[0] != 0xFF {
+		return byteRange{}, false
+	}
+	if rg.off+rg.n > size {
+		rg.n = size - rg.off
+	}
+	return rg, true
+}
+
+// tiffMagic reports the byte order of a TIFF-based file and whether its magic
+// number is one this package understands: 42 for standard TIFF (ARW, NEF, PEF,
+// DNG, CR2), 0x4F52/0x5352 for Olympus ORF and 0x55 for Panasonic RW2.
+func tiffMagic(data []byte) (binary.ByteOrder, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
 	var bo binary.ByteOrder
-	if data[0] == 'I' {
+	switch {
+	case data[0] == 'I' && data[1] == 'I':
 		bo = binary.LittleEndian
-	} else {
+	case data[0] == 'M' && data[1] == 'M':
 		bo = binary.BigEndian
+	default:
+		return nil, false
 	}
-	if bo.Uint16(data[2:]) != 42 {
-		return nil, fmt.Errorf("not a TIFF file")
+	switch bo.Uint16(data[2:]) {
+	case 42, 0x4F52, 0x5352, 0x55:
+		return bo, true
 	}
+	return nil, false
+}
 
-	ifdOff := bo.Uint32(data[4:])
-	for ifdOff != 0 && int(ifdOff)+2 <= len(data) {
-		n := int(bo.Uint16(data[ifdOff:]))
-		base := int(ifdOff) + 2
-		var jpegOff, jpegLen uint32
-		for i := 0; i < n; i++ {
-			e := base + i*12
-			if e+12 > len(data) {
-				break
-			}
-			tag := bo.Uint16(data[e:])
-			val := bo.Uint32(data[e+8:])
-			switch tag {
+// Bounds on what a TIFF walk reads, so a corrupt or hostile file can't make
+// it allocate more than a few hundred kilobytes. Real IFDs have tens of
+// entries and EXIF strings are short.
+const (
+	maxIFDEntries = 1024
+	maxIFDs       = 64
+	maxTIFFValue  = 64 * 1024
+)
+
+// tiffReader reads the IFDs of a TIFF structure through an io.ReaderAt, one
+// bounded read at a time, instead of holding the whole file in memory.
+type tiffReader struct {
+	r    io.ReaderAt
+	size int64
+	bo   binary.ByteOrder
+	ifd0 uint32
+}
+
+// tiffEntry is one 12-byte IFD entry. value holds the value itself when it
+// fits in four bytes, and otherwise the offset of the value.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    [4]byte
+}
+
+func newTIFFReader(r io.ReaderAt, size int64) (*tiffReader, error) {
+	var hdr [8]byte
+	if size < 8 || readAtFull(r, hdr[:], 0) != nil {
+		return nil, fmt.Errorf("TIFF data too small")
+	}
+	bo, ok := tiffMagic(hdr[:])
+	if !ok {
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+	return &tiffReader{r: r, size: size, bo: bo, ifd0: bo.Uint32(hdr[4:])}, nil
+}
+
+// readIFD returns the entries of the IFD at off and the offset of the next IFD
+// in the chain (0 if none, or if the data ends before the pointer).
+func (t *tiffReader) readIFD(off uint32) ([]tiffEntry, uint32, error) {
+	var cnt [2]byte
+	if off == 0 || readAtFull(t.r, cnt[:], int64(off)) != nil {
+		return nil, 0, fmt.Errorf("IFD offset %d out of range", off)
+	}
+	n := int(t.bo.Uint16(cnt[:]))
+	if n > maxIFDEntries {
+		return nil, 0, fmt.Errorf("IFD at %d has %d entries", off, n)
+	}
+	buf := make([]byte, n*12+4)
+	var next uint32
+	if err := readAtFull(t.r, buf, int64(off)+2); err == nil {
+		next = t.bo.Uint32(buf[n*12:])
+	} else if err := readAtFull(t.r, buf[:n*12], int64(off)+2); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]tiffEntry, n)
+	for i := range entries {
+		e := buf[i*12:]
+		entries[i] = tiffEntry{tag: t.bo.Uint16(e), typ: t.bo.Uint16(e[2:]), count: t.bo.Uint32(e[4:])}
+		copy(entries[i].value[:], e[8:12])
+	}
+	return entries, next, nil
+}
+
+// uint returns an entry's first value as a number: SHORTs stored inline are
+// read as 16-bit, everything else (LONGs, offsets) as 32-bit.
+func (t *tiffReader) uint(e tiffEntry) uint32 {
+	if e.typ == 3 && e.count == 1 {
+		return uint32(t.bo.Uint16(e.value[:]))
+	}
+	return t.bo.Uint32(e.value[:])
+}
+
+// bytes returns the n-byte value of an entry, inline or out of line.
+func (t *tiffReader) bytes(e tiffEntry, n uint32) ([]byte, error) {
+	if n <= 4 {
+		return e.value[:n], nil
+	}
+	if n > maxTIFFValue {
+		return nil, fmt.Errorf("TIFF value of %d bytes too large", n)
+	}
+	return readByteRange(t.r, byteRange{off: int64(t.bo.Uint32(e.value[:])), n: int64(n)})
+}
+
+// tiffExtractJPEG walks the TIFF IFD chain, and the SubIFDs (tag 0x014A) it
+// references, collecting every embedded JPEG and returning the location of
+// the largest. A preview can be referenced three ways:
+//   - JPEGInterchangeFormat/Length (0x0201/0x0202): EXIF IFD1, ORF, ARW, PEF,
+//     and the full-size preview in a NEF SubIFD;
+//   - a single JPEG-compressed strip (0x0103 = 6 or 7 with 0x0111/0x0117):
+//     DNG preview SubIFDs and CR2 IFD0;
+//   - JpgFromRaw (0x002E), an UNDEFINED blob holding the whole JPEG: RW2.
+func tiffExtractJPEG(t *tiffReader) (byteRange, error) {
+	var best byteRange
+	consider := func(off, n uint32) {
+		rg := byteRange{off: int64(off), n: int64(n)}
+		var soi [2]byte
+		if off == 0 || n < 4 || rg.off+rg.n > t.size || rg.n <= best.n {
+			return
+		}
+		if readAtFull(t.r, soi[:], rg.off) != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+			return
+		}
+		best = rg
+	}
+
+	visited := make(map[uint32]bool)
+	queue := []uint32{t.ifd0}
+	for len(queue) > 0 && len(visited) < maxIFDs {
+		ifdOff := queue[0]
+		queue = queue[1:]
+		if ifdOff == 0 || visited[ifdOff] {
+			continue
+		}
+		visited[ifdOff] = true
+		entries, next, err := t.readIFD(ifdOff)
+		if err != nil {
+			continue
+		}
+
+		var jpegOff, jpegLen, stripOff, stripLen uint32
+		var compression uint16
+		for _, e := range entries {
+			val := t.uint(e)
+			switch e.tag {
 			case 0x0201:
 				jpegOff = val
 			case 0x0202:
 				jpegLen = val
+			case 0x0103:
+				compression = uint16(val)
+			case 0x0111:
+				if e.count == 1 {
+					stripOff = val
+				}
+			case 0x0117:
+				if e.count == 1 {
+					stripLen = val
+				}
+			case 0x002E:
+				consider(val, e.count)
+			case 0x014A: // SubIFDs: one inline LONG, or an array of LONGs
+				if e.count == 1 {
+					queue = append(queue, val)
+				} else if e.count <= maxIFDs {
+					if offs, err := t.bytes(e, e.count*4); err == nil {
+						for k := 0; k < len(offs); k += 4 {
+							queue = append(queue, t.bo.Uint32(offs[k:]))
+						}
+					}
+				}
 			}
 		}
-		if jpegOff > 0 && jpegLen > 0 && int(jpegOff)+int(jpegLen) <= len(data) {
-			return data[jpegOff : jpegOff+jpegLen], nil
+		consider(jpegOff, jpegLen)
+		if compression == 6 || compression == 7 {
+			consider(stripOff, stripLen)
 		}
+
 		// Follow linked-list to next IFD
-		nextOff := base + n*12
-		if nextOff+4 > len(data) {
-			break
-		}
-		ifdOff = bo.Uint32(data[nextOff:])
+		queue = append(queue, next)
+	}
+	if best.n == 0 {
+		return best, fmt.Errorf("no embedded JPEG found in TIFF IFDs")
 	}
-	return nil, fmt.Errorf("JPEG offset/length tags not found in TIFF IFDs")
+	return best, nil
 }
 
 // scanExtractJPEG finds the largest JPEG segment in arbitrary binary data by
 // locating all SOI markers and bounding each segment by the next SOI (or EOF).
-// Used for ISOBMFF-based RAWs (CR3) where TIFF parsing doesn't apply.
+// Last resort for RAW formats none of the parsers above understand.
 func scanExtractJPEG(data []byte, rawPath string) ([]byte, error) {
 	soi := []byte{0xFF, 0xD8, 0xFF}
 	eoi := []byte{0xFF, 0xD9}
@@ -178,13 +438,153 @@ func scanExtractJPEG(data []byte, rawPath string) ([]byte, error) {
 	return best, nil
 }
 
-// photoMetadata holds camera settings extracted from a photo's EXIF data,
-// pre-formatted for display (e.g. "1/250s", "f/5.6", "ISO 400", "50mm").
+// photoMetadata holds camera settings extracted from a photo's EXIF data. The
+// string fields are pre-formatted for display (e.g. "1/250s", "f/5.6",
+// "ISO 400", "50mm"); Raw holds the numeric values they were derived from.
 type photoMetadata struct {
 	ShutterSpeed string `json:"shutter_speed,omitempty"`
 	Aperture     string `json:"aperture,omitempty"`
 	ISO          string `json:"iso,omitempty"`
 	FocalLength  string `json:"focal_length,omitempty"`
+
+	ExposureCompensation string `json:"exposure_compensation,omitempty"` // e.g. "+0.7 EV"
+	ExposureProgram      string `json:"exposure_program,omitempty"`      // e.g. "Aperture-priority AE"
+	MeteringMode         string `json:"metering_mode,omitempty"`
+	Flash                string `json:"flash,omitempty"`
+	WhiteBalance         string `json:"white_balance,omitempty"`
+	Orientation          string `json:"orientation,omitempty"` // e.g. "Rotate 90 CW"
+
+	Make             string `json:"make,omitempty"`
+	Model            string `json:"model,omitempty"`
+	SerialNumber     string `json:"serial_number,omitempty"`
+	LensMake         string `json:"lens_make,omitempty"`
+	LensModel        string `json:"lens_model,omitempty"`
+	LensSerialNumber string `json:"lens_serial_number,omitempty"`
+
+	// CaptureTime is DateTimeOriginal in ISO 8601 with sub-seconds, e.g.
+	// "2025-11-01T14:30:45.12+09:00"; without the offset when the camera
+	// didn't record one.
+	CaptureTime string `json:"capture_time,omitempty"`
+
+	GPS *gpsPosition `json:"gps,omitempty"`
+	Raw exifRaw      `json:"raw"`
+
+	// Raw EXIF strings used to derive the capture time, e.g.
+	// "2025:11:01 14:30:45", "12" and "+09:00". Not part of the API response.
+	dateTimeOriginal   string
+	subSecTimeOriginal string
+	offsetTimeOriginal string
+}
+
+// exifRaw holds numeric EXIF values as recorded. Enumerations and the
+// exposure bias are pointers, since 0 is a meaningful value for them.
+type exifRaw struct {
+	ExposureTime    float64  `json:"exposure_time,omitempty"` // seconds
+	FNumber         float64  `json:"f_number,omitempty"`
+	ISO             int      `json:"iso,omitempty"`
+	FocalLength     float64  `json:"focal_length,omitempty"` // mm
+	FocalLength35mm int      `json:"focal_length_35mm,omitempty"`
+	ExposureBias    *float64 `json:"exposure_bias,omitempty"` // EV
+	ExposureProgram *int     `json:"exposure_program,omitempty"`
+	MeteringMode    *int     `json:"metering_mode,omitempty"`
+	Flash           *int     `json:"flash,omitempty"`
+	WhiteBalance    *int     `json:"white_balance,omitempty"`
+	Orientation     *int     `json:"orientation,omitempty"`
+}
+
+// gpsPosition is where a photo was taken, from the GPS IFD.
+type gpsPosition struct {
+	Latitude  float64  `json:"latitude"`           // decimal degrees, negative south
+	Longitude float64  `json:"longitude"`          // decimal degrees, negative west
+	Altitude  *float64 `json:"altitude,omitempty"` // metres, negative below sea level
+	Display   string   `json:"display"`            // e.g. "35.658600° N, 139.745400° E"
+}
+
+// Display names for EXIF enumerations, as exiftool prints them.
+var (
+	exposurePrograms = map[int]string{
+		0: "Not defined", 1: "Manual", 2: "Program AE", 3: "Aperture-priority AE",
+		4: "Shutter speed priority AE", 5: "Creative (slow speed)", 6: "Action (high speed)",
+		7: "Portrait", 8: "Landscape", 9: "Bulb",
+	}
+	meteringModes = map[int]string{
+		0: "Unknown", 1: "Average", 2: "Center-weighted average", 3: "Spot",
+		4: "Multi-spot", 5: "Multi-segment", 6: "Partial", 255: "Other",
+	}
+	whiteBalances = map[int]string{0: "Auto", 1: "Manual"}
+	orientations  = map[int]string{
+		1: "Horizontal (normal)", 2: "Mirror horizontal", 3: "Rotate 180",
+		4: "Mirror vertical", 5: "Mirror horizontal and rotate 270 CW",
+		6: "Rotate 90 CW", 7: "Mirror horizontal and rotate 90 CW", 8: "Rotate 270 CW",
+	}
+)
+
+// flashDescription summarises the EXIF Flash bit field.
+func flashDescription(v int) string {
+	switch {
+	case v&0x20 != 0:
+		return "No flash function"
+	case v&0x01 != 0:
+		return "Fired"
+	}
+	return "Did not fire"
+}
+
+// formatExposureBias formats an exposure compensation in EV, e.g. "+0.7 EV".
+func formatExposureBias(v float64) string {
+	switch {
+	case v > 0:
+		return "+" + trimFloat(v) + " EV"
+	case v < 0:
+		return "-" + trimFloat(-v) + " EV"
+	}
+	return "0 EV"
+}
+
+// captureTime returns when the photo was taken according to DateTimeOriginal
+// and SubSecTimeOriginal. With OffsetTimeOriginal the time is placed in the
+// camera's recorded zone; otherwise the camera clock is assumed to be in the
+// local time zone.
+func (m photoMetadata) captureTime() (time.Time, bool) {
+	t, _, ok := m.parseCaptureTime()
+	return t, ok
+}
+
+// parseCaptureTime is captureTime, also reporting whether the camera recorded
+// its UTC offset.
+func (m photoMetadata) parseCaptureTime() (t time.Time, zoned bool, ok bool) {
+	if m.dateTimeOriginal == "" {
+		return time.Time{}, false, false
+	}
+	loc := time.Local
+	if off := m.offsetTimeOriginal; len(off) == 6 && (off[0] == '+' || off[0] == '-') && off[3] == ':' {
+		hours, errH := strconv.Atoi(off[1:3])
+		mins, errM := strconv.Atoi(off[4:6])
+		if errH == nil && errM == nil {
+			secs := hours*3600 + mins*60
+			if off[0] == '-' {
+				secs = -secs
+			}
+			loc = time.FixedZone(off, secs)
+			zoned = true
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", m.dateTimeOriginal, loc)
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	// SubSecTimeOriginal holds the decimal digits of the fraction: "12"
+	// means .12 seconds.
+	if sub := m.subSecTimeOriginal; sub != "" && len(sub) <= 9 {
+		if frac, err := strconv.Atoi(sub); err == nil && frac >= 0 {
+			ns := frac
+			for i := len(sub); i < 9; i++ {
+				ns *= 10
+			}
+			t = t.Add(time.Duration(ns))
+		}
+	}
+	return t, zoned, true
 }
 
 // trimFloat formats v with at most one decimal place, dropping a trailing ".0"
@@ -203,92 +603,272 @@ func formatShutterSpeed(num, den uint32) string {
 	return fmt.Sprintf("1/%.0fs", float64(den)/float64(num))
 }
 
-// parseExifTIFF extracts camera settings from a TIFF block (the payload of a
-// JPEG APP1 EXIF segment, a TIFF-based RAW, or a CR3 CMT2 box). It walks the
-// IFD0 chain and the Exif SubIFD (tag 0x8769) when present; CR3 CMT2 blocks
-// carry the Exif tags directly in IFD0.
+// parseExifTIFF extracts camera settings from a TIFF block held in memory
+// (e.g. a CR3 CMT box).
 func parseExifTIFF(data []byte) (photoMetadata, error) {
 	var meta photoMetadata
-	if len(data) < 8 {
-		return meta, fmt.Errorf("EXIF data too small")
+	err := parseExifTIFFInto(&meta, data)
+	return meta, err
+}
+
+// parseExifTIFFInto is parseExifTIFF for metadata spread over several TIFF
+// blocks (CR3 CMT1 and CMT2): tags found in data overwrite those in meta.
+func parseExifTIFFInto(meta *photoMetadata, data []byte) error {
+	t, err := newTIFFReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
 	}
-	var bo binary.ByteOrder
-	switch {
-	case data[0] == 'I' && data[1] == 'I':
-		bo = binary.LittleEndian
-	case data[0] == 'M' && data[1] == 'M':
-		bo = binary.BigEndian
-	default:
-		return meta, fmt.Errorf("invalid TIFF byte order")
+	return t.readMetadata(meta)
+}
+
+// ascii reads an ASCII value, dropping the NUL terminator and padding.
+func (t *tiffReader) ascii(e tiffEntry) string {
+	b, err := t.bytes(e, e.count)
+	if err != nil {
+		return ""
 	}
-	// 42 is standard TIFF; 0x4F52/0x5352 are Olympus ORF variants.
-	switch bo.Uint16(data[2:]) {
-	case 42, 0x4F52, 0x5352:
-	default:
-		return meta, fmt.Errorf("invalid TIFF magic")
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// rational reads the first RATIONAL value of an entry.
+func (t *tiffReader) rational(e tiffEntry) (uint32, uint32, bool) {
+	b, err := readByteRange(t.r, byteRange{off: int64(t.bo.Uint32(e.value[:])), n: 8})
+	if err != nil {
+		return 0, 0, false
 	}
+	return t.bo.Uint32(b), t.bo.Uint32(b[4:]), true
+}
 
-	// readRational reads a RATIONAL value referenced by the entry at e.
-	readRational := func(e int) (uint32, uint32, bool) {
-		off := int(bo.Uint32(data[e+8:]))
-		if off < 0 || off+8 > len(data) {
-			return 0, 0, false
+// rationals reads all RATIONAL (or, if signed, SRATIONAL) values of an entry
+// as floats. A zero denominator yields nil.
+func (t *tiffReader) rationals(e tiffEntry, signed bool) []float64 {
+	if e.count == 0 || e.count > maxTIFFValue/8 {
+		return nil
+	}
+	b, err := t.bytes(e, e.count*8)
+	if err != nil {
+		return nil
+	}
+	vals := make([]float64, e.count)
+	for i := range vals {
+		num, den := t.bo.Uint32(b[i*8:]), t.bo.Uint32(b[i*8+4:])
+		if den == 0 {
+			return nil
+		}
+		if signed {
+			vals[i] = float64(int32(num)) / float64(int32(den))
+		} else {
+			vals[i] = float64(num) / float64(den)
 		}
-		return bo.Uint32(data[off:]), bo.Uint32(data[off+4:]), true
 	}
+	return vals
+}
 
-	var exifIFDOff uint32
+// readMetadata extracts camera settings from a TIFF structure (the payload of
+// a JPEG APP1 EXIF segment, a TIFF-based RAW, or a CR3 CMT box) into meta. It
+// walks the IFD0 chain, the Exif SubIFD (tag 0x8769) and the GPS IFD (tag
+// 0x8825) when present; CR3 CMT2 blocks carry the Exif tags directly in IFD0.
+func (t *tiffReader) readMetadata(meta *photoMetadata) error {
+	intp := func(v int) *int { return &v }
+
+	var exifIFDOff, gpsIFDOff uint32
 	parseIFD := func(ifdOff uint32) {
-		if int(ifdOff)+2 > len(data) {
+		entries, _, err := t.readIFD(ifdOff)
+		if err != nil {
 			return
 		}
-		n := int(bo.Uint16(data[ifdOff:]))
-		base := int(ifdOff) + 2
-		for i := 0; i < n; i++ {
-			e := base + i*12
-			if e+12 > len(data) {
-				break
-			}
-			switch bo.Uint16(data[e:]) {
+		for _, e := range entries {
+			switch e.tag {
 			case 0x8769: // Exif SubIFD pointer
-				exifIFDOff = bo.Uint32(data[e+8:])
+				exifIFDOff = t.bo.Uint32(e.value[:])
+			case 0x8825: // GPS IFD pointer
+				gpsIFDOff = t.bo.Uint32(e.value[:])
+			case 0x010F: // Make
+				meta.Make = t.ascii(e)
+			case 0x0110: // Model
+				meta.Model = t.ascii(e)
+			case 0x0112: // Orientation
+				v := int(t.uint(e))
+				meta.Raw.Orientation = intp(v)
+				meta.Orientation = orientations[v]
 			case 0x829A: // ExposureTime
-				if num, den, ok := readRational(e); ok {
+				if num, den, ok := t.rational(e); ok {
 					meta.ShutterSpeed = formatShutterSpeed(num, den)
+					if den > 0 {
+						meta.Raw.ExposureTime = float64(num) / float64(den)
+					}
 				}
 			case 0x829D: // FNumber
-				if num, den, ok := readRational(e); ok && den > 0 {
+				if num, den, ok := t.rational(e); ok && den > 0 {
 					meta.Aperture = "f/" + trimFloat(float64(num)/float64(den))
+					meta.Raw.FNumber = float64(num) / float64(den)
 				}
 			case 0x8827: // ISO speed (SHORT, stored inline)
-				meta.ISO = fmt.Sprintf("ISO %d", bo.Uint16(data[e+8:]))
+				meta.Raw.ISO = int(t.bo.Uint16(e.value[:]))
+				meta.ISO = fmt.Sprintf("ISO %d", meta.Raw.ISO)
 			case 0x920A: // FocalLength
-				if num, den, ok := readRational(e); ok && den > 0 && num > 0 {
+				if num, den, ok := t.rational(e); ok && den > 0 && num > 0 {
 					meta.FocalLength = trimFloat(float64(num)/float64(den)) + "mm"
+					meta.Raw.FocalLength = float64(num) / float64(den)
+				}
+			case 0xA405: // FocalLengthIn35mmFilm
+				meta.Raw.FocalLength35mm = int(t.uint(e))
+			case 0x9204: // ExposureBiasValue (SRATIONAL)
+				if v := t.rationals(e, true); len(v) > 0 {
+					meta.Raw.ExposureBias = &v[0]
+					meta.ExposureCompensation = formatExposureBias(v[0])
 				}
+			case 0x8822: // ExposureProgram
+				v := int(t.uint(e))
+				meta.Raw.ExposureProgram = intp(v)
+				meta.ExposureProgram = exposurePrograms[v]
+			case 0x9207: // MeteringMode
+				v := int(t.uint(e))
+				meta.Raw.MeteringMode = intp(v)
+				meta.MeteringMode = meteringModes[v]
+			case 0x9209: // Flash
+				v := int(t.uint(e))
+				meta.Raw.Flash = intp(v)
+				meta.Flash = flashDescription(v)
+			case 0xA403: // WhiteBalance
+				v := int(t.uint(e))
+				meta.Raw.WhiteBalance = intp(v)
+				meta.WhiteBalance = whiteBalances[v]
+			case 0xA431: // BodySerialNumber
+				meta.SerialNumber = t.ascii(e)
+			case 0xC62F: // CameraSerialNumber (DNG), if the Exif one is absent
+				if meta.SerialNumber == "" {
+					meta.SerialNumber = t.ascii(e)
+				}
+			case 0xA433: // LensMake
+				meta.LensMake = t.ascii(e)
+			case 0xA434: // LensModel
+				meta.LensModel = t.ascii(e)
+			case 0xA435: // LensSerialNumber
+				meta.LensSerialNumber = t.ascii(e)
+			case 0x9003: // DateTimeOriginal
+				meta.dateTimeOriginal = t.ascii(e)
+			case 0x9291: // SubSecTimeOriginal
+				meta.subSecTimeOriginal = t.ascii(e)
+			case 0x9011: // OffsetTimeOriginal
+				meta.offsetTimeOriginal = t.ascii(e)
 			}
 		}
 	}
 
-	parseIFD(bo.Uint32(data[4:]))
+	parseIFD(t.ifd0)
 	if exifIFDOff != 0 {
 		parseIFD(exifIFDOff)
 	}
-	return meta, nil
+	if gpsIFDOff != 0 {
+		t.readGPS(meta, gpsIFDOff)
+	}
+	meta.setCaptureTime()
+	return nil
+}
+
+// jpgFromRaw returns the location of the JpgFromRaw preview (tag 0x002E) in
+// IFD0, which RW2 files carry.
+func (t *tiffReader) jpgFromRaw() (byteRange, bool) {
+	entries, _, err := t.readIFD(t.ifd0)
+	if err != nil {
+		return byteRange{}, false
+	}
+	for _, e := range entries {
+		if e.tag == 0x002E && e.count > 4 {
+			rg := byteRange{off: int64(t.bo.Uint32(e.value[:])), n: int64(e.count)}
+			if rg.off+rg.n <= t.size {
+				return rg, true
+			}
+		}
+	}
+	return byteRange{}, false
 }
 
-// jpegExtractExifTIFF returns the TIFF payload of a JPEG's APP1 EXIF segment.
-func jpegExtractExifTIFF(data []byte) ([]byte, error) {
-	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+// readGPS reads the position from the GPS IFD at ifdOff. GPS tags reuse the
+// low tag numbers of IFD0, so the GPS IFD is never parsed as a regular one.
+func (t *tiffReader) readGPS(meta *photoMetadata, ifdOff uint32) {
+	entries, _, err := t.readIFD(ifdOff)
+	if err != nil {
+		return
+	}
+	var latRef, lonRef string
+	var lat, lon []float64
+	var alt *float64
+	belowSeaLevel := false
+	for _, e := range entries {
+		switch e.tag {
+		case 0x0001: // GPSLatitudeRef
+			latRef = t.ascii(e)
+		case 0x0002: // GPSLatitude: degrees, minutes, seconds
+			lat = t.rationals(e, false)
+		case 0x0003: // GPSLongitudeRef
+			lonRef = t.ascii(e)
+		case 0x0004: // GPSLongitude
+			lon = t.rationals(e, false)
+		case 0x0005: // GPSAltitudeRef (BYTE): 1 = below sea level
+			belowSeaLevel = e.value[0] == 1
+		case 0x0006: // GPSAltitude
+			if v := t.rationals(e, false); len(v) == 1 {
+				alt = &v[0]
+			}
+		}
+	}
+	if len(lat) != 3 || len(lon) != 3 {
+		return
+	}
+	pos := &gpsPosition{
+		Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+		Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+	}
+	if latRef == "S" {
+		pos.Latitude = -pos.Latitude
+	}
+	if lonRef == "W" {
+		pos.Longitude = -pos.Longitude
+	}
+	if alt != nil && belowSeaLevel {
+		*alt = -*alt
+	}
+	pos.Altitude = alt
+
+	ns, ew := "N", "E"
+	if pos.Latitude < 0 {
+		ns = "S"
+	}
+	if pos.Longitude < 0 {
+		ew = "W"
+	}
+	pos.Display = fmt.Sprintf("%.6f° %s, %.6f° %s", math.Abs(pos.Latitude), ns, math.Abs(pos.Longitude), ew)
+	meta.GPS = pos
+}
+
+// setCaptureTime fills CaptureTime from the raw EXIF date strings.
+func (m *photoMetadata) setCaptureTime() {
+	t, zoned, ok := m.parseCaptureTime()
+	switch {
+	case !ok:
+	case zoned:
+		m.CaptureTime = t.Format("2006-01-02T15:04:05.999999999Z07:00")
+	default:
+		m.CaptureTime = t.Format("2006-01-02T15:04:05.999999999")
+	}
+}
+
+// jpegExifSection returns the TIFF payload of a JPEG's APP1 EXIF segment,
+// reading only the segment headers that precede it.
+func jpegExifSection(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	var hdr [10]byte
+	if readAtFull(r, hdr[:2], 0) != nil || hdr[0] != 0xFF || hdr[1] != 0xD8 {
 		return nil, fmt.Errorf("not a JPEG")
 	}
 	exifHeader := []byte("Exif\x00\x00")
-	off := 2
-	for off+4 <= len(data) {
-		if data[off] != 0xFF {
+	off := int64(2)
+	for off+4 <= size {
+		if readAtFull(r, hdr[:4], off) != nil || hdr[0] != 0xFF {
 			break
 		}
-		marker := data[off+1]
+		marker := hdr[1]
 		// Standalone markers without a length field.
 		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
 			off += 2
@@ -297,12 +877,14 @@ func jpegExtractExifTIFF(data []byte) ([]byte, error) {
 		if marker == 0xDA { // start of scan — EXIF only appears before this
 			break
 		}
-		segLen := int(binary.BigEndian.Uint16(data[off+2:]))
-		if segLen < 2 || off+2+segLen > len(data) {
+		segLen := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if segLen < 2 || off+2+segLen > size {
 			break
 		}
-		if marker == 0xE1 && segLen >= 2+len(exifHeader)+8 && bytes.HasPrefix(data[off+4:], exifHeader) {
-			return data[off+4+len(exifHeader) : off+2+segLen], nil
+		if marker == 0xE1 && segLen >= 2+int64(len(exifHeader))+8 &&
+			readAtFull(r, hdr[4:10], off+4) == nil && bytes.Equal(hdr[4:10], exifHeader) {
+			start := off + 4 + int64(len(exifHeader))
+			return io.NewSectionReader(r, start, off+2+segLen-start), nil
 		}
 		off += 2 + segLen
 	}
@@ -310,43 +892,162 @@ func jpegExtractExifTIFF(data []byte) ([]byte, error) {
 }
 
 // extractPhotoMetadata reads camera settings from a photo's EXIF data.
-// JPEGs carry EXIF in an APP1 segment; TIFF-based RAWs (ORF) are parsed
-// directly; ISOBMFF RAWs (CR3) store the Exif IFD as a bare TIFF block
-// inside the CMT2 box.
+// JPEGs carry EXIF in an APP1 segment; TIFF-based RAWs (ORF, ARW, NEF, PEF,
+// DNG) are parsed directly; RW2 and RAF keep it in the APP1 segment of their
+// preview JPEG; CR3 stores IFD0 and the Exif IFD as bare TIFF blocks in its CMT1
+// and CMT2 boxes. Only the IFDs and the values they reference are read.
 func extractPhotoMetadata(path string) (photoMetadata, error) {
-	data, err := os.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return photoMetadata{}, err
 	}
-	if len(data) < 8 {
-		return photoMetadata{}, fmt.Errorf("file too small: %s", path)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return photoMetadata{}, err
 	}
+	return readPhotoMetadata(f, info.Size(), path)
+}
 
-	if (data[0] == 'I' && data[1] == 'I') || (data[0] == 'M' && data[1] == 'M') {
-		return parseExifTIFF(data)
+// readPhotoMetadata dispatches on the container format of the size bytes
+// readable from r.
+func readPhotoMetadata(r io.ReaderAt, size int64, path string) (photoMetadata, error) {
+	var meta photoMetadata
+	var head [2]byte
+	if size < 8 || readAtFull(r, head[:], 0) != nil {
+		return meta, fmt.Errorf("file too small: %s", path)
+	}
+
+	if (head[0] == 'I' && head[1] == 'I') || (head[0] == 'M' && head[1] == 'M') {
+		t, err := newTIFFReader(r, size)
+		if err != nil {
+			return meta, err
+		}
+		if err := t.readMetadata(&meta); err != nil {
+			return meta, err
+		}
+		// An RW2's IFD0 holds little beyond the make and model; the rest,
+		// the Exif IFD included, is in its JpgFromRaw preview.
+		if rg, ok := t.jpgFromRaw(); ok {
+			if sec, err := jpegExifSection(io.NewSectionReader(r, rg.off, rg.n), rg.n); err == nil {
+				if et, err := newTIFFReader(sec, sec.Size()); err == nil {
+					et.readMetadata(&meta)
+				}
+			}
+		}
+		return meta, nil
 	}
-	if data[0] == 0xFF && data[1] == 0xD8 {
-		tiff, err := jpegExtractExifTIFF(data)
+	exifOf := func(r io.ReaderAt, size int64) (photoMetadata, error) {
+		sec, err := jpegExifSection(r, size)
 		if err != nil {
-			return photoMetadata{}, err
+			return meta, err
+		}
+		t, err := newTIFFReader(sec, sec.Size())
+		if err != nil {
+			return meta, err
+		}
+		err = t.readMetadata(&meta)
+		return meta, err
+	}
+	if head[0] == 0xFF && head[1] == 0xD8 {
+		return exifOf(r, size)
+	}
+	// RAF has no TIFF header of its own; its EXIF is in the preview JPEG.
+	if rg, ok := rafPreviewRange(r, size); ok {
+		return exifOf(io.NewSectionReader(r, rg.off, rg.n), rg.n)
+	}
+	if c, err := parseCR3(r, size); err == nil {
+		return c.metadata()
+	}
+	return meta, fmt.Errorf("no EXIF data found in %s", path)
+}
+
+// Capture time sources reported by fileCaptureTime.
+const (
+	captureSourceExif  = "exif"
+	captureSourceMtime = "mtime"
+)
+
+// fileCaptureTime returns when the photo at path was taken, preferring EXIF
+// DateTimeOriginal (plus OffsetTimeOriginal) and falling back to the file's
+// modification time when the file has no readable EXIF date. The second
+// return value is the source used: captureSourceExif or captureSourceMtime.
+func fileCaptureTime(path string, info os.FileInfo) (time.Time, string) {
+	if isRawFile(path) || strings.HasSuffix(strings.ToLower(path), ".jpg") || strings.HasSuffix(strings.ToLower(path), ".jpeg") {
+		// Only the EXIF blocks are read, never the whole file, so sorting a
+		// card full of RAWs by date stays cheap.
+		if meta, err := extractPhotoMetadata(path); err == nil {
+			if t, ok := meta.captureTime(); ok {
+				return t, captureSourceExif
+			}
+		}
+	}
+	return info.ModTime().Local(), captureSourceMtime
+}
+
+// dateRange is an inclusive filter on capture days in "YYYY-MM-DD" form, as
+// sent by the import dialog. An empty bound is open.
+type dateRange struct {
+	since string
+	until string
+}
+
+func parseDateRange(since, until string) (dateRange, error) {
+	for _, d := range []string{since, until} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return dateRange{}, err
 		}
-		return parseExifTIFF(tiff)
 	}
-	if idx := bytes.Index(data, []byte("CMT2")); idx >= 0 && idx+4 < len(data) {
-		return parseExifTIFF(data[idx+4:])
+	return dateRange{since: since, until: until}, nil
+}
+
+func (d dateRange) active() bool {
+	return d.since != "" || d.until != ""
+}
+
+// contains reports whether day ("YYYY-MM-DD") falls within the range. Days are
+// compared as calendar dates on the camera's clock, so a photo taken at 23:30
+// local time counts on that day regardless of the server's time zone.
+func (d dateRange) contains(day string) bool {
+	if d.since != "" && day < d.since {
+		return false
+	}
+	if d.until != "" && day > d.until {
+		return false
 	}
-	return photoMetadata{}, fmt.Errorf("no EXIF data found in %s", path)
+	return true
 }
 
-// rawAlreadyExported returns true if a raw file with the given base name (any supported
-// extension) already exists in dir.
-func rawAlreadyExported(dir, baseName string) bool {
-	for _, b := range supportedBrands {
-		if _, err := os.Stat(filepath.Join(dir, baseName+b.rawExt)); err == nil {
-			return true
+// rawPathInDir returns the path of the raw file with the given base name (any
+// supported extension) in dir, if there is one.
+func rawPathInDir(dir, baseName string) (string, bool) {
+	for _, b := range cameraBrands() {
+		for _, rawExt := range b.rawExts {
+			path := filepath.Join(dir, baseName+rawExt)
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
 		}
 	}
-	return false
+	return "", false
+}
+
+// exportXMPSidecar writes the XMP sidecar of an exported RAW from the culling
+// state of its photo, looked up by the JPEG's name or else the RAW's own.
+// Failures are logged: a missing sidecar doesn't fail the export.
+func exportXMPSidecar(culling cullingState, photo, rawPath string) {
+	c, ok := culling.Photos[photo]
+	if !ok {
+		c = culling.Photos[filepath.Base(rawPath)]
+	}
+	if err := writeXMPSidecar(rawPath, c); err == errForeignXMP {
+		log.Printf("Keeping existing sidecar of %s: not written by camera_rip", rawPath)
+	} else if err != nil {
+		log.Printf("Failed to write XMP sidecar for %s: %v", rawPath, err)
+	}
 }
 
 // safePhotoPath joins user-supplied path elements (e.g. a directory or filename
@@ -430,8 +1131,23 @@ func main() {
 	devMode := flag.Bool("dev", false, "Run in development mode (do not serve static files)")
 	host := flag.String("host", "0.0.0.0", "Address to listen on (0.0.0.0 = every interface, so other devices on the network can connect)")
 	port := flag.String("port", "5001", "Port to listen on")
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "Path to the JSON config file with camera profiles")
 	flag.Parse()
 
+	if err := reloadConfig(); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	// SIGHUP re-reads the config file; a broken edit keeps the previous one.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(); err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
+
 	userHomeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalf("Failed to get user home directory: %v", err)
@@ -445,21 +1161,39 @@ func main() {
 	if err := os.MkdirAll(thumbnailCacheDir, 0755); err != nil {
 		log.Fatalf("Failed to create thumbnail cache directory: %v", err)
 	}
+	if err := resetStaleThumbnailCache(); err != nil {
+		log.Printf("Failed to reset thumbnail cache: %v", err)
+	}
+	go reconcileLibraryIndexPeriodically()
+	go fingerprintLibraryInBackground()
+	watchLibrary(context.Background())
+	go watchCards(context.Background())
 
 	http.HandleFunc("/api/directories", corsHandler(listDirectoriesHandler))
 	http.HandleFunc("/api/photos", corsHandler(getPhotosHandler))
 	http.HandleFunc("/api/save", corsHandler(saveSelectedPhotosHandler))
 	http.HandleFunc("/api/import", corsHandler(importFromUSBHandler))
 	http.HandleFunc("/api/import-preview", corsHandler(importPreviewHandler))
+	http.HandleFunc("/api/import-jobs", corsHandler(importJobsHandler))
+	http.HandleFunc("/api/import-job", corsHandler(importJobHandler))
+	http.HandleFunc("/api/import-cancel", corsHandler(importCancelHandler))
+	http.HandleFunc("/api/import-resume", corsHandler(importResumeHandler))
 	http.HandleFunc("/api/export-raw", corsHandler(exportRawFilesHandler))
 	http.HandleFunc("/api/export-raw-single", corsHandler(exportRawSingleFileHandler))
 	http.HandleFunc("/api/export-status", corsHandler(exportStatusHandler))
+	http.HandleFunc("/api/export-preset", corsHandler(exportPresetHandler))
 	http.HandleFunc("/api/selected-photos", corsHandler(getSelectedPhotosHandler))
+	http.HandleFunc("/api/selection", corsHandler(selectionHandler))
+	http.HandleFunc("/api/download-selection", corsHandler(downloadSelectionHandler))
+	http.HandleFunc("/api/culling", corsHandler(cullingHandler))
 	http.HandleFunc("/api/delete-imported", corsHandler(deleteImportedHandler))
 	http.HandleFunc("/api/sd-cleanup", corsHandler(sdCleanupHandler))
 	http.HandleFunc("/api/delete-photos", corsHandler(deletePhotosHandler))
 	http.HandleFunc("/api/rename-directory", corsHandler(renameDirectoryHandler))
 	http.HandleFunc("/api/photo-metadata", corsHandler(photoMetadataHandler))
+	http.HandleFunc("/api/config", corsHandler(configHandler))
+	http.HandleFunc("/api/events", corsHandler(eventsHandler))
+	http.HandleFunc("/api/cards", corsHandler(cardsHandler))
 	http.HandleFunc("/photos/", corsHandler(servePhotoHandler))
 	http.HandleFunc("/thumbnail/", corsHandler(serveThumbnailHandler))
 
@@ -496,18 +1230,11 @@ func corsHandler(h http.HandlerFunc) http.HandlerFunc {
 }
 
 func listDirectoriesHandler(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir(photoBaseDir)
-	if err != nil {
+	if _, err := os.Stat(photoBaseDir); err != nil {
 		http.Error(w, "Failed to read photo base directory", http.StatusInternalServerError)
 		return
 	}
-
-	var dirs []string
-	for _, file := range files {
-		if file.IsDir() && file.Name() != ".thumbnails" {
-			dirs = append(dirs, file.Name())
-		}
-	}
+	dirs := indexedSessionNames()
 
 	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
 
@@ -576,6 +1303,8 @@ func renameDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to move thumbnail cache from %s to %s: %v", oldThumbs, newThumbs, err)
 	}
 
+	renameLibrarySession(data.Directory, newName)
+
 	log.Printf("Renamed directory %s to %s", data.Directory, newName)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -591,12 +1320,15 @@ func getPhotosHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	targetDir, err := safePhotoPath(directory)
-	if err != nil {
+	if _, err := safePhotoPath(directory); err != nil || !validDirName(directory) {
 		http.Error(w, "Invalid directory", http.StatusBadRequest)
 		return
 	}
-	files, err := ioutil.ReadDir(targetDir)
+	files, _, err := indexedSessionFiles(directory)
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to read photo directory", http.StatusInternalServerError)
 		return
@@ -604,14 +1336,12 @@ func getPhotosHandler(w http.ResponseWriter, r *http.Request) {
 
 	var photos []string
 	var rawFiles []string
-	for _, file := range files {
-		if !file.IsDir() && !strings.HasPrefix(file.Name(), "._") {
-			lowerName := strings.ToLower(file.Name())
-			if strings.HasSuffix(lowerName, ".png") || strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".gif") {
-				photos = append(photos, file.Name())
-			} else if isRawFile(file.Name()) {
-				rawFiles = append(rawFiles, file.Name())
-			}
+	for _, name := range files {
+		lowerName := strings.ToLower(name)
+		if strings.HasSuffix(lowerName, ".png") || strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".gif") {
+			photos = append(photos, name)
+		} else if isRawFile(name) {
+			rawFiles = append(rawFiles, name)
 		}
 	}
 
@@ -641,51 +1371,44 @@ func getSelectedPhotosHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	selectedDir, err := safePhotoPath(directory, "selected")
-	if err != nil {
+	if _, err := safePhotoPath(directory); err != nil || !validDirName(directory) {
 		http.Error(w, "Invalid directory", http.StatusBadRequest)
 		return
 	}
-	files, err := ioutil.ReadDir(selectedDir)
+	_, files, err := indexedSessionFiles(directory)
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		// If the directory doesn't exist, it just means no photos have been selected yet.
-		// Return an empty list.
-		if os.IsNotExist(err) {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode([]string{})
-			return
-		}
-		http.Error(w, "Failed to read selected photo directory", http.StatusInternalServerError)
+		http.Error(w, "Failed to read selected photos", http.StatusInternalServerError)
 		return
 	}
 
-	var photos []string
-	var rawFiles []string
-	for _, file := range files {
-		if !file.IsDir() && !strings.HasPrefix(file.Name(), "._") {
-			lowerName := strings.ToLower(file.Name())
-			if strings.HasSuffix(lowerName, ".png") || strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".gif") {
-				photos = append(photos, file.Name())
-			} else if isRawFile(file.Name()) {
-				rawFiles = append(rawFiles, file.Name())
-			}
+	// RAW picks are listed alongside the JPEGs: the browser sends this list
+	// back on save, and a RAW left out of it would be taken out of selected/.
+	photos := []string{}
+	for _, name := range files {
+		if isViewableFile(name) {
+			photos = append(photos, name)
 		}
 	}
 
-	if len(photos) == 0 {
-		photos = rawFiles
-	}
-
-	sort.Strings(photos)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photos)
 }
 
+// saveSelectedPhotosHandler adds photos to the session's selection: those
+// listed in selected_files and, when min_rating (1-5) is set, every photo
+// rated at least that many stars and not rejected. The request's mode picks
+// how they are stored (see selectionModes); without it the session keeps
+// the mode it was saved with, and a new selection uses the configured one.
 func saveSelectedPhotosHandler(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		SelectedFiles []string `json:"selected_files"`
 		Directory     string   `json:"directory"`
+		MinRating     *int     `json:"min_rating"`
+		Mode          string   `json:"mode"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
@@ -693,122 +1416,106 @@ func saveSelectedPhotosHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if data.MinRating != nil && data.Directory != "" {
+		if *data.MinRating < 1 || *data.MinRating > 5 {
+			http.Error(w, "min_rating must be between 1 and 5", http.StatusBadRequest)
+			return
+		}
+		rated, err := culledPhotos(data.Directory, *data.MinRating)
+		if err != nil {
+			http.Error(w, "Failed to read culling state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		seen := make(map[string]bool, len(data.SelectedFiles))
+		for _, f := range data.SelectedFiles {
+			seen[f] = true
+		}
+		for _, f := range rated {
+			if !seen[f] {
+				data.SelectedFiles = append(data.SelectedFiles, f)
+			}
+		}
+	}
+
 	if len(data.SelectedFiles) == 0 || data.Directory == "" {
 		http.Error(w, "Missing 'selected_files' or 'directory' in request", http.StatusBadRequest)
 		return
 	}
 
+	if data.Mode != "" && !selectionModes[data.Mode] {
+		http.Error(w, "mode must be copy, hardlink, symlink or virtual", http.StatusBadRequest)
+		return
+	}
 	sourceDir, err := safePhotoPath(data.Directory)
 	if err != nil {
 		http.Error(w, "Invalid directory", http.StatusBadRequest)
 		return
 	}
-	destinationDir := filepath.Join(sourceDir, "selected")
-
-	if err := os.MkdirAll(destinationDir, 0755); err != nil {
-		http.Error(w, "Failed to create destination directory", http.StatusInternalServerError)
+	if _, err := os.Stat(sourceDir); err != nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
 		return
 	}
-
-	for _, filename := range data.SelectedFiles {
-		if strings.Contains(filename, "..") || strings.ContainsAny(filename, `/\`) {
-			log.Printf("Skipping invalid filename: %s", filename)
-			continue
-		}
-		sourcePath := filepath.Join(sourceDir, filename)
-		destinationPath := filepath.Join(destinationDir, filename)
-
-		sourceFile, err := os.Open(sourcePath)
-		if err != nil {
-			log.Printf("Failed to open source file: %v", err)
-			continue
-		}
-		defer sourceFile.Close()
-
-		destinationFile, err := os.Create(destinationPath)
-		if err != nil {
-			log.Printf("Failed to create destination file: %v", err)
-			continue
+	mode := data.Mode
+	if mode == "" {
+		if mode, err = sessionSelectionMode(data.Directory); err != nil {
+			http.Error(w, "Failed to read selection state: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		defer destinationFile.Close()
+	}
 
-		if _, err := io.Copy(destinationFile, sourceFile); err != nil {
-			log.Printf("Failed to copy file: %v", err)
-			continue
-		}
+	added, err := addToSelection(r.Context(), data.Directory, data.SelectedFiles, mode)
+	if err != nil {
+		http.Error(w, "Failed to save selection: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	updateLibrarySession(data.Directory)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Successfully copied " + strconv.Itoa(len(data.SelectedFiles)) + " files to '" + destinationDir + "'",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Successfully selected " + strconv.Itoa(added) + " files (" + mode + ")",
+		"mode":    mode,
+		"added":   added,
 	})
 }
 
-func buildImportedFilesSet() map[string]bool {
-	importedFiles := make(map[string]bool)
-
-	dirs, err := ioutil.ReadDir(photoBaseDir)
+// duplicateClass classifies a card file against the library index (see
+// libraryLookup.classify), by its content and by the name it gets without an
+// import template. A file that can't be read counts as new.
+func duplicateClass(library libraryLookup, path string, info os.FileInfo, cameraDir string) string {
+	fp, err := cardFingerprint(path, info)
 	if err != nil {
-		return importedFiles
-	}
-
-	for _, dir := range dirs {
-		if dir.IsDir() && dir.Name() != ".thumbnails" {
-			dirPath := filepath.Join(photoBaseDir, dir.Name())
-			files, err := ioutil.ReadDir(dirPath)
-			if err != nil {
-				continue
-			}
-
-			for _, file := range files {
-				if !file.IsDir() {
-					importedFiles[file.Name()] = true
-				}
-			}
-		}
+		log.Printf("Failed to fingerprint %s: %v", path, err)
+		return duplicateNew
 	}
-
-	return importedFiles
+	return library.classify(fp, legacyImportName(cameraDir, info.Name()))
 }
 
 func importFromUSBHandler(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Since            string `json:"since"`
 		Until            string `json:"until"`
-		SkipDuplicates   bool   `json:"skip_duplicates"`
+		SkipDuplicates   *bool  `json:"skip_duplicates"`
 		TargetDirectory  string `json:"target_directory"`
 		NewDirectoryName string `json:"new_directory_name"`
-		ImportVideos     bool   `json:"import_videos"`
-		ImportRaws       bool   `json:"import_raws"`
+		ImportVideos     *bool  `json:"import_videos"`
+		ImportRaws       *bool  `json:"import_raws"`
+		Card             string `json:"card"` // see cardMountPoint
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	var sinceDate time.Time
-	var untilDate time.Time
-	var err error
-	if data.Since != "" {
-		sinceDate, err = time.Parse("2006-01-02", data.Since)
-		if err != nil {
-			http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
-			return
-		}
-	}
-	if data.Until != "" {
-		untilDate, err = time.Parse("2006-01-02", data.Until)
-		if err != nil {
-			http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
-			return
-		}
-		// Make until date inclusive by adding one day
-		untilDate = untilDate.AddDate(0, 0, 1)
+	dates, err := parseDateRange(data.Since, data.Until)
+	if err != nil {
+		http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
+		return
 	}
 
-	usbMountPoint := findUSBMountPoint()
-	if usbMountPoint == "" {
-		http.Error(w, "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is it connected?", http.StatusNotFound)
+	usbMountPoint, err := cardMountPoint(data.Card)
+	if err != nil {
+		message, status := cardErrorResponse(err, data.Card)
+		http.Error(w, message, status)
 		return
 	}
 
@@ -864,15 +1571,27 @@ func importFromUSBHandler(w http.ResponseWriter, r *http.Request) {
 		dir  string
 	}
 	var allFiles []fileWithDir
+	options := make(map[string]importOptions)
+	sidecars := make(map[string]map[string]string)          // camera dir -> upper-cased name -> XMP name
+	companions := make(map[string]map[string][]os.FileInfo) // camera dir -> see groupCompanions
+	anySkipDuplicates := false
 	for _, cameraDir := range cameraDirs {
+		opts := resolveImportOptions(cameraDir, data.ImportRaws, data.ImportVideos, data.SkipDuplicates)
+		options[cameraDir] = opts
+		anySkipDuplicates = anySkipDuplicates || opts.skipDuplicates
 		sourceDir := filepath.Join(usbMountPoint, "DCIM", cameraDir)
 		files, err := ioutil.ReadDir(sourceDir)
 		if err != nil {
 			log.Printf("Failed to read directory %s: %v", sourceDir, err)
 			continue
 		}
+		sidecars[cameraDir] = make(map[string]string)
+		companions[cameraDir] = groupCompanions(files)
 		for _, file := range files {
 			allFiles = append(allFiles, fileWithDir{file: file, dir: cameraDir})
+			if strings.EqualFold(filepath.Ext(file.Name()), ".xmp") {
+				sidecars[cameraDir][strings.ToUpper(file.Name())] = file.Name()
+			}
 		}
 	}
 
@@ -882,21 +1601,40 @@ func importFromUSBHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Build set of already imported files once (if skip duplicates is enabled)
-	var importedFiles map[string]bool
-	if data.SkipDuplicates {
-		importedFiles = buildImportedFilesSet()
-		log.Printf("Skip duplicates enabled: found %d already imported files", len(importedFiles))
+	var library libraryLookup
+	if anySkipDuplicates {
+		library = refreshLibraryIndex()
+		log.Printf("Skip duplicates enabled: %d files in the library index", len(library.byName))
 	}
 
 	// Pre-pass: determine exactly which files will be copied so we can report a
 	// total up front and stream per-file progress during the copy pass.
-	type fileToCopy struct {
-		src      string
-		destName string
-		isMedia  bool // jpg or raw — included in thumbnail generation
+	namer := newImportNamer(configuredImportTemplate(), filepath.Base(destinationDir))
+	var toCopy []importJobFile
+	// Companion files (voice memos, THM, XMP, proxies) go wherever a file of
+	// their shot goes, named after it.
+	attached := make(map[string]bool)
+	attachCompanions := func(cameraDir, fileName, destFilename string) {
+		stem := strings.ToUpper(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+		if attached[cameraDir+"/"+stem] {
+			return
+		}
+		attached[cameraDir+"/"+stem] = true
+		for _, c := range companions[cameraDir][stem] {
+			destName := companionDestName(destFilename, c.Name())
+			if _, err := os.Stat(filepath.Join(destinationDir, destName)); err == nil {
+				continue
+			}
+			toCopy = append(toCopy, importJobFile{
+				Src:       filepath.Join("DCIM", cameraDir, c.Name()),
+				DestName:  destName,
+				Size:      c.Size(),
+				Companion: true,
+			})
+		}
 	}
-	var toCopy []fileToCopy
 	skippedDuplicates := 0
+	nameCollisions := 0
 	for _, fileEntry := range allFiles {
 		file := fileEntry.file
 		if file.IsDir() || strings.HasPrefix(file.Name(), "._") {
@@ -908,81 +1646,71 @@ func importFromUSBHandler(w http.ResponseWriter, r *http.Request) {
 		isMp4 := strings.HasSuffix(lowerName, ".mp4")
 		isRaw := isRawFile(file.Name())
 
-		if !isJpg && (!isMp4 || !data.ImportVideos) && (!isRaw || !data.ImportRaws) {
+		opts := options[fileEntry.dir]
+		if !isJpg && (!isMp4 || !opts.importVideos) && (!isRaw || !opts.importRaws) {
 			continue
 		}
 
 		sourceDir := filepath.Join(usbMountPoint, "DCIM", fileEntry.dir)
 		sourceFile := filepath.Join(sourceDir, file.Name())
 
-		if !sinceDate.IsZero() || !untilDate.IsZero() {
-			fileInfo, err := os.Stat(sourceFile)
-			if err != nil {
-				log.Printf("Failed to get file info: %v", err)
-				continue
-			}
-			modTime := fileInfo.ModTime()
-			if !sinceDate.IsZero() && modTime.Before(sinceDate) {
-				continue
-			}
-			if !untilDate.IsZero() && !modTime.Before(untilDate) {
+		if dates.active() {
+			taken, _ := fileCaptureTime(sourceFile, file)
+			if !dates.contains(taken.Format("2006-01-02")) {
 				continue
 			}
 		}
 
-		dirPrefix := getDCIMPrefix(fileEntry.dir)
-		destFilename := file.Name()
-		if dirPrefix != "" {
-			destFilename = dirPrefix + "_" + file.Name()
-		}
-
-		// Check if file has already been imported to any directory (O(1) lookup)
-		if data.SkipDuplicates && importedFiles[destFilename] {
-			skippedDuplicates++
-			continue
+		// Check if the file's content is already anywhere in the library; a
+		// file that only shares its name with one is imported.
+		src := filepath.Join("DCIM", fileEntry.dir, file.Name())
+		if opts.skipDuplicates {
+			switch duplicateClass(library, sourceFile, file, fileEntry.dir) {
+			case duplicateTrue:
+				skippedDuplicates++
+				continue
+			case duplicateCollision:
+				nameCollisions++
+			}
 		}
+		destFilename := namer.name(fileEntry.dir, sourceFile, file)
 
-		// Skip if the file already exists in an existing destination directory.
+		// Skip if the file already exists in an existing destination directory,
+		// but still pick up companions an earlier import left on the card.
 		if destinationDirCreated {
 			if _, err := os.Stat(filepath.Join(destinationDir, destFilename)); err == nil {
+				attachCompanions(fileEntry.dir, file.Name(), destFilename)
 				continue
 			}
 		}
 
-		toCopy = append(toCopy, fileToCopy{src: sourceFile, destName: destFilename, isMedia: isJpg || isRaw})
-	}
-
-	// Everything below streams newline-delimited JSON (NDJSON) progress events so
-	// the client can show a live progress bar. Once the first line is written the
-	// HTTP status is fixed at 200, so all hard failures above use http.Error.
-	w.Header().Set("Content-Type", "application/x-ndjson")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	flusher, _ := w.(http.Flusher)
-	enc := json.NewEncoder(w)
-	emit := func(event map[string]interface{}) {
-		if err := enc.Encode(event); err != nil {
-			return
+		item := importJobFile{
+			Src:      src,
+			DestName: destFilename,
+			Size:     file.Size(),
+			IsMedia:  isJpg || isRaw,
 		}
-		if flusher != nil {
-			flusher.Flush()
+		if sidecar, ok := findXMPSidecar(sidecars[fileEntry.dir], file.Name()); ok {
+			item.Sidecar = filepath.Join("DCIM", fileEntry.dir, sidecar)
 		}
+		toCopy = append(toCopy, item)
+		attachCompanions(fileEntry.dir, file.Name(), destFilename)
 	}
 
 	dirName := filepath.Base(destinationDir)
-	total := len(toCopy)
 
 	// Nothing to copy: report why and stop (no directory is created).
-	if total == 0 {
+	if len(toCopy) == 0 {
 		var message string
-		if !sinceDate.IsZero() || !untilDate.IsZero() {
+		if dates.active() {
 			message = "No new files found in the selected date range"
 		} else if skippedDuplicates > 0 {
 			message = "All " + strconv.Itoa(skippedDuplicates) + " files have already been imported."
 		} else {
 			message = "No files found to import."
 		}
-		emit(map[string]interface{}{
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		json.NewEncoder(w).Encode(map[string]interface{}{
 			"type":               "done",
 			"message":            message,
 			"new_directory":      nil,
@@ -992,135 +1720,80 @@ func importFromUSBHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if runningJobForDirectory(dirName) != nil {
+		http.Error(w, "An import into this directory is already running", http.StatusConflict)
+		return
+	}
+
 	// Create the destination directory now that we know files will be copied.
 	if !destinationDirCreated {
 		if err := os.MkdirAll(destinationDir, 0755); err != nil {
 			log.Printf("Failed to create destination directory: %v", err)
-			emit(map[string]interface{}{"type": "error", "message": "Could not create destination directory"})
+			http.Error(w, "Could not create destination directory", http.StatusInternalServerError)
 			return
 		}
-		destinationDirCreated = true
-	}
-
-	emit(map[string]interface{}{"type": "start", "total": total})
-
-	// Throttle progress events to at most ~100 over the whole import.
-	step := total / 100
-	if step < 1 {
-		step = 1
-	}
-
-	copiedCount := 0
-	var copiedFiles []string
-	for _, item := range toCopy {
-		if err := copyFile(item.src, filepath.Join(destinationDir, item.destName)); err != nil {
-			log.Printf("Failed to copy %s: %v", item.src, err)
-			continue
-		}
-		copiedCount++
-		if item.isMedia {
-			copiedFiles = append(copiedFiles, item.destName)
-		}
-		if copiedCount == total || copiedCount%step == 0 {
-			emit(map[string]interface{}{"type": "progress", "copied": copiedCount, "total": total})
-		}
-	}
-
-	// Start async thumbnail generation for imported photos
-	go func() {
-		log.Printf("Starting background thumbnail generation for imported directory: %s (%d photos)", dirName, len(copiedFiles))
-		preGenerateThumbnails(dirName, copiedFiles)
-	}()
-
-	message := "Successfully copied " + strconv.Itoa(copiedCount) + " new files"
-	if !isNewBatch {
-		message += " to " + dirName
-	}
-	message += "."
-	if skippedDuplicates > 0 {
-		message += " Skipped " + strconv.Itoa(skippedDuplicates) + " already imported."
-	}
-
-	var newDirectory interface{}
-	if isNewBatch {
-		newDirectory = dirName
-	} else {
-		newDirectory = nil
 	}
-	emit(map[string]interface{}{
-		"type":               "done",
-		"message":            message,
-		"new_directory":      newDirectory,
-		"copied":             copiedCount,
-		"skipped_duplicates": skippedDuplicates,
-	})
-}
 
-// copyFile copies a single file from src to dst, closing both handles before it
-// returns. Using this (rather than inline defers inside a copy loop) keeps at
-// most one source/destination file descriptor open at a time during an import.
-func copyFile(src, dst string) error {
-	source, err := os.Open(src)
-	if err != nil {
-		return err
+	// The copy runs as a background job so it survives the client going away;
+	// this request just follows the job's progress as newline-delimited JSON
+	// (NDJSON) events. Once the first line is written the HTTP status is fixed
+	// at 200, so all hard failures above use http.Error.
+	job, err := startImportJob(importJobState{
+		ID:                newImportJobID(),
+		Directory:         dirName,
+		IsNewBatch:        isNewBatch,
+		SkippedDuplicates: skippedDuplicates,
+		NameCollisions:    nameCollisions,
+		Card:              identifyCard(usbMountPoint).ID,
+		Started:           time.Now(),
+		Files:             toCopy,
+	}, usbMountPoint)
+	if errors.Is(err, errImportRunning) {
+		http.Error(w, "An import into this directory is already running", http.StatusConflict)
+		return
 	}
-	defer source.Close()
-
-	destination, err := os.Create(dst)
 	if err != nil {
-		return err
-	}
-	defer destination.Close()
-
-	if _, err := io.Copy(destination, source); err != nil {
-		return err
+		log.Printf("Failed to start import job: %v", err)
+		http.Error(w, "Could not start import", http.StatusInternalServerError)
+		return
 	}
-	return nil
+	streamImportJob(w, r, job, 0)
 }
 
 func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Since           string `json:"since"`
 		Until           string `json:"until"`
-		SkipDuplicates  bool   `json:"skip_duplicates"`
+		SkipDuplicates  *bool  `json:"skip_duplicates"`
 		TargetDirectory string `json:"target_directory"`
-		ImportVideos    bool   `json:"import_videos"`
-		ImportRaws      bool   `json:"import_raws"`
+		ImportVideos    *bool  `json:"import_videos"`
+		ImportRaws      *bool  `json:"import_raws"`
+		Card            string `json:"card"` // see cardMountPoint
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	var sinceDate time.Time
-	var untilDate time.Time
-	var err error
-	if data.Since != "" {
-		sinceDate, err = time.Parse("2006-01-02", data.Since)
-		if err != nil {
-			http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
-			return
-		}
-	}
-	if data.Until != "" {
-		untilDate, err = time.Parse("2006-01-02", data.Until)
-		if err != nil {
-			http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
-			return
-		}
-		// Make until date inclusive by adding one day
-		untilDate = untilDate.AddDate(0, 0, 1)
+	dates, err := parseDateRange(data.Since, data.Until)
+	if err != nil {
+		http.Error(w, "Invalid date format. Please use YYYY-MM-DD.", http.StatusBadRequest)
+		return
 	}
 
-	usbMountPoint := findUSBMountPoint()
-	if usbMountPoint == "" {
+	usbMountPoint, err := cardMountPoint(data.Card)
+	if err != nil {
+		message, _ := cardErrorResponse(err, data.Card)
+		if errors.Is(err, errNoCard) {
+			message = "USB device with a camera DCIM directory not found"
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"total_files":     0,
 			"files_to_import": 0,
 			"files_to_skip":   0,
-			"usb_connected":   false,
-			"error":           "USB device with a camera DCIM directory not found",
+			"usb_connected":   !errors.Is(err, errNoCard),
+			"error":           message,
 		})
 		return
 	}
@@ -1159,32 +1832,54 @@ func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 		dir  string
 	}
 	var allFiles []fileWithDir
+	options := make(map[string]importOptions)
+	companions := make(map[string]map[string][]os.FileInfo) // camera dir -> see groupCompanions
+	companionsFound := 0
+	anySkipDuplicates := false
 	for _, cameraDir := range cameraDirs {
+		opts := resolveImportOptions(cameraDir, data.ImportRaws, data.ImportVideos, data.SkipDuplicates)
+		options[cameraDir] = opts
+		anySkipDuplicates = anySkipDuplicates || opts.skipDuplicates
 		sourceDir := filepath.Join(usbMountPoint, "DCIM", cameraDir)
 		files, err := ioutil.ReadDir(sourceDir)
 		if err != nil {
 			log.Printf("Failed to read directory %s: %v", sourceDir, err)
 			continue
 		}
+		companions[cameraDir] = groupCompanions(files)
+		for _, group := range companions[cameraDir] {
+			companionsFound += len(group)
+		}
 		for _, file := range files {
 			allFiles = append(allFiles, fileWithDir{file: file, dir: cameraDir})
 		}
 	}
 
 	// Build set of already imported files once (if skip duplicates is enabled)
-	var importedFiles map[string]bool
-	if data.SkipDuplicates {
-		importedFiles = buildImportedFilesSet()
+	var library libraryLookup
+	if anySkipDuplicates {
+		library = refreshLibraryIndex()
 	}
 
 	totalFiles := 0
 	filesToImport := 0
 	skippedDuplicates := 0
+	nameCollisions := 0
+	newFiles := 0
 	skippedByDate := 0
 	skippedVideos := 0
 	skippedRaws := 0
-	// dailyBreakdown maps "YYYY-MM-DD" -> count of files that will be imported that day
+	companionsToImport := 0
+	counted := make(map[string]bool) // camera dir/stem whose companions are counted
+	var namer *importNamer
+	if destinationDir != "" {
+		namer = newImportNamer(configuredImportTemplate(), filepath.Base(destinationDir))
+	}
+	// dailyBreakdown maps "YYYY-MM-DD" -> count of files that will be imported
+	// that day; dailySources splits each count by where its date came from.
 	dailyBreakdown := make(map[string]int)
+	dailySources := make(map[string]map[string]int)
+	dateSources := map[string]int{captureSourceExif: 0, captureSourceMtime: 0}
 
 	for _, fileEntry := range allFiles {
 		file := fileEntry.file
@@ -1200,7 +1895,8 @@ func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Skip if not jpg and not importing videos/raws
-			if !isJpg && (!isMp4 || !data.ImportVideos) && (!isRaw || !data.ImportRaws) {
+			opts := options[fileEntry.dir]
+			if !isJpg && (!isMp4 || !opts.importVideos) && (!isRaw || !opts.importRaws) {
 				if isMp4 {
 					skippedVideos++
 				}
@@ -1213,45 +1909,31 @@ func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 			sourceDir := filepath.Join(usbMountPoint, "DCIM", fileEntry.dir)
 			sourceFile := filepath.Join(sourceDir, file.Name())
 
-			// Check date filter (range)
-			var modTime time.Time
-			if !sinceDate.IsZero() || !untilDate.IsZero() {
-				fileInfo, err := os.Stat(sourceFile)
-				if err != nil {
-					skippedByDate++
-					continue
-				}
-				modTime = fileInfo.ModTime()
-				if !sinceDate.IsZero() && modTime.Before(sinceDate) {
-					skippedByDate++
-					continue
-				}
-				if !untilDate.IsZero() && !modTime.Before(untilDate) {
-					skippedByDate++
-					continue
-				}
-			} else {
-				// Still need modTime for daily breakdown
-				if fileInfo, err := os.Stat(sourceFile); err == nil {
-					modTime = fileInfo.ModTime()
-				}
-			}
-
-			dirPrefix := getDCIMPrefix(fileEntry.dir)
-			destFilename := file.Name()
-			if dirPrefix != "" {
-				destFilename = dirPrefix + "_" + file.Name()
+			// Check date filter (range). The capture date is also needed for
+			// the daily breakdown, so it is read even without a filter.
+			taken, source := fileCaptureTime(sourceFile, file)
+			day := taken.Format("2006-01-02")
+			if !dates.contains(day) {
+				skippedByDate++
+				continue
 			}
 
 			// Check if already imported
-			if data.SkipDuplicates && importedFiles[destFilename] {
-				skippedDuplicates++
-				continue
+			if opts.skipDuplicates {
+				switch duplicateClass(library, sourceFile, file, fileEntry.dir) {
+				case duplicateTrue:
+					skippedDuplicates++
+					continue
+				case duplicateCollision:
+					nameCollisions++
+				default:
+					newFiles++
+				}
 			}
 
 			// Check if file already exists in target destination
-			if destinationDir != "" {
-				destinationFile := filepath.Join(destinationDir, destFilename)
+			if namer != nil {
+				destinationFile := filepath.Join(destinationDir, namer.name(fileEntry.dir, sourceFile, file))
 				if _, err := os.Stat(destinationFile); err == nil {
 					skippedDuplicates++
 					continue
@@ -1259,10 +1941,16 @@ func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			filesToImport++
-			if !modTime.IsZero() {
-				dateKey := modTime.Format("2006-01-02")
-				dailyBreakdown[dateKey]++
+			if stem := strings.ToUpper(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))); !counted[fileEntry.dir+"/"+stem] {
+				counted[fileEntry.dir+"/"+stem] = true
+				companionsToImport += len(companions[fileEntry.dir][stem])
+			}
+			dailyBreakdown[day]++
+			if dailySources[day] == nil {
+				dailySources[day] = make(map[string]int)
 			}
+			dailySources[day][source]++
+			dateSources[source]++
 		}
 	}
 
@@ -1271,133 +1959,17 @@ func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
 		"total_files":        totalFiles,
 		"files_to_import":    filesToImport,
 		"skipped_duplicates": skippedDuplicates,
+		"name_collisions":    nameCollisions,
+		"new_files":          newFiles,
 		"skipped_by_date":    skippedByDate,
 		"skipped_videos":     skippedVideos,
 		"skipped_raws":       skippedRaws,
+		"companions_found":   companionsFound,
+		"companions":         companionsToImport,
 		"usb_connected":      true,
 		"daily_breakdown":    dailyBreakdown,
-	})
-}
-
-func exportRawFilesHandler(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Directory string `json:"directory"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	if data.Directory == "" {
-		http.Error(w, "Missing 'directory' in request", http.StatusBadRequest)
-		return
-	}
-
-	// Find USB/SD card mount point
-	usbMountPoint := findUSBMountPoint()
-	if usbMountPoint == "" {
-		http.Error(w, "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is the SD card connected?", http.StatusNotFound)
-		return
-	}
-
-	if len(findCameraDirectories(usbMountPoint)) == 0 {
-		http.Error(w, "Could not find a supported camera DCIM directory on USB device", http.StatusNotFound)
-		return
-	}
-
-	sourceDir, err := safePhotoPath(data.Directory)
-	if err != nil {
-		http.Error(w, "Invalid directory", http.StatusBadRequest)
-		return
-	}
-	selectedDir := filepath.Join(sourceDir, "selected")
-	rawDestDir := filepath.Join(selectedDir, "raw")
-
-	// Check if selected directory exists and has files
-	selectedFiles, err := ioutil.ReadDir(selectedDir)
-	if err != nil {
-		http.Error(w, "Selected directory not found or empty", http.StatusNotFound)
-		return
-	}
-
-	// Filter for JPEG files in selected directory
-	var jpegFiles []string
-	for _, file := range selectedFiles {
-		if !file.IsDir() {
-			lowerName := strings.ToLower(file.Name())
-			if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") {
-				jpegFiles = append(jpegFiles, file.Name())
-			}
-		}
-	}
-
-	if len(jpegFiles) == 0 {
-		http.Error(w, "No JPEG files found in selected directory", http.StatusNotFound)
-		return
-	}
-
-	// Create raw destination directory
-	if err := os.MkdirAll(rawDestDir, 0755); err != nil {
-		http.Error(w, "Failed to create raw destination directory", http.StatusInternalServerError)
-		return
-	}
-
-	copiedCount := 0
-	skippedCount := 0
-	notFoundCount := 0
-
-	for _, jpegFile := range jpegFiles {
-		ext := filepath.Ext(jpegFile)
-		baseName := strings.TrimSuffix(jpegFile, ext)
-
-		prefix, originalBaseName := splitPrefixedFilename(baseName)
-
-		// Skip if a raw file (any supported extension) is already at destination
-		if rawAlreadyExported(rawDestDir, baseName) {
-			skippedCount++
-			continue
-		}
-
-		rawSourcePath, rawExt, found := findRawForJPG(usbMountPoint, prefix, originalBaseName)
-		if !found {
-			log.Printf("Raw file not found on SD card for %s", originalBaseName)
-			notFoundCount++
-			continue
-		}
-
-		rawDestPath := filepath.Join(rawDestDir, baseName+rawExt)
-
-		// Copy the raw file from SD card
-		source, err := os.Open(rawSourcePath)
-		if err != nil {
-			log.Printf("Failed to open source raw file: %v", err)
-			notFoundCount++
-			continue
-		}
-		defer source.Close()
-
-		destination, err := os.Create(rawDestPath)
-		if err != nil {
-			log.Printf("Failed to create destination raw file: %v", err)
-			continue
-		}
-		defer destination.Close()
-
-		if _, err := io.Copy(destination, source); err != nil {
-			log.Printf("Failed to copy raw file: %v", err)
-			continue
-		}
-		copiedCount++
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":        "Raw file export complete",
-		"copied":         copiedCount,
-		"skipped":        skippedCount,
-		"not_found":      notFoundCount,
-		"total_selected": len(jpegFiles),
+		"daily_sources":      dailySources,
+		"date_sources":       dateSources,
 	})
 }
 
@@ -1405,6 +1977,7 @@ func exportRawSingleFileHandler(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Directory string `json:"directory"`
 		Filename  string `json:"filename"`
+		Card      string `json:"card"` // see cardMountPoint
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
@@ -1417,10 +1990,11 @@ func exportRawSingleFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find USB/SD card mount point
-	usbMountPoint := findUSBMountPoint()
-	if usbMountPoint == "" {
-		http.Error(w, "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is the SD card connected?", http.StatusNotFound)
+	// Only needed if the RAW isn't in the session or an archive directory
+	usbMountPoint, err := cardMountPoint(data.Card)
+	if err != nil && !errors.Is(err, errNoCard) {
+		message, status := cardErrorResponse(err, data.Card)
+		http.Error(w, message, status)
 		return
 	}
 
@@ -1446,10 +2020,15 @@ func exportRawSingleFileHandler(w http.ResponseWriter, r *http.Request) {
 	ext := filepath.Ext(data.Filename)
 	baseName := strings.TrimSuffix(data.Filename, ext)
 
-	prefix, originalBaseName := splitPrefixedFilename(baseName)
+	culling, err := loadCulling(data.Directory)
+	if err != nil {
+		log.Printf("Failed to read culling state for %s: %v", data.Directory, err)
+	}
 
-	// Skip if a raw file (any supported extension) is already at destination
-	if rawAlreadyExported(rawDestDir, baseName) {
+	// Skip if a raw file (any supported extension) is already at
+	// destination, but refresh its sidecar in case ratings changed.
+	if rawPath, ok := rawPathInDir(rawDestDir, baseName); ok {
+		exportXMPSidecar(culling, data.Filename, rawPath)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"message": "Raw file already exported",
@@ -1458,41 +2037,40 @@ func exportRawSingleFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rawSourcePath, rawExt, found := findRawForJPG(usbMountPoint, prefix, originalBaseName)
+	src, found := findRawSource(data.Directory, baseName, usbMountPoint)
 	if !found {
-		http.Error(w, "Raw file not found on SD card", http.StatusNotFound)
+		if usbMountPoint == "" {
+			http.Error(w, "Raw file not found in the session or archives, and no SD card with a camera DCIM directory is connected", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Raw file not found", http.StatusNotFound)
 		return
 	}
 
-	rawDestPath := filepath.Join(rawDestDir, baseName+rawExt)
-
-	// Copy the raw file from SD card
-	source, err := os.Open(rawSourcePath)
-	if err != nil {
-		log.Printf("Failed to open source raw file: %v", err)
-		http.Error(w, "Failed to open source raw file", http.StatusInternalServerError)
-		return
-	}
-	defer source.Close()
+	rawDestPath := filepath.Join(rawDestDir, baseName+filepath.Ext(src.path))
 
-	destination, err := os.Create(rawDestPath)
+	entry, err := exportRawVerified(r.Context(), data.Directory, src, rawDestPath)
 	if err != nil {
-		log.Printf("Failed to create destination raw file: %v", err)
-		http.Error(w, "Failed to create destination raw file", http.StatusInternalServerError)
-		return
-	}
-	defer destination.Close()
-
-	if _, err := io.Copy(destination, source); err != nil {
 		log.Printf("Failed to copy raw file: %v", err)
+		var vErr *verifyError
+		if errors.As(err, &vErr) {
+			http.Error(w, "Raw file copy failed checksum verification", http.StatusInternalServerError)
+			return
+		}
 		http.Error(w, "Failed to copy raw file", http.StatusInternalServerError)
 		return
 	}
+	exportXMPSidecar(culling, data.Filename, rawDestPath)
+	companions := exportRawCompanions(r.Context(), data.Directory, src, rawDestPath, make(map[string][]os.DirEntry))
+	if err := recordManifestEntries(data.Directory, append([]manifestEntry{entry}, companions...)); err != nil {
+		log.Printf("Failed to update import manifest for %s: %v", data.Directory, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Raw file export complete",
 		"status":  "copied",
+		"source":  src.kind,
 	})
 }
 
@@ -1508,23 +2086,14 @@ func exportStatusHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid directory", http.StatusBadRequest)
 		return
 	}
-	selectedDir := filepath.Join(sourceDir, "selected")
-	rawDir := filepath.Join(selectedDir, "raw")
+	rawDir := filepath.Join(sourceDir, "selected", "raw")
 
-	// Count JPEG files in selected directory
-	selectedCount := 0
-	var jpegFiles []string
-	if files, err := ioutil.ReadDir(selectedDir); err == nil {
-		for _, file := range files {
-			if !file.IsDir() {
-				lowerName := strings.ToLower(file.Name())
-				if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") {
-					selectedCount++
-					jpegFiles = append(jpegFiles, file.Name())
-				}
-			}
-		}
+	// Count selected JPEGs, whatever the session's selection mode
+	jpegFiles, err := selectedJPEGs(directory)
+	if err != nil {
+		log.Printf("Failed to read selection of %s: %v", directory, err)
 	}
+	selectedCount := len(jpegFiles)
 
 	// Count raw files in raw directory (any supported extension)
 	rawCount := 0
@@ -1556,101 +2125,6 @@ func exportStatusHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func deleteImportedHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Find USB/SD card mount point
-	usbMountPoint := findUSBMountPoint()
-	if usbMountPoint == "" {
-		http.Error(w, "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is it connected?", http.StatusNotFound)
-		return
-	}
-
-	cameraDirs := findCameraDirectories(usbMountPoint)
-	if len(cameraDirs) == 0 {
-		http.Error(w, "Could not find a supported camera DCIM directory on USB device", http.StatusNotFound)
-		return
-	}
-
-	// Build set of imported files using the same logic as the import handler
-	importedFiles := buildImportedFilesSet()
-	log.Printf("Delete imported: found %d already imported files", len(importedFiles))
-
-	deletedCount := 0
-	deletedRawCount := 0
-	notFoundCount := 0
-	errorCount := 0
-
-	// Process files from all camera DCIM directories
-	for _, cameraDir := range cameraDirs {
-		sourceDir := filepath.Join(usbMountPoint, "DCIM", cameraDir)
-		files, err := ioutil.ReadDir(sourceDir)
-		if err != nil {
-			log.Printf("Failed to read directory %s: %v", sourceDir, err)
-			continue
-		}
-
-		for _, file := range files {
-			if !file.IsDir() && !strings.HasPrefix(file.Name(), "._") {
-				lowerName := strings.ToLower(file.Name())
-				// Process both .jpg and .mp4 files
-				isJpg := strings.HasSuffix(lowerName, ".jpg")
-				isMp4 := strings.HasSuffix(lowerName, ".mp4")
-				if !isJpg && !isMp4 {
-					continue
-				}
-
-				dirPrefix := getDCIMPrefix(cameraDir)
-				destFilename := file.Name()
-				if dirPrefix != "" {
-					destFilename = dirPrefix + "_" + file.Name()
-				}
-
-				// Only delete files that are in the imported set
-				if importedFiles[destFilename] {
-					filePath := filepath.Join(sourceDir, file.Name())
-					if err := os.Remove(filePath); err == nil {
-						deletedCount++
-						log.Printf("Deleted imported file: %s", file.Name())
-
-						// If it's a JPG, also try to delete the associated RAW file
-						if isJpg {
-							baseName := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-							if brand := detectCameraBrand(cameraDir); brand != nil {
-								rawFilePath := filepath.Join(sourceDir, baseName+brand.rawExt)
-								if err := os.Remove(rawFilePath); err == nil {
-									deletedRawCount++
-									log.Printf("Deleted associated RAW file: %s", baseName+brand.rawExt)
-								}
-							}
-						}
-					} else {
-						if os.IsNotExist(err) {
-							notFoundCount++
-						} else {
-							log.Printf("Failed to delete file %s: %v", filePath, err)
-							errorCount++
-						}
-					}
-				}
-			}
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":     "Delete operation complete",
-		"deleted":     deletedCount,
-		"deleted_raw": deletedRawCount,
-		"not_found":   notFoundCount,
-		"errors":      errorCount,
-		"total_found": deletedCount + deletedRawCount + notFoundCount + errorCount,
-	})
-}
-
 // sdCleanupItem describes one junk directory found at the root of the SD card.
 type sdCleanupItem struct {
 	Name  string `json:"name"`
@@ -1704,10 +2178,17 @@ func scanSDCleanupTargets(mountPoint string) []sdCleanupItem {
 }
 
 // sdCleanupHandler reports (GET) and deletes (POST) trash and OS metadata
-// folders at the root of the SD card. Deletion is restricted to the
-// sdCleanupTarget allowlist — nothing under DCIM is ever touched.
+// folders at the root of the SD card chosen with the card query parameter
+// (see cardMountPoint). Deletion is restricted to the sdCleanupTarget
+// allowlist — nothing under DCIM is ever touched.
 func sdCleanupHandler(w http.ResponseWriter, r *http.Request) {
-	usbMountPoint := findUSBMountPoint()
+	card := r.URL.Query().Get("card")
+	usbMountPoint, err := cardMountPoint(card)
+	if err != nil && !errors.Is(err, errNoCard) {
+		message, status := cardErrorResponse(err, card)
+		http.Error(w, message, status)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodGet:
@@ -1734,7 +2215,8 @@ func sdCleanupHandler(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPost:
 		if usbMountPoint == "" {
-			http.Error(w, "USB device with a camera DCIM directory (e.g. 100CANON, 100OLYMP) not found. Is it connected?", http.StatusNotFound)
+			message, status := cardErrorResponse(errNoCard, card)
+			http.Error(w, message, status)
 			return
 		}
 		items := scanSDCleanupTargets(usbMountPoint)
@@ -1800,6 +2282,7 @@ func deletePhotosHandler(w http.ResponseWriter, r *http.Request) {
 	deletedCount := 0
 	notFoundCount := 0
 	errorCount := 0
+	deletedBases := make(map[string]bool)
 
 	for _, filename := range data.Files {
 		// Security: ensure filename doesn't contain path traversal
@@ -1820,27 +2303,33 @@ func deletePhotosHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		} else {
 			deletedCount++
+			deletedBases[strings.ToUpper(strings.TrimSuffix(filename, filepath.Ext(filename)))] = true
 			log.Printf("Deleted file: %s", filename)
 
 			// Also try to delete thumbnail if it exists
-			thumbnailPath := filepath.Join(thumbnailCacheDir, data.Directory, filename)
-			if err := os.Remove(thumbnailPath); err != nil && !os.IsNotExist(err) {
-				log.Printf("Failed to delete thumbnail %s: %v", thumbnailPath, err)
-			}
+			removeCachedThumbnails(data.Directory, filename)
 		}
 	}
 
+	// Voice memos and other companions go once nothing of their shot is left.
+	companionsDeleted := deleteOrphanedCompanions(targetDir, deletedBases)
+	if _, err := pruneCulling(data.Directory); err != nil {
+		log.Printf("Failed to update culling state of %s: %v", data.Directory, err)
+	}
+	updateLibrarySession(data.Directory)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":   "Delete operation complete",
-		"deleted":   deletedCount,
-		"not_found": notFoundCount,
-		"errors":    errorCount,
+		"message":            "Delete operation complete",
+		"deleted":            deletedCount,
+		"companions_deleted": companionsDeleted,
+		"not_found":          notFoundCount,
+		"errors":             errorCount,
 	})
 }
 
-// findCameraDirectories returns DCIM subdirectories whose suffix matches a supported brand
-// (e.g. 100CANON, 101CANON, 100OLYMP).
+// findCameraDirectories returns DCIM subdirectories whose name matches a supported brand
+// (e.g. 100CANON, 101CANON, 100OLYMP, 100MSDCF, 100_FUJI).
 func findCameraDirectories(mountPoint string) []string {
 	var dirs []string
 	dcimPath := filepath.Join(mountPoint, "DCIM")
@@ -1867,8 +2356,8 @@ func findCameraDirectory(mountPoint string) string {
 }
 
 // findRawForJPG locates the RAW file on the camera card matching the given JPG base name.
-// It prefers a DCIM folder whose 3-digit prefix matches the JPG's prefix, and falls back to
-// scanning all camera folders.
+// It prefers a DCIM folder starting with prefix (a 3-digit folder number or a whole folder
+// name), and falls back to scanning all camera folders.
 func findRawForJPG(mountPoint, prefix, originalBaseName string) (rawPath, rawExt string, found bool) {
 	cameraDirs := findCameraDirectories(mountPoint)
 
@@ -1877,9 +2366,11 @@ func findRawForJPG(mountPoint, prefix, originalBaseName string) (rawPath, rawExt
 		if brand == nil {
 			return "", "", false
 		}
-		candidate := filepath.Join(mountPoint, "DCIM", dir, originalBaseName+brand.rawExt)
-		if _, err := os.Stat(candidate); err == nil {
-			return candidate, brand.rawExt, true
+		for _, rawExt := range brand.rawExts {
+			candidate := filepath.Join(mountPoint, "DCIM", dir, originalBaseName+rawExt)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, rawExt, true
+			}
 		}
 		return "", "", false
 	}
@@ -1904,54 +2395,41 @@ func findRawForJPG(mountPoint, prefix, originalBaseName string) (rawPath, rawExt
 	return "", "", false
 }
 
-func findUSBMountPoint() string {
-	switch runtime.GOOS {
-	case "darwin":
-		volumesDir := "/Volumes"
-		dirs, err := ioutil.ReadDir(volumesDir)
+// decodePhoto decodes a photo for resizing: the embedded preview of a RAW, or
+// the image itself otherwise. The EXIF orientation is not applied.
+func decodePhoto(path string) (image.Image, error) {
+	filename := filepath.Base(path)
+	if isRawFile(filename) {
+		jpegData, err := extractEmbeddedJPEG(path)
 		if err != nil {
-			return ""
-		}
-		for _, dir := range dirs {
-			if dir.IsDir() {
-				mountPoint := filepath.Join(volumesDir, dir.Name())
-				if findCameraDirectory(mountPoint) != "" {
-					return mountPoint
-				}
-			}
+			return nil, fmt.Errorf("extracting embedded JPEG from %s: %w", filename, err)
 		}
-	case "linux":
-		mediaDir := filepath.Join("/media", os.Getenv("USER"))
-		dirs, err := ioutil.ReadDir(mediaDir)
+		img, err := jpeg.Decode(bytes.NewReader(jpegData))
 		if err != nil {
-			return ""
-		}
-		for _, dir := range dirs {
-			if dir.IsDir() {
-				mountPoint := filepath.Join(mediaDir, dir.Name())
-				if findCameraDirectory(mountPoint) != "" {
-					return mountPoint
-				}
-			}
+			return nil, fmt.Errorf("decoding embedded JPEG from %s: %w", filename, err)
 		}
+		return img, nil
 	}
-	return ""
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
 }
 
 // thumbnailLocks serializes generation of the same thumbnail. The import
 // worker pool, the /api/photos worker pool, and on-demand /thumbnail/ requests
 // can all race to generate the same file; without this, concurrent writers
 // interleave on the same path and readers can be served a half-written JPEG.
-var thumbnailLocks sync.Map
+var thumbnailLocks stripedLocks
 
 func generateThumbnail(directory, filename string) error {
 	thumbnailDir := filepath.Join(thumbnailCacheDir, directory)
 	thumbnailPath := filepath.Join(thumbnailDir, filename)
 
-	lockAny, _ := thumbnailLocks.LoadOrStore(directory+"/"+filename, &sync.Mutex{})
-	lock := lockAny.(*sync.Mutex)
-	lock.Lock()
-	defer lock.Unlock()
+	defer thumbnailLocks.lock(directory + "/" + filename).Unlock()
 
 	// Check if thumbnail already exists (re-checked under the lock so a
 	// goroutine that waited on a concurrent generation returns immediately)
@@ -1961,29 +2439,15 @@ func generateThumbnail(directory, filename string) error {
 
 	originalPhotoPath := filepath.Join(photoBaseDir, directory, filename)
 
-	var img image.Image
-	if isRawFile(filename) {
-		jpegData, err := extractEmbeddedJPEG(originalPhotoPath)
-		if err != nil {
-			return fmt.Errorf("extracting embedded JPEG from %s: %w", filename, err)
-		}
-		img, err = jpeg.Decode(bytes.NewReader(jpegData))
-		if err != nil {
-			return fmt.Errorf("decoding embedded JPEG from %s: %w", filename, err)
-		}
-	} else {
-		file, err := os.Open(originalPhotoPath)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		img, _, err = image.Decode(file)
-		if err != nil {
-			return err
-		}
+	img, err := decodePhoto(originalPhotoPath)
+	if err != nil {
+		return err
 	}
 
+	// Rotate after resizing, which is far cheaper than rotating the full
+	// image; thumbnails are bounded by a square so the result fits either way.
 	thumb := resize.Thumbnail(uint(thumbnailSize), uint(thumbnailSize), img, resize.Lanczos3)
+	thumb = orientImage(thumb, photoOrientation(originalPhotoPath))
 
 	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
 		return err
@@ -2007,8 +2471,11 @@ func generateThumbnail(directory, filename string) error {
 	return os.Rename(out.Name(), thumbnailPath)
 }
 
+// preGenerateThumbnails runs one worker per CPU: decoding is CPU-bound, and
+// each worker holds a RAW preview and its decoded image in memory, so more
+// workers only add memory pressure.
 func preGenerateThumbnails(directory string, photos []string) {
-	const numWorkers = 20
+	numWorkers := runtime.NumCPU()
 	var wg sync.WaitGroup
 	photoChan := make(chan string, len(photos))
 
@@ -2074,7 +2541,7 @@ func servePhotoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isRawFile(filename) {
-		jpegData, err := extractEmbeddedJPEG(photoPath)
+		jpegData, err := rawPreview(directory, filename, photoPath)
 		if err != nil {
 			http.Error(w, "Failed to extract preview from RAW file", http.StatusInternalServerError)
 			log.Printf("Error extracting JPEG from RAW %s: %v", photoPath, err)
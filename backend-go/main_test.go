@@ -1,37 +1,49 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestDetectCameraBrand(t *testing.T) {
 	tests := []struct {
 		folderName string
-		wantSuffix string
+		wantBrand  string
 	}{
-		{"100CANON", "CANON"},
-		{"101CANON", "CANON"},
-		{"100OLYMP", "OLYMP"},
-		{"100OMSYS", "OMSYS"},
-		{"999OMSYS", "OMSYS"},
-		{"100NIKON", ""}, // Not supported yet
+		{"100CANON", "Canon"},
+		{"101CANON", "Canon"},
+		{"100OLYMP", "Olympus"},
+		{"100OMSYS", "Olympus"},
+		{"999OMSYS", "Olympus"},
+		{"100MSDCF", "Sony"},
+		{"100NIKON", "Nikon"},
+		{"100ND850", "Nikon"},
+		{"101NZ_6_", "Nikon"},
+		{"100_FUJI", "Fujifilm"},
+		{"100_PANA", "Panasonic"},
+		{"100PENTX", "Pentax"},
+		{"100_0101", "Pentax"},
+		{"100_fuji", "Fujifilm"},
+		{"100ABCDEFG", ""},
+		{"MISC", ""},
 		{"DCIM", ""},
 	}
 
 	for _, tt := range tests {
 		got := detectCameraBrand(tt.folderName)
-		if tt.wantSuffix == "" {
+		if tt.wantBrand == "" {
 			if got != nil {
-				t.Errorf("detectCameraBrand(%q) = %v, want nil", tt.folderName, got.suffix)
+				t.Errorf("detectCameraBrand(%q) = %v, want nil", tt.folderName, got.name)
 			}
 		} else {
 			if got == nil {
-				t.Errorf("detectCameraBrand(%q) = nil, want %q", tt.folderName, tt.wantSuffix)
-			} else if got.suffix != tt.wantSuffix {
-				t.Errorf("detectCameraBrand(%q) = %q, want %q", tt.folderName, got.suffix, tt.wantSuffix)
+				t.Errorf("detectCameraBrand(%q) = nil, want %q", tt.folderName, tt.wantBrand)
+			} else if got.name != tt.wantBrand {
+				t.Errorf("detectCameraBrand(%q) = %q, want %q", tt.folderName, got.name, tt.wantBrand)
 			}
 		}
 	}
@@ -111,6 +123,12 @@ func TestIsRawFile(t *testing.T) {
 	}{
 		{"P4061482.ORF", true},
 		{"IMG_0001.CR3", true},
+		{"DSC00001.ARW", true},
+		{"DSC_0001.NEF", true},
+		{"DSCF0001.RAF", true},
+		{"P1000001.RW2", true},
+		{"IMGP0001.PEF", true},
+		{"IMGP0001.dng", true},
 		{"IMG_0001.JPG", false},
 		{"test.txt", false},
 		{"ORF.JPG", false},
@@ -165,12 +183,15 @@ func buildTestExifTIFF() []byte {
 	return buf
 }
 
+// testExifRaw is the Raw part of the metadata in buildTestExifTIFF.
+var testExifRaw = exifRaw{ExposureTime: 0.004, FNumber: 5.6, ISO: 400, FocalLength: 50}
+
 func TestParseExifTIFF(t *testing.T) {
 	meta, err := parseExifTIFF(buildTestExifTIFF())
 	if err != nil {
 		t.Fatalf("parseExifTIFF() error = %v", err)
 	}
-	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm"}
+	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm", Raw: testExifRaw}
 	if meta != want {
 		t.Errorf("parseExifTIFF() = %+v, want %+v", meta, want)
 	}
@@ -194,7 +215,7 @@ func TestExtractPhotoMetadataFromJPEG(t *testing.T) {
 	if err != nil {
 		t.Fatalf("extractPhotoMetadata() error = %v", err)
 	}
-	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm"}
+	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm", Raw: testExifRaw}
 	if meta != want {
 		t.Errorf("extractPhotoMetadata() = %+v, want %+v", meta, want)
 	}
@@ -283,3 +304,442 @@ func TestFormatShutterSpeed(t *testing.T) {
 		}
 	}
 }
+
+// testIFDEntry is one entry for buildTIFF. Values longer than four bytes are
+// placed out of line automatically.
+type testIFDEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// asciiEntry returns a NUL-terminated ASCII entry.
+func asciiEntry(tag uint16, s string) testIFDEntry {
+	return testIFDEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// buildTIFF constructs a little-endian TIFF whose IFD0 holds ifd0 and, when
+// exif is non-empty, an Exif SubIFD pointer to a second IFD holding exif; the
+// same for gps and a GPS IFD.
+func buildTIFF(ifd0, exif []testIFDEntry, gps ...testIFDEntry) []byte {
+	le := binary.LittleEndian
+	buf := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, testIFDEntry{tag: 0x8769, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, testIFDEntry{tag: 0x8825, typ: 4, count: 1, value: make([]byte, 4)})
+	}
+	writeIFD := func(entries []testIFDEntry) (pointerPos map[uint16]int) {
+		pointerPos = map[uint16]int{}
+		start := len(buf)
+		dataOff := start + 2 + len(entries)*12 + 4
+		var extra []byte
+		ifd := make([]byte, 2+len(entries)*12+4)
+		le.PutUint16(ifd, uint16(len(entries)))
+		for i, en := range entries {
+			e := 2 + i*12
+			le.PutUint16(ifd[e:], en.tag)
+			le.PutUint16(ifd[e+2:], en.typ)
+			le.PutUint32(ifd[e+4:], en.count)
+			if len(en.value) <= 4 {
+				copy(ifd[e+8:], en.value)
+				pointerPos[en.tag] = start + e + 8
+			} else {
+				le.PutUint32(ifd[e+8:], uint32(dataOff+len(extra)))
+				extra = append(extra, en.value...)
+			}
+		}
+		buf = append(buf, ifd...)
+		buf = append(buf, extra...)
+		return pointerPos
+	}
+	pos := writeIFD(ifd0)
+	if len(exif) > 0 {
+		le.PutUint32(buf[pos[0x8769]:], uint32(len(buf)))
+		writeIFD(exif)
+	}
+	if len(gps) > 0 {
+		le.PutUint32(buf[pos[0x8825]:], uint32(len(buf)))
+		writeIFD(gps)
+	}
+	return buf
+}
+
+// shortEntry returns an inline SHORT entry.
+func shortEntry(tag, val uint16) testIFDEntry {
+	return testIFDEntry{tag: tag, typ: 3, count: 1, value: binary.LittleEndian.AppendUint16(nil, val)}
+}
+
+// rationalEntry returns a RATIONAL (or SRATIONAL) entry of num/den pairs.
+func rationalEntry(tag, typ uint16, pairs ...int32) testIFDEntry {
+	var b []byte
+	for _, v := range pairs {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	return testIFDEntry{tag: tag, typ: typ, count: uint32(len(pairs) / 2), value: b}
+}
+
+func TestParseExifTIFFFull(t *testing.T) {
+	tiff := buildTIFF(
+		[]testIFDEntry{asciiEntry(0x010F, "Canon"), asciiEntry(0x0110, "Canon EOS R6"), shortEntry(0x0112, 6)},
+		[]testIFDEntry{
+			rationalEntry(0x829A, 5, 1, 250),
+			rationalEntry(0x9204, 10, -2, 3),
+			shortEntry(0x8822, 3),
+			shortEntry(0x9207, 5),
+			shortEntry(0x9209, 16),
+			shortEntry(0xA403, 0),
+			shortEntry(0xA405, 75),
+			asciiEntry(0xA431, "012345678901"),
+			asciiEntry(0xA434, "RF24-105mm F4 L IS USM"),
+			asciiEntry(0x9003, "2025:11:01 14:30:45"),
+			asciiEntry(0x9291, "12"),
+			asciiEntry(0x9011, "+09:00"),
+		},
+		asciiEntry(0x0001, "S"),
+		rationalEntry(0x0002, 5, 33, 1, 51, 1, 54, 1),
+		asciiEntry(0x0003, "E"),
+		rationalEntry(0x0004, 5, 151, 1, 12, 1, 36, 1),
+		testIFDEntry{tag: 0x0005, typ: 1, count: 1, value: []byte{1}},
+		rationalEntry(0x0006, 5, 25, 2),
+	)
+	meta, err := parseExifTIFF(tiff)
+	if err != nil {
+		t.Fatalf("parseExifTIFF() error = %v", err)
+	}
+
+	for field, got := range map[string][2]string{
+		"make":                  {meta.Make, "Canon"},
+		"model":                 {meta.Model, "Canon EOS R6"},
+		"serial_number":         {meta.SerialNumber, "012345678901"},
+		"lens_model":            {meta.LensModel, "RF24-105mm F4 L IS USM"},
+		"orientation":           {meta.Orientation, "Rotate 90 CW"},
+		"shutter_speed":         {meta.ShutterSpeed, "1/250s"},
+		"exposure_compensation": {meta.ExposureCompensation, "-0.7 EV"},
+		"exposure_program":      {meta.ExposureProgram, "Aperture-priority AE"},
+		"metering_mode":         {meta.MeteringMode, "Multi-segment"},
+		"flash":                 {meta.Flash, "Did not fire"},
+		"white_balance":         {meta.WhiteBalance, "Auto"},
+		"capture_time":          {meta.CaptureTime, "2025-11-01T14:30:45.12+09:00"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s = %q, want %q", field, got[0], got[1])
+		}
+	}
+	if meta.Raw.Orientation == nil || *meta.Raw.Orientation != 6 || meta.Raw.Flash == nil || *meta.Raw.Flash != 16 ||
+		meta.Raw.WhiteBalance == nil || *meta.Raw.WhiteBalance != 0 || meta.Raw.FocalLength35mm != 75 {
+		t.Errorf("raw values = %+v, want orientation 6, flash 16, white balance 0, 75mm equivalent", meta.Raw)
+	}
+	if meta.Raw.ExposureBias == nil || *meta.Raw.ExposureBias > -0.66 || *meta.Raw.ExposureBias < -0.67 {
+		t.Errorf("raw exposure bias = %v, want -2/3", meta.Raw.ExposureBias)
+	}
+
+	gps := meta.GPS
+	if gps == nil {
+		t.Fatal("GPS = nil, want a position")
+	}
+	if gps.Latitude > -33.865 || gps.Latitude < -33.866 || gps.Longitude < 151.209 || gps.Longitude > 151.211 {
+		t.Errorf("GPS = %.6f, %.6f, want -33.865, 151.21", gps.Latitude, gps.Longitude)
+	}
+	if gps.Altitude == nil || *gps.Altitude != -12.5 {
+		t.Errorf("GPS altitude = %v, want -12.5 (below sea level)", gps.Altitude)
+	}
+	if gps.Display != "33.865000° S, 151.210000° E" {
+		t.Errorf("GPS display = %q", gps.Display)
+	}
+}
+
+func TestPhotoMetadataCaptureTime(t *testing.T) {
+	tiff := buildTIFF(nil, []testIFDEntry{
+		asciiEntry(0x9003, "2025:11:01 23:30:15"),
+		asciiEntry(0x9011, "+09:00"),
+	})
+	meta, err := parseExifTIFF(tiff)
+	if err != nil {
+		t.Fatalf("parseExifTIFF() error = %v", err)
+	}
+	got, ok := meta.captureTime()
+	if !ok {
+		t.Fatal("captureTime() ok = false, want true")
+	}
+	want := time.Date(2025, 11, 1, 14, 30, 15, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("captureTime() = %v, want %v", got, want)
+	}
+	// The calendar day is the camera's, not the server's.
+	if day := got.Format("2006-01-02"); day != "2025-11-01" {
+		t.Errorf("capture day = %q, want 2025-11-01", day)
+	}
+
+	if _, ok := (photoMetadata{}).captureTime(); ok {
+		t.Error("captureTime() without DateTimeOriginal ok = true, want false")
+	}
+}
+
+func TestFileCaptureTime(t *testing.T) {
+	dir := t.TempDir()
+	tiff := buildTIFF(nil, []testIFDEntry{asciiEntry(0x9003, "2024:06:15 08:00:00")})
+	payloadLen := 2 + 6 + len(tiff)
+	jpg := []byte{0xFF, 0xD8, 0xFF, 0xE1, byte(payloadLen >> 8), byte(payloadLen)}
+	jpg = append(jpg, []byte("Exif\x00\x00")...)
+	jpg = append(jpg, tiff...)
+	jpg = append(jpg, 0xFF, 0xD9)
+
+	withExif := filepath.Join(dir, "IMG_0001.JPG")
+	noExif := filepath.Join(dir, "MVI_0002.MP4")
+	for path, content := range map[string][]byte{withExif: jpg, noExif: []byte("video")} {
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2030, 1, 2, 12, 0, 0, 0, time.Local)
+	for _, path := range []string{withExif, noExif} {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, _ := os.Stat(withExif)
+	if got, source := fileCaptureTime(withExif, info); source != captureSourceExif || got.Format("2006-01-02") != "2024-06-15" {
+		t.Errorf("fileCaptureTime(jpeg) = (%v, %q), want 2024-06-15 from exif", got, source)
+	}
+	info, _ = os.Stat(noExif)
+	if got, source := fileCaptureTime(noExif, info); source != captureSourceMtime || !got.Equal(mtime) {
+		t.Errorf("fileCaptureTime(mp4) = (%v, %q), want %v from mtime", got, source, mtime)
+	}
+}
+
+func TestDateRangeContains(t *testing.T) {
+	r, err := parseDateRange("2025-11-01", "2025-11-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day, want := range map[string]bool{
+		"2025-10-31": false,
+		"2025-11-01": true,
+		"2025-11-03": true,
+		"2025-11-04": false,
+	} {
+		if got := r.contains(day); got != want {
+			t.Errorf("contains(%q) = %v, want %v", day, got, want)
+		}
+	}
+	if open := (dateRange{}); open.active() || !open.contains("1999-01-01") {
+		t.Error("empty dateRange should be inactive and contain every day")
+	}
+	if _, err := parseDateRange("11/01/2025", ""); err == nil {
+		t.Error("parseDateRange() accepted a non YYYY-MM-DD date")
+	}
+}
+
+// Sentinel values patched by buildRawTIFF once the layout is known.
+const (
+	jpegOffsetValue = 0xFFFFFFF0 + iota
+	jpegLengthValue
+	subIFDValue
+)
+
+// testJPEG returns a fake JPEG of n bytes: SOI, filler, EOI.
+func testJPEG(n int) []byte {
+	j := make([]byte, n)
+	j[0], j[1], j[n-2], j[n-1] = 0xFF, 0xD8, 0xFF, 0xD9
+	return j
+}
+
+// buildRawTIFF lays out a TIFF-based RAW as header | IFD0 | IFD1 | SubIFD |
+// JPEGs. Entries are LONG/SHORT with inline values; the sentinels above are
+// replaced with the offset/length of the JPEG for that IFD (ifd0JPEG for IFD0
+// and IFD1, subJPEG for the SubIFD) or with the SubIFD's offset.
+func buildRawTIFF(magic uint16, ifd0, ifd1, sub []testIFDEntry, ifd0JPEG, subJPEG []byte) []byte {
+	le := binary.LittleEndian
+	ifdSize := func(entries []testIFDEntry) int { return 2 + len(entries)*12 + 4 }
+	ifd0Off := 8
+	ifd1Off := ifd0Off + ifdSize(ifd0)
+	subOff := ifd1Off + ifdSize(ifd1)
+	jpeg0Off := subOff + ifdSize(sub)
+	subJPEGOff := jpeg0Off + len(ifd0JPEG)
+
+	buf := make([]byte, subJPEGOff+len(subJPEG))
+	copy(buf, "II")
+	le.PutUint16(buf[2:], magic)
+	le.PutUint32(buf[4:], uint32(ifd0Off))
+	write := func(off int, entries []testIFDEntry, jpegOff int, jpeg []byte, next int) {
+		le.PutUint16(buf[off:], uint16(len(entries)))
+		for i, en := range entries {
+			e := off + 2 + i*12
+			le.PutUint16(buf[e:], en.tag)
+			le.PutUint16(buf[e+2:], en.typ)
+			le.PutUint32(buf[e+4:], en.count)
+			val := le.Uint32(en.value)
+			switch val {
+			case jpegOffsetValue:
+				val = uint32(jpegOff)
+			case jpegLengthValue:
+				val = uint32(len(jpeg))
+			case subIFDValue:
+				val = uint32(subOff)
+			}
+			if en.typ == 7 && en.count == jpegLengthValue { // UNDEFINED blob: count is the length
+				le.PutUint32(buf[e+4:], uint32(len(jpeg)))
+			}
+			le.PutUint32(buf[e+8:], val)
+		}
+		le.PutUint32(buf[off+2+len(entries)*12:], uint32(next))
+	}
+	next := 0
+	if len(ifd1) > 0 {
+		next = ifd1Off
+	}
+	write(ifd0Off, ifd0, jpeg0Off, ifd0JPEG, next)
+	if len(ifd1) > 0 {
+		write(ifd1Off, ifd1, jpeg0Off, ifd0JPEG, 0)
+	}
+	if len(sub) > 0 {
+		write(subOff, sub, subJPEGOff, subJPEG, 0)
+	}
+	copy(buf[jpeg0Off:], ifd0JPEG)
+	copy(buf[subJPEGOff:], subJPEG)
+	return buf
+}
+
+func longEntry(tag uint16, val uint32) testIFDEntry {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, val)
+	return testIFDEntry{tag: tag, typ: 4, count: 1, value: v}
+}
+
+func TestExtractEmbeddedJPEGContainers(t *testing.T) {
+	thumb := testJPEG(64)
+	preview := testJPEG(512)
+	jpegPointers := []testIFDEntry{longEntry(0x0201, jpegOffsetValue), longEntry(0x0202, jpegLengthValue)}
+	jpegStrip := []testIFDEntry{longEntry(0x0103, 7), longEntry(0x0111, jpegOffsetValue), longEntry(0x0117, jpegLengthValue)}
+
+	tests := []struct {
+		name string
+		file []byte
+		want []byte
+	}{
+		// ARW and PEF point at the preview straight from IFD0.
+		{"ARW/PEF IFD0 preview", buildRawTIFF(42, jpegPointers, nil, nil, preview, nil), preview},
+		// ORF uses its own magic and keeps the preview in IFD1.
+		{"ORF IFD1 preview", buildRawTIFF(0x4F52, []testIFDEntry{longEntry(0x0100, 1)}, jpegPointers, nil, preview, nil), preview},
+		// NEF has a small IFD1 thumbnail and the full preview in a SubIFD.
+		{"NEF SubIFD preview", buildRawTIFF(42, []testIFDEntry{longEntry(0x014A, subIFDValue)}, jpegPointers, jpegPointers, thumb, preview), preview},
+		// DNG stores its preview as a single JPEG-compressed strip in a SubIFD.
+		{"DNG JPEG strip", buildRawTIFF(42, []testIFDEntry{longEntry(0x014A, subIFDValue)}, nil, jpegStrip, nil, preview), preview},
+		// RW2 has magic 0x55 and a JpgFromRaw blob in IFD0.
+		{"RW2 JpgFromRaw", buildRawTIFF(0x55, []testIFDEntry{{tag: 0x002E, typ: 7, count: jpegLengthValue, value: []byte{0xF0, 0xFF, 0xFF, 0xFF}}}, nil, nil, preview, nil), preview},
+	}
+
+	raf := make([]byte, 100)
+	copy(raf, "FUJIFILMCCD-RAW 0201FF383501")
+	binary.BigEndian.PutUint32(raf[84:], 100)
+	binary.BigEndian.PutUint32(raf[88:], uint32(len(preview)))
+	raf = append(raf, preview...)
+	raf = append(raf, make([]byte, 256)...) // sensor data after the preview
+	tests = append(tests, struct {
+		name string
+		file []byte
+		want []byte
+	}{"RAF header preview", raf, preview})
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "raw")
+		if err := os.WriteFile(path, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := extractEmbeddedJPEG(path)
+		if err != nil {
+			t.Errorf("%s: extractEmbeddedJPEG() error = %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: extractEmbeddedJPEG() returned %d bytes, want the %d-byte preview", tt.name, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestExtractPhotoMetadataContainers(t *testing.T) {
+	want := photoMetadata{ShutterSpeed: "1/250s", Aperture: "f/5.6", ISO: "ISO 400", FocalLength: "50mm", Raw: testExifRaw}
+
+	// RAF: EXIF lives in the APP1 segment of the preview JPEG.
+	jpg := testExifJPEG(buildTestExifTIFF())
+	raf := make([]byte, 100)
+	copy(raf, "FUJIFILMCCD-RAW 0201FF383501")
+	binary.BigEndian.PutUint32(raf[84:], 100)
+	binary.BigEndian.PutUint32(raf[88:], uint32(len(jpg)))
+	raf = append(raf, jpg...)
+
+	// RW2: Panasonic's magic number, an IFD0 with the make and model but no
+	// Exif IFD, and the rest of the EXIF in the APP1 segment of the
+	// JpgFromRaw preview.
+	rw2 := buildTIFF([]testIFDEntry{
+		asciiEntry(0x010F, "Panasonic"),
+		asciiEntry(0x0110, "DC-G9"),
+		{tag: 0x002E, typ: 7, count: uint32(len(jpg)), value: jpg},
+	}, nil)
+	binary.LittleEndian.PutUint16(rw2[2:], 0x55)
+	wantRW2 := want
+	wantRW2.Make, wantRW2.Model = "Panasonic", "DC-G9"
+
+	for name, tt := range map[string]struct {
+		file []byte
+		want photoMetadata
+	}{"P1000001.RW2": {rw2, wantRW2}, "DSCF0001.RAF": {raf, want}} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := extractPhotoMetadata(path)
+		if err != nil {
+			t.Errorf("%s: extractPhotoMetadata() error = %v", name, err)
+			continue
+		}
+		if meta != tt.want {
+			t.Errorf("%s: extractPhotoMetadata() = %+v, want %+v", name, meta, tt.want)
+		}
+	}
+}
+
+// testExifJPEG wraps a TIFF structure in the APP1 segment of a minimal JPEG.
+func testExifJPEG(tiff []byte) []byte {
+	payloadLen := 2 + 6 + len(tiff)
+	jpg := []byte{0xFF, 0xD8, 0xFF, 0xE1, byte(payloadLen >> 8), byte(payloadLen)}
+	jpg = append(jpg, []byte("Exif\x00\x00")...)
+	jpg = append(jpg, tiff...)
+	return append(jpg, 0xFF, 0xD9)
+}
+
+func TestTIFFReaderBoundedReads(t *testing.T) {
+	preview := testJPEG(512)
+	jpegPointers := []testIFDEntry{longEntry(0x0201, jpegOffsetValue), longEntry(0x0202, jpegLengthValue)}
+	file := buildRawTIFF(0x4F52, []testIFDEntry{longEntry(0x0100, 1)}, jpegPointers, nil, preview, nil)
+	file = append(file, make([]byte, 8<<20)...) // sensor data
+
+	r := &countingReaderAt{r: bytes.NewReader(file)}
+	tr, err := newTIFFReader(r, int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, err := tiffExtractJPEG(tr)
+	if err != nil || rg.n != int64(len(preview)) {
+		t.Fatalf("tiffExtractJPEG() = %+v (err %v), want the %d-byte preview", rg, err, len(preview))
+	}
+	if r.n > 1024 {
+		t.Errorf("tiffExtractJPEG() read %d bytes, want only the IFDs", r.n)
+	}
+
+	// An IFD claiming 65535 entries, and a SubIFD array pointing past the end
+	// of the data, are rejected without large allocations.
+	le := binary.LittleEndian
+	bogus := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0xFF, 0xFF}
+	if _, err := tiffExtractJPEG(&tiffReader{r: bytes.NewReader(bogus), size: int64(len(bogus)), bo: le, ifd0: 8}); err == nil {
+		t.Error("tiffExtractJPEG() found a JPEG in an IFD with 65535 entries")
+	}
+	sub := buildTIFF([]testIFDEntry{{tag: 0x014A, typ: 4, count: 1 << 30, value: []byte{0xF0, 0xFF, 0xFF, 0x7F}}}, nil)
+	tr, _ = newTIFFReader(bytes.NewReader(sub), int64(len(sub)))
+	if _, err := tiffExtractJPEG(tr); err == nil {
+		t.Error("tiffExtractJPEG() found a JPEG through a bogus SubIFD array")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// importManifestFile records, for every file copied into a session directory,
+// where it came from and the SHA-256 it was verified against.
+const importManifestFile = ".import-manifest.json"
+
+// Manifest entry kinds.
+const (
+	manifestKindImport    = "import"
+	manifestKindRawExport = "raw_export"
+)
+
+// manifestEntry describes one verified copy in a session directory.
+type manifestEntry struct {
+	File        string    `json:"file"`   // relative to the session directory, e.g. 100_IMG_0001.JPG or selected/raw/100_IMG_0001.CR3
+	Source      string    `json:"source"` // relative to the card mount point, e.g. DCIM/100CANON/IMG_0001.JPG
+	DCIMFolder  string    `json:"dcim_folder"`
+	Size        int64     `json:"size"`
+	CaptureTime time.Time `json:"capture_time"`
+	SHA256      string    `json:"sha256"`
+	Kind        string    `json:"kind"`
+	Copied      time.Time `json:"copied"`
+}
+
+type importManifest struct {
+	Entries []manifestEntry `json:"entries"`
+}
+
+// manifestLocks serializes read-modify-write cycles on a session's manifest;
+// an import job and a raw export can update the same session concurrently.
+var manifestLocks sync.Map
+
+func lockManifest(directory string) func() {
+	lockAny, _ := manifestLocks.LoadOrStore(directory, &sync.Mutex{})
+	lock := lockAny.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// loadManifest reads the manifest of a session directory. A session without a
+// manifest (imported before manifests existed) yields an empty one.
+func loadManifest(directory string) (importManifest, error) {
+	var m importManifest
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return m, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, importManifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// recordManifestEntries merges entries into a session's manifest, replacing
+// any existing entry for the same file.
+func recordManifestEntries(directory string, entries []manifestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	defer lockManifest(directory)()
+
+	m, err := loadManifest(directory)
+	if err != nil {
+		return err
+	}
+	byFile := make(map[string]manifestEntry, len(m.Entries)+len(entries))
+	for _, e := range m.Entries {
+		byFile[e.File] = e
+	}
+	for _, e := range entries {
+		byFile[e.File] = e
+	}
+	m.Entries = m.Entries[:0]
+	for _, e := range byFile {
+		m.Entries = append(m.Entries, e)
+	}
+	return saveManifest(directory, m)
+}
+
+// renameManifestEntries updates the manifest after files in a session were
+// moved: renames maps old to new paths, both relative to the session
+// directory. The entries keep their source and checksum, so a moved copy
+// still counts as imported.
+func renameManifestEntries(directory string, renames map[string]string) error {
+	if len(renames) == 0 {
+		return nil
+	}
+	defer lockManifest(directory)()
+
+	m, err := loadManifest(directory)
+	if err != nil {
+		return err
+	}
+	// A moved entry replaces whatever entry its new path had.
+	byFile := make(map[string]manifestEntry, len(m.Entries))
+	var moved []manifestEntry
+	for _, e := range m.Entries {
+		if to, ok := renames[e.File]; ok {
+			e.File = to
+			moved = append(moved, e)
+		} else {
+			byFile[e.File] = e
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for _, e := range moved {
+		byFile[e.File] = e
+	}
+	m.Entries = m.Entries[:0]
+	for _, e := range byFile {
+		m.Entries = append(m.Entries, e)
+	}
+	return saveManifest(directory, m)
+}
+
+// saveManifest writes a session's manifest, sorted by file. The caller holds
+// the session's manifest lock.
+func saveManifest(directory string, m importManifest) error {
+	sort.Slice(m.Entries, func(a, b int) bool { return m.Entries[a].File < m.Entries[b].File })
+
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, importManifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, importManifestFile))
+}
+
+// verifyError reports a copy whose destination does not hash to the same
+// value as the bytes read from the source.
+type verifyError struct {
+	src, dst  string
+	want, got string
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("checksum mismatch copying %s to %s: source %s, copy %s", e.src, e.dst, e.want, e.got)
+}
+
+// hashFile returns the size and hex SHA-256 of the file at path.
+func hashFile(ctx context.Context, path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	return hashOpenFile(ctx, f)
+}
+
+// hashFileUncached is hashFile reading from the device rather than the page
+// cache where the platform allows it (see openUncached).
+func hashFileUncached(ctx context.Context, path string) (int64, string, error) {
+	f, err := openUncached(path)
+	if err != nil {
+		return 0, "", err
+	}
+	return hashOpenFile(ctx, f)
+}
+
+func hashOpenFile(ctx context.Context, f *os.File) (int64, string, error) {
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, contextReader{ctx: ctx, r: f})
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFileVerified copies a single file from src to dst, then checks the copy
+// with verifyCopy. Both handles are closed before it returns, so a copy loop
+// keeps at most one source/destination descriptor open at a time. The copy is
+// written to a hidden temp file and only renamed into place once verified, so
+// dst is never left truncated or corrupt; on a mismatch the copy is discarded
+// and a *verifyError is returned. Returns the size and SHA-256 of the copy.
+func copyFileVerified(ctx context.Context, src, dst string) (int64, string, error) {
+	source, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer source.Close()
+
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".part")
+	destination, err := os.Create(tmp)
+	if err != nil {
+		return 0, "", err
+	}
+	size, err := io.Copy(destination, contextReader{ctx: ctx, r: source})
+	if err == nil {
+		// Synced pages are clean, so verifyCopy can drop them and read the
+		// copy back from the disk.
+		err = destination.Sync()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, "", err
+	}
+
+	sum, err := verifyCopy(ctx, src, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		if v, ok := err.(*verifyError); ok {
+			v.dst = dst
+		}
+		return 0, "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return 0, "", err
+	}
+	return size, sum, nil
+}
+
+// verifyCopy reads src and its copy dst again, each in a pass of its own and
+// bypassing the page cache where possible, and returns their SHA-256 if they
+// match or a *verifyError if they don't. Hashing the bytes as they are copied
+// would not do: a flaky card reader that returns bad bytes once has them
+// written and hashed alike.
+func verifyCopy(ctx context.Context, src, dst string) (string, error) {
+	_, want, err := hashFileUncached(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	_, got, err := hashFileUncached(ctx, dst)
+	if err != nil {
+		return "", err
+	}
+	if got != want {
+		return "", &verifyError{src: src, dst: dst, want: want, got: got}
+	}
+	return want, nil
+}
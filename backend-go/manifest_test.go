@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileVerified(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "IMG_0001.CR3")
+	dst := filepath.Join(dir, "copy.CR3")
+	content := []byte("raw sensor bytes")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, sum, err := copyFileVerified(context.Background(), src, dst)
+	if err != nil {
+		t.Fatalf("copyFileVerified() error = %v", err)
+	}
+	want := sha256.Sum256(content)
+	if size != int64(len(content)) || sum != hex.EncodeToString(want[:]) {
+		t.Errorf("copyFileVerified() = (%d, %s), want (%d, %x)", size, sum, len(content), want)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != string(content) {
+		t.Errorf("copy content = %q, want %q", got, content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".copy.CR3.part")); !os.IsNotExist(err) {
+		t.Error("temporary .part file was left behind")
+	}
+}
+
+func TestVerifyCopyRereadsSource(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "IMG_0001.CR3")
+	dst := filepath.Join(dir, ".copy.CR3.part")
+	os.WriteFile(src, []byte("raw sensor bytes"), 0644)
+	// The card reader returned one bad byte during the copy: the copy and a
+	// hash taken while copying agree, but a fresh read of the card doesn't.
+	os.WriteFile(dst, []byte("raw sensor bytez"), 0644)
+
+	var v *verifyError
+	if _, err := verifyCopy(context.Background(), src, dst); !errors.As(err, &v) {
+		t.Errorf("verifyCopy() error = %v, want a *verifyError", err)
+	}
+}
+
+func TestResumedManifestEntryRejectsSameSizeCorruption(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "card.JPG")
+	dst := filepath.Join(dir, "library.JPG")
+	os.WriteFile(src, []byte("good-bytes"), 0644)
+	os.WriteFile(dst, []byte("bad!-bytes"), 0644)
+
+	item := importJobFile{Src: "DCIM/100CANON/IMG_0001.JPG", DestName: "100_IMG_0001.JPG", Size: 10}
+	_, err := resumedManifestEntry(context.Background(), item, src, dst, nil)
+	var vErr *verifyError
+	if !errors.As(err, &vErr) {
+		t.Fatalf("resumedManifestEntry() error = %v, want *verifyError", err)
+	}
+
+	os.WriteFile(dst, []byte("good-bytes"), 0644)
+	entry, err := resumedManifestEntry(context.Background(), item, src, dst, nil)
+	if err != nil {
+		t.Fatalf("resumedManifestEntry() error = %v", err)
+	}
+	if entry.DCIMFolder != "100CANON" || entry.Source != item.Src || entry.Kind != manifestKindImport {
+		t.Errorf("entry = %+v, want source %s in 100CANON", entry, item.Src)
+	}
+}
+
+func TestRecordManifestEntriesMerges(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+
+	first := []manifestEntry{{File: "100_IMG_0001.JPG", SHA256: "a"}, {File: "100_IMG_0002.JPG", SHA256: "b"}}
+	if err := recordManifestEntries("batch", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordManifestEntries("batch", []manifestEntry{{File: "100_IMG_0002.JPG", SHA256: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest("batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 2 || m.Entries[0].SHA256 != "a" || m.Entries[1].SHA256 != "c" {
+		t.Errorf("manifest entries = %+v, want IMG_0001=a and IMG_0002=c", m.Entries)
+	}
+}
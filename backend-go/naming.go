@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nameFields are the values a filename template can use:
+//
+//	{original}        card file name without extension, e.g. IMG_0001
+//	{ext}             extension with its dot, e.g. .JPG
+//	{dcim}            DCIM folder number, e.g. 100
+//	{date[:layout]}   capture time as a Go time layout, default 2006-01-02
+//	{time[:layout]}   capture time, default 150405
+//	{camera}          camera model from EXIF
+//	{serial}          camera body serial number from EXIF
+//	{seq[:width]}     sequence number, zero-padded to width (default 4)
+//
+// plus template-specific tokens in extra, e.g. {preset} for export presets.
+type nameFields struct {
+	original string
+	ext      string
+	dcim     string
+	taken    time.Time
+	camera   string
+	serial   string
+	seq      int
+	extra    map[string]string
+}
+
+var templateToken = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*))?\}`)
+
+// sampleNameFields are used to check a template when the config is loaded.
+var sampleNameFields = nameFields{
+	original: "IMG_0001",
+	ext:      ".JPG",
+	dcim:     "100",
+	taken:    time.Date(2025, 11, 1, 14, 30, 45, 0, time.UTC),
+	camera:   "Canon EOS R6",
+	serial:   "012345678901",
+	seq:      1,
+}
+
+// templateUsesMetadata reports whether expanding template needs the camera
+// model or serial number, which means reading the photo's EXIF.
+func templateUsesMetadata(template string) bool {
+	return strings.Contains(template, "{camera") || strings.Contains(template, "{serial")
+}
+
+// expandFilenameTemplate fills in the tokens of template. The result must be
+// a plain file name; values are cleaned of path separators, but a layout or
+// literal text that produces one is an error.
+func expandFilenameTemplate(template string, f nameFields) (string, error) {
+	var err error
+	name := templateToken.ReplaceAllStringFunc(template, func(token string) string {
+		m := templateToken.FindStringSubmatch(token)
+		key, arg := m[1], m[2]
+		switch key {
+		case "original":
+			return f.original
+		case "ext":
+			return f.ext
+		case "dcim":
+			return f.dcim
+		case "date", "time":
+			if arg == "" {
+				arg = map[string]string{"date": "2006-01-02", "time": "150405"}[key]
+			}
+			return f.taken.Format(arg)
+		case "camera":
+			return cleanNameValue(f.camera)
+		case "serial":
+			return cleanNameValue(f.serial)
+		case "seq":
+			width := 4
+			if arg != "" {
+				n, convErr := strconv.Atoi(arg)
+				if convErr != nil || n < 1 || n > 9 {
+					err = fmt.Errorf("%s: width must be 1 to 9", token)
+					return token
+				}
+				width = n
+			}
+			return fmt.Sprintf("%0*d", width, f.seq)
+		}
+		if v, ok := f.extra[key]; ok {
+			return v
+		}
+		err = fmt.Errorf("unknown token %s", token)
+		return token
+	})
+	if err != nil {
+		return "", err
+	}
+	if !validDirName(name) || strings.ContainsAny(name, "{}") {
+		return "", fmt.Errorf("%q does not give a plain file name", template)
+	}
+	return name, nil
+}
+
+// cleanNameValue makes an EXIF string usable in a file name: spaces and path
+// separators become underscores, and a missing value reads "unknown".
+func cleanNameValue(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '\\', ':':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// validateImportTemplate checks the import filename template of a config
+// file. It must end in {ext}, so a RAW and a JPEG of the same shot can share
+// the rest of the name.
+func validateImportTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.HasSuffix(template, "{ext}") {
+		return fmt.Errorf("import_filename_template must end with {ext}")
+	}
+	if _, err := expandFilenameTemplate(template, sampleNameFields); err != nil {
+		return fmt.Errorf("import_filename_template: %w", err)
+	}
+	return nil
+}
+
+// legacyImportName is how files are named without an import template:
+// <dcim>_<original>, e.g. 100_IMG_0001.JPG.
+func legacyImportName(cameraDir, fileName string) string {
+	if prefix := getDCIMPrefix(cameraDir); prefix != "" {
+		return prefix + "_" + fileName
+	}
+	return fileName
+}
+
+// importNamer names the files of one import. Files of the same shot (same
+// DCIM folder and card name, any extension) get the same base name, also
+// across imports into the same session, so a RAW always sits next to its
+// JPEG. A base name taken by another shot gets a _2, _3, ... suffix.
+type importNamer struct {
+	template string
+	shots    map[string]string        // shotKey -> base name, for shots named by this import
+	earlier  map[string][]earlierShot // shotKey -> shots the session held before
+	taken    map[string]bool          // upper-cased base names in use
+	seq      int
+}
+
+// earlierShot is a shot imported into the session before, with one of its
+// files to compare capture times with.
+type earlierShot struct {
+	base string
+	path string
+}
+
+// shotKey identifies a shot by DCIM folder number and card name without
+// extension.
+func shotKey(dcim, original string) string {
+	return dcim + "/" + strings.ToUpper(original)
+}
+
+// newImportNamer prepares naming files into the session directory, which may
+// not exist yet. The shots it already holds are found in its import manifest,
+// or for files imported before manifests existed, by their legacy name.
+func newImportNamer(template, directory string) *importNamer {
+	n := &importNamer{template: template, shots: map[string]string{}, earlier: map[string][]earlierShot{}, taken: map[string]bool{}}
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return n
+	}
+	m, _ := loadManifest(directory)
+	keys := make(map[string]string) // session file -> shotKey, from the manifest
+	for _, e := range m.Entries {
+		if e.Kind == manifestKindImport && e.Source != "" {
+			keys[e.File] = shotKey(getDCIMPrefix(filepath.Base(filepath.Dir(e.Source))), companionStem(filepath.Base(e.Source)))
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !isPrimaryFile(name) {
+			continue
+		}
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if n.taken[strings.ToUpper(base)] {
+			continue // another file of a shot already seen
+		}
+		n.taken[strings.ToUpper(base)] = true
+		key, ok := keys[name]
+		if !ok {
+			key = shotKey(splitPrefixedFilename(base))
+		}
+		n.earlier[key] = append(n.earlier[key], earlierShot{base: base, path: filepath.Join(dir, name)})
+	}
+	// {seq} continues after the shots already in the session.
+	n.seq = len(n.taken)
+	return n
+}
+
+// sameCapture reports whether two files were taken at the same moment. Files
+// without an EXIF capture time are assumed to match.
+func sameCapture(path, cardPath string, cardInfo os.FileInfo) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	a, sourceA := fileCaptureTime(path, info)
+	b, sourceB := fileCaptureTime(cardPath, cardInfo)
+	return sourceA != captureSourceExif || sourceB != captureSourceExif || a.Equal(b)
+}
+
+// name returns the session file name for the card file at sourcePath in the
+// DCIM folder cameraDir. A shot already in the session keeps its name unless
+// its capture time differs, as after a camera's counter rolled over or with a
+// second body using the same numbering; then it is named like a new shot.
+// The file's EXIF is only read when needed.
+func (n *importNamer) name(cameraDir, sourcePath string, info os.FileInfo) string {
+	fileName := info.Name()
+	ext := filepath.Ext(fileName)
+	original := strings.TrimSuffix(fileName, ext)
+	dcim := getDCIMPrefix(cameraDir)
+	key := shotKey(dcim, original)
+	if base, ok := n.shots[key]; ok {
+		return base + ext
+	}
+	for _, e := range n.earlier[key] {
+		if sameCapture(e.path, sourcePath, info) {
+			n.shots[key] = e.base
+			return e.base + ext
+		}
+	}
+
+	n.seq++
+	base := strings.TrimSuffix(legacyImportName(cameraDir, fileName), ext)
+	if n.template != "" {
+		f := nameFields{original: original, dcim: dcim, seq: n.seq}
+		if strings.Contains(n.template, "{date") || strings.Contains(n.template, "{time") {
+			f.taken, _ = fileCaptureTime(sourcePath, info)
+		}
+		if templateUsesMetadata(n.template) {
+			if meta, err := extractPhotoMetadata(sourcePath); err == nil {
+				f.camera, f.serial = meta.Model, meta.SerialNumber
+			}
+		}
+		if expanded, err := expandFilenameTemplate(strings.TrimSuffix(n.template, "{ext}"), f); err == nil {
+			base = expanded
+		}
+	}
+	unique := base
+	for i := 2; n.taken[strings.ToUpper(unique)]; i++ {
+		unique = base + "_" + strconv.Itoa(i)
+	}
+	n.taken[strings.ToUpper(unique)] = true
+	n.shots[key] = unique
+	return unique + ext
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandFilenameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{dcim}_{original}{ext}", "100_IMG_0001.JPG"},
+		{"{date}_{time}_{seq}{ext}", "2025-11-01_143045_0001.JPG"},
+		{"{date:20060102}-{seq:2}{ext}", "20251101-01.JPG"},
+		{"{camera}_{serial}_{original}{ext}", "Canon_EOS_R6_012345678901_IMG_0001.JPG"},
+	}
+	for _, tt := range tests {
+		if got, err := expandFilenameTemplate(tt.template, sampleNameFields); err != nil || got != tt.want {
+			t.Errorf("expandFilenameTemplate(%q) = %q, %v; want %q", tt.template, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"{lens}{ext}", "{date:2006/01/02}{ext}", "{seq:0}{ext}", "{ext}"} {
+		if got, err := expandFilenameTemplate(bad, sampleNameFields); err == nil {
+			t.Errorf("expandFilenameTemplate(%q) = %q, want an error", bad, got)
+		}
+	}
+}
+
+// writeCardFiles creates files in a DCIM folder under a temp card mount point,
+// all modified at the given time, and returns the folder's path.
+func writeCardFiles(t *testing.T, cameraDir string, modified time.Time, names ...string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "DCIM", cameraDir)
+	os.MkdirAll(dir, 0755)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, modified, modified)
+	}
+	return dir
+}
+
+// nameCardFiles runs names through an import namer like the import does.
+func nameCardFiles(t *testing.T, n *importNamer, cardDir string, names ...string) []string {
+	t.Helper()
+	var got []string
+	for _, name := range names {
+		path := filepath.Join(cardDir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n.name(filepath.Base(cardDir), path, info))
+	}
+	return got
+}
+
+func TestImportNamerKeepsPairsAndAvoidsCollisions(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "2025-11-01.JPG"), []byte("earlier"), 0644)
+
+	taken := time.Date(2025, 11, 1, 14, 30, 45, 0, time.Local)
+	names := []string{"IMG_0001.CR3", "IMG_0001.JPG", "IMG_0002.JPG"}
+	cardDir := writeCardFiles(t, "100CANON", taken, names...)
+
+	got := nameCardFiles(t, newImportNamer("{date}{ext}", "batch"), cardDir, names...)
+	want := []string{"2025-11-01_2.CR3", "2025-11-01_2.JPG", "2025-11-01_3.JPG"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s named %q, want %q", names[i], got[i], want[i])
+		}
+	}
+
+	if got := nameCardFiles(t, newImportNamer("", "new"), cardDir, "IMG_0002.JPG"); got[0] != "100_IMG_0002.JPG" {
+		t.Errorf("without a template IMG_0002.JPG named %q, want 100_IMG_0002.JPG", got[0])
+	}
+}
+
+func TestImportNamerReusesNamesFromManifest(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+	os.WriteFile(filepath.Join(photoBaseDir, "batch", "trip_0007.JPG"), []byte("IMG_0001.JPG"), 0644)
+	recordManifestEntries("batch", []manifestEntry{{
+		File:   "trip_0007.JPG",
+		Source: "DCIM/100CANON/IMG_0001.JPG",
+		Kind:   manifestKindImport,
+	}})
+
+	cardDir := writeCardFiles(t, "100CANON", time.Now(), "IMG_0001.CR3", "IMG_0002.CR3")
+	got := nameCardFiles(t, newImportNamer("trip_{seq}{ext}", "batch"), cardDir, "IMG_0001.CR3", "IMG_0002.CR3")
+	if got[0] != "trip_0007.CR3" || got[1] != "trip_0002.CR3" {
+		t.Errorf("names = %v, want the RAW next to its JPEG (trip_0007.CR3) and the next sequence number (trip_0002.CR3)", got)
+	}
+
+	m, _ := loadManifest("batch")
+	if dir, original := cardOriginal(m, "trip_0007"); dir != "100CANON" || original != "IMG_0001" {
+		t.Errorf("cardOriginal(trip_0007) = %q, %q; want 100CANON, IMG_0001", dir, original)
+	}
+	if dir, original := cardOriginal(m, "101_IMG_0042"); dir != "101" || original != "IMG_0042" {
+		t.Errorf("cardOriginal(101_IMG_0042) = %q, %q; want the legacy name split into 101, IMG_0042", dir, original)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// previewCacheDir holds rotated RAW previews, per session, inside the
+// thumbnail cache: thumbnailCacheDir/<directory>/.previews/<raw filename>.
+const previewCacheDir = ".previews"
+
+// thumbnailCacheVersion is bumped whenever the way thumbnails are rendered
+// changes, so caches written by older versions are discarded at startup.
+// Version 2 applies the EXIF Orientation tag.
+const (
+	thumbnailCacheVersion     = "2"
+	thumbnailCacheVersionFile = ".version"
+)
+
+// previewLocks serializes generation of the same rotated preview, like
+// thumbnailLocks.
+var previewLocks stripedLocks
+
+// stripedLocks is a fixed set of mutexes shared out by hashing a key, so
+// generating the same file is serialized without keeping a lock per file
+// for the lifetime of the server. Unrelated keys occasionally share a lock,
+// which only costs a little parallelism.
+type stripedLocks [64]sync.Mutex
+
+// lock locks the mutex for key and returns it for unlocking.
+func (l *stripedLocks) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	m := &l[h.Sum32()%uint32(len(l))]
+	m.Lock()
+	return m
+}
+
+// photoOrientation returns the EXIF Orientation (1-8) of a JPEG or RAW file,
+// or 1 if it has none.
+func photoOrientation(path string) int {
+	meta, err := extractPhotoMetadata(path)
+	if err != nil || meta.Raw.Orientation == nil {
+		return 1
+	}
+	return *meta.Raw.Orientation
+}
+
+// orientImage returns img transformed for display according to an EXIF
+// Orientation value. Orientation 1 (and unknown values) return img as is.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // mirror horizontal and rotate 270 CW
+				dx, dy = y, x
+			case 6: // rotate 90 CW
+				dx, dy = h-1-y, x
+			case 7: // mirror horizontal and rotate 90 CW
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 CW
+				dx, dy = y, w-1-x
+			}
+			s := src.PixOffset(x, y)
+			copy(dst.Pix[dst.PixOffset(dx, dy):], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+// rawPreview returns the embedded preview of a RAW file in the session
+// directory, rotated according to the RAW's Orientation tag. Previews that
+// need no rotation are returned as embedded; rotated ones are re-encoded once
+// and cached under previewCacheDir like thumbnails.
+func rawPreview(directory, filename, rawPath string) ([]byte, error) {
+	orientation := photoOrientation(rawPath)
+	if orientation < 2 || orientation > 8 {
+		return extractEmbeddedJPEG(rawPath)
+	}
+
+	cacheDir := filepath.Join(thumbnailCacheDir, directory, previewCacheDir)
+	cachePath := filepath.Join(cacheDir, filename)
+	if data, err := os.ReadFile(cachePath); err == nil {
+		return data, nil
+	}
+
+	defer previewLocks.lock(directory + "/" + filename).Unlock()
+	if data, err := os.ReadFile(cachePath); err == nil {
+		return data, nil
+	}
+
+	jpegData, err := extractEmbeddedJPEG(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(jpegData))
+	if err != nil {
+		return nil, fmt.Errorf("decoding embedded JPEG from %s: %w", filename, err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+
+	// A failure to cache is not a failure to serve the preview.
+	if err := writeFileAtomic(cacheDir, cachePath, buf.Bytes()); err != nil {
+		log.Printf("Failed to cache rotated preview %s: %v", cachePath, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic writes data to a temp file in dir and renames it to path,
+// so concurrent readers never see a partial file.
+func writeFileAtomic(dir, path string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// resetStaleThumbnailCache empties the thumbnail cache if it was written by a
+// version that rendered thumbnails differently (see thumbnailCacheVersion).
+func resetStaleThumbnailCache() error {
+	versionPath := filepath.Join(thumbnailCacheDir, thumbnailCacheVersionFile)
+	if v, err := os.ReadFile(versionPath); err == nil && string(v) == thumbnailCacheVersion {
+		return nil
+	}
+	entries, err := os.ReadDir(thumbnailCacheDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		log.Printf("Discarding thumbnails cached by an older version")
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(thumbnailCacheDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(versionPath, []byte(thumbnailCacheVersion), 0644)
+}
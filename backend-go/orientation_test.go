@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	// A 3x2 image whose pixels are numbered 1..6 row by row:
+	//   1 2 3
+	//   4 5 6
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Set(i%3, i/3, color.RGBA{R: uint8(i + 1), A: 255})
+	}
+	tests := map[int][]string{
+		1: {"123", "456"},
+		2: {"321", "654"},
+		3: {"654", "321"},
+		4: {"456", "123"},
+		5: {"14", "25", "36"},
+		6: {"41", "52", "63"},
+		7: {"63", "52", "41"},
+		8: {"36", "25", "14"},
+	}
+	for orientation, want := range tests {
+		img := orientImage(src, orientation)
+		b := img.Bounds()
+		var rows []string
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := ""
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				row += string(rune('0' + r>>8))
+			}
+			rows = append(rows, row)
+		}
+		if fmt.Sprint(rows) != fmt.Sprint(want) {
+			t.Errorf("orientImage(%d) = %v, want %v", orientation, rows, want)
+		}
+	}
+}
+
+// testJPEGWithOrientation encodes a w x h JPEG with an EXIF APP1 segment
+// holding the given Orientation.
+func testJPEGWithOrientation(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := buildTIFF([]testIFDEntry{shortEntry(0x0112, uint16(orientation))}, nil)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(2+6+len(tiff)))
+	app1 = append(append(app1, "Exif\x00\x00"...), tiff...)
+	return append(append([]byte{0xFF, 0xD8}, app1...), buf.Bytes()[2:]...)
+}
+
+func TestGenerateThumbnailAppliesOrientation(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	thumbnailCacheDir = filepath.Join(photoBaseDir, ".thumbnails")
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+	os.WriteFile(filepath.Join(photoBaseDir, "batch", "100_IMG_0001.JPG"), testJPEGWithOrientation(t, 400, 200, 6), 0644)
+
+	if err := generateThumbnail("batch", "100_IMG_0001.JPG"); err != nil {
+		t.Fatalf("generateThumbnail() error = %v", err)
+	}
+	f, err := os.Open(filepath.Join(thumbnailCacheDir, "batch", "100_IMG_0001.JPG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 100 || cfg.Height != 200 {
+		t.Errorf("thumbnail is %dx%d, want 100x200 (rotated portrait)", cfg.Width, cfg.Height)
+	}
+}
+
+func TestRawPreviewRotatesAndCaches(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	thumbnailCacheDir = filepath.Join(photoBaseDir, ".thumbnails")
+	os.MkdirAll(filepath.Join(photoBaseDir, "batch"), 0755)
+
+	var preview bytes.Buffer
+	jpeg.Encode(&preview, image.NewGray(image.Rect(0, 0, 60, 40)), nil)
+	jpegPointers := []testIFDEntry{longEntry(0x0201, jpegOffsetValue), longEntry(0x0202, jpegLengthValue)}
+	write := func(name string, orientation uint32) string {
+		ifd0 := append([]testIFDEntry{longEntry(0x0112, orientation)}, jpegPointers...)
+		path := filepath.Join(photoBaseDir, "batch", name)
+		os.WriteFile(path, buildRawTIFF(0x4F52, ifd0, nil, nil, preview.Bytes(), nil), 0644)
+		return path
+	}
+
+	upright := write("100_P0000001.ORF", 1)
+	data, err := rawPreview("batch", "100_P0000001.ORF", upright)
+	if err != nil || !bytes.Equal(data, preview.Bytes()) {
+		t.Errorf("rawPreview(upright) = %d bytes (err %v), want the embedded preview unchanged", len(data), err)
+	}
+
+	portrait := write("100_P0000002.ORF", 8)
+	data, err = rawPreview("batch", "100_P0000002.ORF", portrait)
+	if err != nil {
+		t.Fatalf("rawPreview() error = %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width != 40 || cfg.Height != 60 {
+		t.Errorf("rotated preview is %dx%d (err %v), want 40x60", cfg.Width, cfg.Height, err)
+	}
+	cached, err := os.ReadFile(filepath.Join(thumbnailCacheDir, "batch", previewCacheDir, "100_P0000002.ORF"))
+	if err != nil || !bytes.Equal(cached, data) {
+		t.Errorf("rotated preview not cached (err %v)", err)
+	}
+}
+
+func TestResetStaleThumbnailCache(t *testing.T) {
+	thumbnailCacheDir = t.TempDir()
+	stale := filepath.Join(thumbnailCacheDir, "batch", "100_IMG_0001.JPG")
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	os.WriteFile(stale, []byte("sideways"), 0644)
+
+	if err := resetStaleThumbnailCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("thumbnail from an older cache version was kept")
+	}
+
+	os.MkdirAll(filepath.Dir(stale), 0755)
+	os.WriteFile(stale, []byte("upright"), 0644)
+	if err := resetStaleThumbnailCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Error("current-version thumbnail was discarded")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Metadata handling of an export preset.
+const (
+	presetMetadataStrip     = "strip"       // no EXIF at all
+	presetMetadataKeep      = "keep"        // the source JPEG's EXIF
+	presetMetadataKeepNoGPS = "keep_no_gps" // the source JPEG's EXIF without the GPS position
+)
+
+// exportPreset renders photos as resized JPEGs, e.g. 2048px long-edge copies
+// for sharing. Presets are defined in the config file.
+type exportPreset struct {
+	Name             string `json:"name"`
+	LongEdge         int    `json:"long_edge"`                   // pixels; 0 keeps the full size
+	Quality          int    `json:"quality,omitempty"`           // JPEG quality 1-100, default 90
+	Metadata         string `json:"metadata,omitempty"`          // presetMetadata*, default strip
+	OutputDir        string `json:"output_dir,omitempty"`        // absolute, or relative to the session; default export/<name>
+	FilenameTemplate string `json:"filename_template,omitempty"` // see nameFields, plus {name} and {preset}; default "{name}.jpg"
+}
+
+const defaultPresetTemplate = "{name}.jpg"
+
+// validateExportPresets checks the presets of a config file.
+func validateExportPresets(presets []exportPreset) error {
+	seen := make(map[string]bool)
+	for i, p := range presets {
+		if !validDirName(p.Name) {
+			return fmt.Errorf("export_presets[%d]: name must be a plain file name", i)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("export_presets[%d]: duplicate preset %q", i, p.Name)
+		}
+		seen[p.Name] = true
+		if p.LongEdge < 0 {
+			return fmt.Errorf("export preset %q: long_edge must not be negative", p.Name)
+		}
+		if p.Quality < 0 || p.Quality > 100 {
+			return fmt.Errorf("export preset %q: quality must be between 1 and 100", p.Name)
+		}
+		switch p.Metadata {
+		case "", presetMetadataStrip, presetMetadataKeep, presetMetadataKeepNoGPS:
+		default:
+			return fmt.Errorf("export preset %q: metadata must be strip, keep or keep_no_gps", p.Name)
+		}
+		if p.OutputDir != "" && !filepath.IsAbs(p.OutputDir) {
+			for _, part := range strings.Split(filepath.ToSlash(p.OutputDir), "/") {
+				if part == ".." {
+					return fmt.Errorf("export preset %q: a relative output_dir must stay inside the session", p.Name)
+				}
+			}
+		}
+		if _, err := p.outputName("100_IMG_0001.JPG", sampleNameFields); err != nil {
+			return fmt.Errorf("export preset %q: filename_template: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// outputDir returns where the preset writes a session's renders.
+func (p exportPreset) outputDir(sessionDir string) string {
+	switch {
+	case p.OutputDir == "":
+		return filepath.Join(sessionDir, "export", p.Name)
+	case filepath.IsAbs(p.OutputDir):
+		return p.OutputDir
+	default:
+		return filepath.Join(sessionDir, p.OutputDir)
+	}
+}
+
+// outputName expands the preset's filename template for a photo. Besides the
+// fields of the photo, {name} is the photo's session name without extension
+// and {preset} the preset's name; {ext} is always .jpg.
+func (p exportPreset) outputName(photo string, f nameFields) (string, error) {
+	template := p.FilenameTemplate
+	if template == "" {
+		template = defaultPresetTemplate
+	}
+	f.ext = ".jpg"
+	f.extra = map[string]string{"name": strings.TrimSuffix(photo, filepath.Ext(photo)), "preset": p.Name}
+	return expandFilenameTemplate(template, f)
+}
+
+// presetNameFields gathers the template fields of a selected photo: the card
+// name and folder it was imported from, its capture time and, if the template
+// needs them, camera model and serial number. seq numbers the photos of one
+// export from 1.
+func presetNameFields(p exportPreset, m importManifest, sourcePath, photo string, seq int) nameFields {
+	cameraDir, original := cardOriginal(m, strings.TrimSuffix(photo, filepath.Ext(photo)))
+	f := nameFields{original: original, dcim: getDCIMPrefix(cameraDir), seq: seq}
+	if info, err := os.Stat(sourcePath); err == nil {
+		f.taken, _ = fileCaptureTime(sourcePath, info)
+	}
+	if templateUsesMetadata(p.FilenameTemplate) {
+		if meta, err := extractPhotoMetadata(sourcePath); err == nil {
+			f.camera, f.serial = meta.Model, meta.SerialNumber
+		}
+	}
+	return f
+}
+
+// renderPresetPhoto renders one photo through a preset into outPath and
+// returns the size written. The image is decoded and resized like a
+// thumbnail, then rotated upright, so a kept EXIF block has its Orientation
+// reset to 1.
+func renderPresetPhoto(p exportPreset, sourcePath, outPath string) (int64, error) {
+	img, err := decodePhoto(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	if b := img.Bounds(); p.LongEdge > 0 && (b.Dx() > p.LongEdge || b.Dy() > p.LongEdge) {
+		img = resize.Thumbnail(uint(p.LongEdge), uint(p.LongEdge), img, resize.Lanczos3)
+	}
+	img = orientImage(img, photoOrientation(sourcePath))
+
+	quality := p.Quality
+	if quality == 0 {
+		quality = 90
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+
+	if p.Metadata == presetMetadataKeep || p.Metadata == presetMetadataKeepNoGPS {
+		exif, err := presetEXIF(sourcePath, p.Metadata == presetMetadataKeepNoGPS)
+		if err != nil {
+			log.Printf("Not keeping EXIF of %s: %v", sourcePath, err)
+		} else {
+			data = insertEXIF(data, exif)
+		}
+	}
+	return int64(len(data)), writeFileAtomic(filepath.Dir(outPath), outPath, data)
+}
+
+// presetEXIF returns a copy of a JPEG's EXIF TIFF block with the orientation
+// reset and, if stripGPS is set, the GPS IFD emptied and its values zeroed.
+// RAWs have no APP1 segment to keep, so their renders carry no EXIF.
+func presetEXIF(path string, stripGPS bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	section, err := jpegExifSection(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(section)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTIFFReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := t.readIFD(t.ifd0)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		pos := int(t.ifd0) + 2 + i*12
+		switch e.tag {
+		case 0x0112: // Orientation
+			if e.typ == 3 {
+				t.bo.PutUint16(data[pos+8:], 1)
+			}
+		case 0x8825: // GPS IFD pointer
+			if stripGPS {
+				clearTIFFIFD(t, data, t.bo.Uint32(e.value[:]))
+			}
+		}
+	}
+	return data, nil
+}
+
+// clearTIFFIFD zeroes the entries of the IFD at off, and the out-of-line
+// values they point to, leaving a valid empty IFD.
+func clearTIFFIFD(t *tiffReader, data []byte, off uint32) {
+	entries, _, err := t.readIFD(off)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		n := uint64(tiffTypeSize(e.typ)) * uint64(e.count)
+		if n <= 4 {
+			continue
+		}
+		start := uint64(t.bo.Uint32(e.value[:]))
+		if start+n <= uint64(len(data)) {
+			clear(data[start : start+n])
+		}
+	}
+	end := int(off) + 2 + len(entries)*12 + 4
+	if end > len(data) {
+		end = len(data)
+	}
+	clear(data[off:end])
+}
+
+// tiffTypeSize returns the size in bytes of one value of a TIFF field type.
+func tiffTypeSize(typ uint16) int {
+	switch typ {
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11, 13: // LONG, SLONG, FLOAT, IFD
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	default: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	}
+}
+
+// insertEXIF adds an APP1 EXIF segment holding tiff right after the SOI of a
+// JPEG. A block too big for one segment is dropped.
+func insertEXIF(jpegData, tiff []byte) []byte {
+	header := []byte("Exif\x00\x00")
+	segLen := 2 + len(header) + len(tiff)
+	if segLen > 0xFFFF || len(jpegData) < 2 {
+		return jpegData
+	}
+	out := make([]byte, 0, len(jpegData)+2+segLen)
+	out = append(out, jpegData[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(segLen))
+	out = append(out, header...)
+	out = append(out, tiff...)
+	return append(out, jpegData[2:]...)
+}
+
+// presetPhotos returns the selected photos of a session a preset can render:
+// JPEGs, PNGs and RAWs (through their embedded preview).
+func presetPhotos(directory string) ([]string, error) {
+	names, err := selectedFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+	var photos []string
+	for _, name := range names {
+		lowerName := strings.ToLower(name)
+		if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".png") || isRawFile(name) {
+			photos = append(photos, name)
+		}
+	}
+	return photos, nil
+}
+
+// presetSourcePath returns the file a selected photo is rendered from: the
+// session's own copy, or the one in selected/ if only that is left.
+func presetSourcePath(sessionDir, photo string) string {
+	path := filepath.Join(sessionDir, photo)
+	if _, err := os.Stat(path); err != nil {
+		selected := filepath.Join(sessionDir, "selected", photo)
+		if _, err := os.Stat(selected); err == nil {
+			return selected
+		}
+	}
+	return path
+}
+
+// presetResult is the outcome of rendering one photo.
+type presetResult struct {
+	photo, output string
+	size          int64
+	err           error
+}
+
+// exportPresetHandler renders a session's selection through an export preset.
+//
+// POST {"directory", "preset", "photos"?} renders the listed photos, or the
+// whole selection, on one worker per CPU and streams NDJSON events like the
+// import: "start", a "progress" event per photo, then "done", or "cancelled"
+// if the client goes away.
+func exportPresetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		Directory string   `json:"directory"`
+		Preset    string   `json:"preset"`
+		Photos    []string `json:"photos"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validDirName(data.Directory) || data.Preset == "" {
+		http.Error(w, "Missing 'directory' or 'preset' in request", http.StatusBadRequest)
+		return
+	}
+	preset, ok := configuredExportPreset(data.Preset)
+	if !ok {
+		http.Error(w, "Unknown export preset: "+data.Preset, http.StatusNotFound)
+		return
+	}
+	sessionDir, err := safePhotoPath(data.Directory)
+	if err != nil {
+		http.Error(w, "Invalid directory", http.StatusBadRequest)
+		return
+	}
+	photos := data.Photos
+	if photos == nil {
+		if photos, err = presetPhotos(data.Directory); err != nil {
+			http.Error(w, "Failed to read selected photos", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, photo := range photos {
+		if !validDirName(photo) {
+			http.Error(w, "Invalid photo name: "+photo, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(photos) == 0 {
+		http.Error(w, "No selected photos to export", http.StatusNotFound)
+		return
+	}
+	outDir := preset.outputDir(sessionDir)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		http.Error(w, "Failed to create output directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	emit := func(event map[string]interface{}) {
+		if enc.Encode(event) == nil && flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	total := len(photos)
+	emit(map[string]interface{}{"type": "start", "total": total, "preset": preset.Name, "output_dir": outDir})
+
+	ctx := r.Context()
+	results := renderPresetPhotos(ctx, preset, data.Directory, sessionDir, outDir, photos)
+	started := time.Now()
+	processed, rendered, failed := 0, 0, 0
+	var bytesWritten int64
+	for res := range results {
+		processed++
+		event := map[string]interface{}{"type": "progress", "copied": processed, "total": total, "file": res.photo}
+		if res.err != nil {
+			log.Printf("Failed to export %s with preset %s: %v", res.photo, preset.Name, res.err)
+			failed++
+			event["error"] = res.err.Error()
+		} else {
+			rendered++
+			bytesWritten += res.size
+			event["output"] = res.output
+		}
+		emit(event)
+	}
+	if ctx.Err() != nil {
+		emit(map[string]interface{}{
+			"type":    "cancelled",
+			"message": "Export cancelled after " + strconv.Itoa(rendered) + " of " + strconv.Itoa(total) + " photos.",
+			"copied":  rendered,
+			"total":   total,
+		})
+		return
+	}
+
+	message := fmt.Sprintf("Exported %d photos with preset %s to %s", rendered, preset.Name, outDir)
+	if failed > 0 {
+		message += fmt.Sprintf("; %d failed", failed)
+	}
+	emit(map[string]interface{}{
+		"type":          "done",
+		"message":       message,
+		"exported":      rendered,
+		"failed":        failed,
+		"bytes_written": bytesWritten,
+		"seconds":       time.Since(started).Seconds(),
+		"output_dir":    outDir,
+	})
+}
+
+// renderPresetPhotos renders photos on one worker per CPU (see
+// preGenerateThumbnails) and delivers the results as they finish. Output names
+// are handed out in order before rendering, so two photos whose template
+// gives the same name get a _2, _3, ... suffix. The channel is closed once
+// every photo is done, or early when ctx is cancelled.
+func renderPresetPhotos(ctx context.Context, preset exportPreset, directory, sessionDir, outDir string, photos []string) <-chan presetResult {
+	type presetJob struct {
+		presetResult
+		source string
+	}
+	jobs := make(chan presetJob)
+	results := make(chan presetResult)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				res := job.presetResult
+				if res.err == nil {
+					res.size, res.err = renderPresetPhoto(preset, job.source, filepath.Join(outDir, res.output))
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		m, err := loadManifest(directory)
+		if err != nil {
+			log.Printf("Failed to read import manifest for %s: %v", directory, err)
+		}
+		taken := make(map[string]bool)
+		for i, photo := range photos {
+			job := presetJob{presetResult: presetResult{photo: photo}, source: presetSourcePath(sessionDir, photo)}
+			f := presetNameFields(preset, m, job.source, photo, i+1)
+			if job.output, job.err = preset.outputName(photo, f); job.err == nil {
+				ext := filepath.Ext(job.output)
+				base := strings.TrimSuffix(job.output, ext)
+				for n := 2; taken[strings.ToLower(job.output)]; n++ {
+					job.output = base + "_" + strconv.Itoa(n) + ext
+				}
+				taken[strings.ToLower(job.output)] = true
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testJPEGWithGPS encodes a w x h JPEG whose EXIF holds a make, the given
+// Orientation and a GPS position.
+func testJPEGWithGPS(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := buildTIFF(
+		[]testIFDEntry{asciiEntry(0x010F, "Canon"), shortEntry(0x0112, uint16(orientation))},
+		nil,
+		asciiEntry(0x0001, "S"),
+		rationalEntry(0x0002, 5, 33, 1, 51, 1, 54, 1),
+		asciiEntry(0x0003, "E"),
+		rationalEntry(0x0004, 5, 151, 1, 12, 1, 36, 1),
+	)
+	return insertEXIF(buf.Bytes(), tiff)
+}
+
+// renderedMetadata decodes a rendered JPEG's size and parses its EXIF, if any.
+func renderedMetadata(t *testing.T, path string) (image.Config, *photoMetadata) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := jpegExifSection(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return cfg, nil
+	}
+	tiff, _ := io.ReadAll(section)
+	meta, err := parseExifTIFF(tiff)
+	if err != nil {
+		t.Fatalf("parseExifTIFF() error = %v", err)
+	}
+	return cfg, &meta
+}
+
+func TestRenderPresetPhotoMetadata(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "IMG_0001.JPG")
+	os.WriteFile(src, testJPEGWithGPS(t, 400, 200, 6), 0644)
+
+	tests := []struct {
+		metadata          string
+		wantEXIF, wantGPS bool
+	}{
+		{"", false, false},
+		{presetMetadataKeep, true, true},
+		{presetMetadataKeepNoGPS, true, false},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, "out-"+tt.metadata+".jpg")
+		preset := exportPreset{Name: "web", LongEdge: 100, Metadata: tt.metadata}
+		if _, err := renderPresetPhoto(preset, src, out); err != nil {
+			t.Fatalf("renderPresetPhoto(%q) error = %v", tt.metadata, err)
+		}
+		cfg, meta := renderedMetadata(t, out)
+		if cfg.Width != 50 || cfg.Height != 100 {
+			t.Errorf("metadata %q: rendered %dx%d, want 50x100 (resized, rotated portrait)", tt.metadata, cfg.Width, cfg.Height)
+		}
+		if (meta != nil) != tt.wantEXIF {
+			t.Errorf("metadata %q: has EXIF = %v, want %v", tt.metadata, meta != nil, tt.wantEXIF)
+			continue
+		}
+		if meta == nil {
+			continue
+		}
+		if meta.Make != "Canon" || meta.Raw.Orientation == nil || *meta.Raw.Orientation != 1 {
+			t.Errorf("metadata %q: make %q, orientation %v; want Canon with orientation reset to 1", tt.metadata, meta.Make, meta.Raw.Orientation)
+		}
+		if (meta.GPS != nil) != tt.wantGPS {
+			t.Errorf("metadata %q: GPS = %+v, want present %v", tt.metadata, meta.GPS, tt.wantGPS)
+		}
+	}
+}
+
+func TestExportPresetOutputName(t *testing.T) {
+	p := exportPreset{Name: "web", FilenameTemplate: "{name}_{preset}.jpg"}
+	if got, err := p.outputName("100_IMG_0001.CR3", nameFields{}); err != nil || got != "100_IMG_0001_web.jpg" {
+		t.Errorf("outputName() = %q, %v; want 100_IMG_0001_web.jpg", got, err)
+	}
+	if got, _ := (exportPreset{Name: "web"}).outputName("IMG_0001.JPG", nameFields{}); got != "IMG_0001.jpg" {
+		t.Errorf("default outputName() = %q, want IMG_0001.jpg", got)
+	}
+	p = exportPreset{Name: "web", FilenameTemplate: "{date}_{original}_{seq:3}{ext}"}
+	if got, _ := p.outputName("2025_0001.JPG", sampleNameFields); got != "2025-11-01_IMG_0001_001.jpg" {
+		t.Errorf("outputName() with card fields = %q, want 2025-11-01_IMG_0001_001.jpg", got)
+	}
+	if _, err := (exportPreset{Name: "web", FilenameTemplate: "web/{name}.jpg"}).outputName("IMG_0001.JPG", nameFields{}); err == nil {
+		t.Error("outputName() accepted a template with a slash")
+	}
+}
+
+func TestExportPresetHandlerStreamsProgress(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	defer func(cfg appConfig) { currentConfig = cfg }(currentConfig)
+	currentConfig.ExportPresets = []exportPreset{{Name: "web", LongEdge: 100, FilenameTemplate: "{name}_web.jpg"}}
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(session, 0755)
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG"} {
+		os.WriteFile(filepath.Join(session, name), testJPEGWithOrientation(t, 400, 200, 1), 0644)
+	}
+	if _, err := addToSelection(context.Background(), "batch", []string{"IMG_0001.JPG", "IMG_0002.JPG"}, selectionVirtual); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.NewReader(`{"directory": "batch", "preset": "web"}`)
+	rec := httptest.NewRecorder()
+	exportPresetHandler(rec, httptest.NewRequest(http.MethodPost, "/api/export-preset", body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	var types []string
+	var done map[string]interface{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("bad event %q: %v", scanner.Text(), err)
+		}
+		types = append(types, event["type"].(string))
+		done = event
+	}
+	if strings.Join(types, ",") != "start,progress,progress,done" {
+		t.Errorf("events = %v, want start, two progress, done", types)
+	}
+	if done["exported"] != float64(2) || done["failed"] != float64(0) {
+		t.Errorf("done = %v, want 2 exported, 0 failed", done)
+	}
+	for _, name := range []string{"IMG_0001_web.jpg", "IMG_0002_web.jpg"} {
+		if _, err := os.Stat(filepath.Join(session, "export", "web", name)); err != nil {
+			t.Errorf("rendered %s: %v", name, err)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	exportPresetHandler(rec, httptest.NewRequest(http.MethodPost, "/api/export-preset", strings.NewReader(`{"directory": "batch", "preset": "print"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown preset: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestRenderPresetPhotosSuffixesCollidingNames(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	outDir := filepath.Join(session, "export", "web")
+	os.MkdirAll(outDir, 0755)
+	photos := []string{"IMG_0001.JPG", "IMG_0001.jpeg", "IMG_0002.JPG"}
+	for _, name := range photos {
+		os.WriteFile(filepath.Join(session, name), testJPEGWithOrientation(t, 40, 20, 1), 0644)
+	}
+
+	outputs := make(map[string]string)
+	for res := range renderPresetPhotos(context.Background(), exportPreset{Name: "web"}, "batch", session, outDir, photos) {
+		if res.err != nil {
+			t.Fatalf("render %s: %v", res.photo, res.err)
+		}
+		outputs[res.photo] = res.output
+	}
+	want := map[string]string{"IMG_0001.JPG": "IMG_0001.jpg", "IMG_0001.jpeg": "IMG_0001_2.jpg", "IMG_0002.JPG": "IMG_0002.jpg"}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs = %v, want %v", outputs, want)
+	}
+}
+
+func TestInsertEXIFOversizedBlock(t *testing.T) {
+	jpegData := []byte{0xFF, 0xD8, 0xFF, 0xD9}
+	if got := insertEXIF(jpegData, make([]byte, 0x10000)); !bytes.Equal(got, jpegData) {
+		t.Error("insertEXIF() added a segment too big for APP1")
+	}
+	got := insertEXIF(jpegData, []byte("II*\x00"))
+	if binary.BigEndian.Uint16(got[4:]) != 2+6+4 || string(got[6:12]) != "Exif\x00\x00" {
+		t.Errorf("insertEXIF() = % x, want an APP1 segment after SOI", got)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Places a RAW is exported from, in the order they are tried.
+const (
+	rawSourceSession = "session" // imported next to the JPEG (import_raws)
+	rawSourceArchive = "archive" // one of the configured archive_dirs
+	rawSourceCard    = "card"    // the connected SD card
+)
+
+// rawSource is the RAW found for a selected JPEG.
+type rawSource struct {
+	path       string
+	kind       string // rawSourceSession, rawSourceArchive or rawSourceCard
+	mountPoint string // card mount point, for rawSourceCard
+}
+
+// findRawSource looks for the RAW of a selected JPEG, given its session base
+// name (e.g. 100_IMG_0001): in the session directory, then in each archive
+// directory (as <archive>/<session>/<name> or <archive>/<name>), then on the
+// card at mountPoint if one is connected.
+func findRawSource(directory, baseName, mountPoint string) (rawSource, bool) {
+	if sourceDir, err := safePhotoPath(directory); err == nil {
+		if path, ok := rawPathInDir(sourceDir, baseName); ok {
+			return rawSource{path: path, kind: rawSourceSession}, true
+		}
+	}
+	for _, archive := range configuredArchiveDirs() {
+		for _, dir := range []string{filepath.Join(archive, directory), archive} {
+			if path, ok := rawPathInDir(dir, baseName); ok {
+				return rawSource{path: path, kind: rawSourceArchive}, true
+			}
+		}
+	}
+	if mountPoint != "" {
+		m, err := loadManifest(directory)
+		if err != nil {
+			log.Printf("Failed to read import manifest for %s: %v", directory, err)
+		}
+		cameraDir, originalBaseName := cardOriginal(m, baseName)
+		if path, _, ok := findRawForJPG(mountPoint, cameraDir, originalBaseName); ok {
+			return rawSource{path: path, kind: rawSourceCard, mountPoint: mountPoint}, true
+		}
+	}
+	return rawSource{}, false
+}
+
+// cardOriginal returns the DCIM folder and card name (without extension) a
+// session photo was imported from. The session's import manifest m knows
+// them whatever the import filename template made of the name; sessions
+// imported before manifests existed have legacy <dcim>_<original> names,
+// which give the folder number only.
+func cardOriginal(m importManifest, baseName string) (cameraDir, originalBaseName string) {
+	for _, e := range m.Entries {
+		if e.Kind == manifestKindImport && e.Source != "" && strings.TrimSuffix(e.File, filepath.Ext(e.File)) == baseName {
+			original := filepath.Base(e.Source)
+			return filepath.Base(filepath.Dir(e.Source)), strings.TrimSuffix(original, filepath.Ext(original))
+		}
+	}
+	return splitPrefixedFilename(baseName)
+}
+
+// exportRawVerified copies a RAW into a session's selected/raw directory with
+// copyFileVerified and returns its manifest entry. The entry keeps the card
+// file it came from: directly for a card source, or from the import manifest
+// for a RAW imported into the session, so card deletion can still match it.
+func exportRawVerified(ctx context.Context, directory string, src rawSource, rawDestPath string) (manifestEntry, error) {
+	size, sum, err := copyFileVerified(ctx, src.path, rawDestPath)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	entry := manifestEntry{
+		File:   filepath.ToSlash(filepath.Join("selected", "raw", filepath.Base(rawDestPath))),
+		Size:   size,
+		SHA256: sum,
+		Kind:   manifestKindRawExport,
+		Copied: time.Now(),
+	}
+	switch src.kind {
+	case rawSourceCard:
+		if rel, err := filepath.Rel(src.mountPoint, src.path); err == nil {
+			entry.Source = filepath.ToSlash(rel)
+			entry.DCIMFolder = filepath.Base(filepath.Dir(src.path))
+		}
+	case rawSourceSession:
+		m, err := loadManifest(directory)
+		if err != nil {
+			log.Printf("Failed to read import manifest for %s: %v", directory, err)
+		}
+		for _, imported := range m.Entries {
+			if imported.File == filepath.Base(src.path) && imported.SHA256 == sum {
+				entry.Source = imported.Source
+				entry.DCIMFolder = imported.DCIMFolder
+				break
+			}
+		}
+	}
+	if info, err := os.Stat(rawDestPath); err == nil {
+		entry.CaptureTime, _ = fileCaptureTime(rawDestPath, info)
+	}
+	return entry, nil
+}
+
+// exportRawCompanions copies the companion files next to an exported RAW's
+// source, such as its voice memo, into selected/raw named after the RAW, and
+// returns their manifest entries. XMP files are left out: the export writes
+// its own sidecar. listings caches directory listings across calls.
+func exportRawCompanions(ctx context.Context, directory string, src rawSource, rawDestPath string, listings map[string][]os.DirEntry) []manifestEntry {
+	dir := filepath.Dir(src.path)
+	entries, ok := listings[dir]
+	if !ok {
+		entries, _ = os.ReadDir(dir)
+		listings[dir] = entries
+	}
+	stem := strings.TrimSuffix(filepath.Base(src.path), filepath.Ext(src.path))
+	var exported []manifestEntry
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || isPrimaryFile(name) || !isCompanionFile(name) || strings.EqualFold(filepath.Ext(name), ".xmp") || !strings.EqualFold(companionStem(name), stem) {
+			continue
+		}
+		dest := filepath.Join(filepath.Dir(rawDestPath), companionDestName(filepath.Base(rawDestPath), name))
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+		companion := src
+		companion.path = filepath.Join(dir, name)
+		entry, err := exportRawVerified(ctx, directory, companion, dest)
+		if err != nil {
+			log.Printf("Failed to copy companion file %s: %v", name, err)
+			continue
+		}
+		exported = append(exported, entry)
+	}
+	return exported
+}
+
+// rawExportItem is a RAW planned for copying by exportRawFilesHandler.
+type rawExportItem struct {
+	jpegFile string
+	destName string // name in selected/raw, e.g. 100_IMG_0001.CR3
+	src      rawSource
+	size     int64
+}
+
+// exportRawFilesHandler copies the RAW of every selected JPEG into
+// selected/raw, streaming newline-delimited JSON events like the import does:
+// "start" with the number of files and bytes to copy, a "progress" event after
+// each file with the files processed and copied, bytes copied and throughput,
+// "verify_failed" for a copy that didn't match its source, "error" for a file
+// that couldn't be copied, and finally "done" or, if the client goes away,
+// "cancelled". Problems found before the first event are plain HTTP errors.
+func exportRawFilesHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Directory string `json:"directory"`
+		Card      string `json:"card"` // see cardMountPoint
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if data.Directory == "" {
+		http.Error(w, "Missing 'directory' in request", http.StatusBadRequest)
+		return
+	}
+
+	// The SD card is only needed for RAWs that are neither in the session
+	// nor in an archive directory, so a missing card isn't an error yet.
+	usbMountPoint, err := cardMountPoint(data.Card)
+	if err != nil && !errors.Is(err, errNoCard) {
+		message, status := cardErrorResponse(err, data.Card)
+		http.Error(w, message, status)
+		return
+	}
+
+	sourceDir, err := safePhotoPath(data.Directory)
+	if err != nil {
+		http.Error(w, "Invalid directory", http.StatusBadRequest)
+		return
+	}
+	rawDestDir := filepath.Join(sourceDir, "selected", "raw")
+
+	// Selected JPEGs, whether copied, linked or only listed
+	jpegFiles, err := selectedJPEGs(data.Directory)
+	if err != nil {
+		http.Error(w, "Failed to read selected photos", http.StatusInternalServerError)
+		return
+	}
+
+	if len(jpegFiles) == 0 {
+		http.Error(w, "No selected JPEG files found", http.StatusNotFound)
+		return
+	}
+
+	// Create raw destination directory
+	if err := os.MkdirAll(rawDestDir, 0755); err != nil {
+		http.Error(w, "Failed to create raw destination directory", http.StatusInternalServerError)
+		return
+	}
+
+	culling, err := loadCulling(data.Directory)
+	if err != nil {
+		log.Printf("Failed to read culling state for %s: %v", data.Directory, err)
+	}
+
+	// Work out what to copy first, so "start" can report the total bytes.
+	skippedCount := 0
+	notFoundCount := 0
+	var plan []rawExportItem
+	var totalBytes int64
+	for _, jpegFile := range jpegFiles {
+		baseName := strings.TrimSuffix(jpegFile, filepath.Ext(jpegFile))
+
+		// Skip if a raw file (any supported extension) is already at
+		// destination, but refresh its sidecar in case ratings changed.
+		if rawPath, ok := rawPathInDir(rawDestDir, baseName); ok {
+			exportXMPSidecar(culling, jpegFile, rawPath)
+			skippedCount++
+			continue
+		}
+
+		src, found := findRawSource(data.Directory, baseName, usbMountPoint)
+		if !found {
+			log.Printf("Raw file not found for %s", baseName)
+			notFoundCount++
+			continue
+		}
+		item := rawExportItem{jpegFile: jpegFile, destName: baseName + filepath.Ext(src.path), src: src}
+		if info, err := os.Stat(src.path); err == nil {
+			item.size = info.Size()
+		}
+		totalBytes += item.size
+		plan = append(plan, item)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	emit := func(event map[string]interface{}) {
+		if err := enc.Encode(event); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	total := len(plan)
+	emit(map[string]interface{}{
+		"type":        "start",
+		"total":       total,
+		"total_bytes": totalBytes,
+		"skipped":     skippedCount,
+		"not_found":   notFoundCount,
+	})
+
+	ctx := r.Context()
+	started := time.Now()
+	copiedCount := 0
+	failedCount := 0
+	var bytesCopied int64
+	verifyFailed := []string{}
+	sources := make(map[string]string) // exported RAW name -> rawSource kind
+	var manifestEntries []manifestEntry
+	companionCount := 0
+	listings := make(map[string][]os.DirEntry)
+	throughput := func() int64 {
+		if elapsed := time.Since(started).Seconds(); elapsed > 0 {
+			return int64(float64(bytesCopied) / elapsed)
+		}
+		return 0
+	}
+	cancelled := func() {
+		if err := recordManifestEntries(data.Directory, manifestEntries); err != nil {
+			log.Printf("Failed to update import manifest for %s: %v", data.Directory, err)
+		}
+		emit(map[string]interface{}{
+			"type":         "cancelled",
+			"message":      "Raw export cancelled after " + strconv.Itoa(copiedCount) + " of " + strconv.Itoa(total) + " files.",
+			"copied":       copiedCount,
+			"failed":       failedCount,
+			"total":        total,
+			"bytes_copied": bytesCopied,
+		})
+	}
+
+	for i, item := range plan {
+		if ctx.Err() != nil {
+			cancelled()
+			return
+		}
+
+		rawDestPath := filepath.Join(rawDestDir, item.destName)
+		entry, err := exportRawVerified(ctx, data.Directory, item.src, rawDestPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				cancelled()
+				return
+			}
+			var vErr *verifyError
+			if errors.As(err, &vErr) {
+				verifyFailed = append(verifyFailed, item.destName)
+				emit(map[string]interface{}{
+					"type":    "verify_failed",
+					"file":    item.destName,
+					"source":  item.src.kind,
+					"message": "Copy of " + item.destName + " did not match its source and was discarded.",
+				})
+			} else {
+				failedCount++
+				emit(map[string]interface{}{
+					"type":    "error",
+					"file":    item.destName,
+					"source":  item.src.kind,
+					"message": "Failed to copy " + item.destName + ": " + err.Error(),
+				})
+			}
+			log.Printf("Failed to copy raw file: %v", err)
+		} else {
+			exportXMPSidecar(culling, item.jpegFile, rawDestPath)
+			manifestEntries = append(manifestEntries, entry)
+			companions := exportRawCompanions(ctx, data.Directory, item.src, rawDestPath, listings)
+			manifestEntries = append(manifestEntries, companions...)
+			companionCount += len(companions)
+			sources[item.destName] = item.src.kind
+			bytesCopied += entry.Size
+			copiedCount++
+		}
+
+		emit(map[string]interface{}{
+			"type":             "progress",
+			"processed":        i + 1,
+			"copied":           copiedCount,
+			"total":            total,
+			"bytes_copied":     bytesCopied,
+			"total_bytes":      totalBytes,
+			"bytes_per_second": throughput(),
+			"file":             item.destName,
+			"source":           item.src.kind,
+		})
+	}
+	if err := recordManifestEntries(data.Directory, manifestEntries); err != nil {
+		log.Printf("Failed to update import manifest for %s: %v", data.Directory, err)
+	}
+
+	message := fmt.Sprintf("Exported %d raw files (%d already existed, %d not found)", copiedCount, skippedCount, notFoundCount)
+	if companionCount > 0 {
+		message += fmt.Sprintf(" with %d companion files", companionCount)
+	}
+	if notFoundCount > 0 && usbMountPoint == "" {
+		message += "; some raw files are not in the session or archives and no SD card is connected"
+	}
+	if len(verifyFailed) > 0 {
+		message += fmt.Sprintf("; %d failed checksum verification", len(verifyFailed))
+	}
+	if failedCount > 0 {
+		message += fmt.Sprintf("; %d could not be copied", failedCount)
+	}
+
+	emit(map[string]interface{}{
+		"type":             "done",
+		"message":          message,
+		"copied":           copiedCount,
+		"companions":       companionCount,
+		"skipped":          skippedCount,
+		"not_found":        notFoundCount,
+		"failed":           failedCount,
+		"verify_failed":    verifyFailed,
+		"sources":          sources,
+		"total_selected":   len(jpegFiles),
+		"bytes_copied":     bytesCopied,
+		"bytes_per_second": throughput(),
+	})
+}
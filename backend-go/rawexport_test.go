@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindRawSource(t *testing.T) {
+	defer func(cfg appConfig) { currentConfig = cfg }(currentConfig)
+	photoBaseDir = t.TempDir()
+	archive := t.TempDir()
+	currentConfig = appConfig{ArchiveDirs: []string{archive}}
+
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(filepath.Join(archive, "batch"), 0755)
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "100_IMG_0001.CR3"), []byte("session"), 0644)
+	os.WriteFile(filepath.Join(archive, "batch", "100_IMG_0001.CR3"), []byte("archive"), 0644)
+	os.WriteFile(filepath.Join(archive, "batch", "100_IMG_0002.ORF"), []byte("archive"), 0644)
+
+	tests := []struct {
+		baseName string
+		kind     string
+		found    bool
+	}{
+		{"100_IMG_0001", rawSourceSession, true},
+		{"100_IMG_0002", rawSourceArchive, true},
+		{"100_IMG_0003", "", false},
+	}
+	for _, tt := range tests {
+		src, found := findRawSource("batch", tt.baseName, "")
+		if found != tt.found || src.kind != tt.kind {
+			t.Errorf("findRawSource(%s) = %q, %v; want %q, %v", tt.baseName, src.kind, found, tt.kind, tt.found)
+		}
+	}
+}
+
+func TestExportRawVerifiedKeepsCardSource(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(filepath.Join(session, "selected", "raw"), 0755)
+	raw := filepath.Join(session, "100_IMG_0001.CR3")
+	os.WriteFile(raw, []byte("raw bytes"), 0644)
+	_, sum, _ := hashFile(context.Background(), raw)
+	recordManifestEntries("batch", []manifestEntry{{
+		File: "100_IMG_0001.CR3", Source: "DCIM/100CANON/IMG_0001.CR3", DCIMFolder: "100CANON", SHA256: sum, Kind: manifestKindImport,
+	}})
+
+	dest := filepath.Join(session, "selected", "raw", "100_IMG_0001.CR3")
+	entry, err := exportRawVerified(context.Background(), "batch", rawSource{path: raw, kind: rawSourceSession}, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.File != "selected/raw/100_IMG_0001.CR3" || entry.Source != "DCIM/100CANON/IMG_0001.CR3" || entry.SHA256 != sum {
+		t.Errorf("exportRawVerified() entry = %+v, want the import's card source", entry)
+	}
+}
+
+func TestExportRawFilesHandlerStreamsProgress(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	os.MkdirAll(session, 0755)
+	for _, name := range []string{"100_IMG_0001.JPG", "100_IMG_0001.CR3", "100_IMG_0002.JPG", "100_IMG_0003.JPG"} {
+		os.WriteFile(filepath.Join(session, name), []byte(name), 0644)
+	}
+	// A RAW that can't be read: copying it fails.
+	os.Mkdir(filepath.Join(session, "100_IMG_0003.CR3"), 0755)
+	if _, err := addToSelection(context.Background(), "batch", []string{"100_IMG_0001.JPG", "100_IMG_0002.JPG", "100_IMG_0003.JPG"}, selectionVirtual); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/export-raw", strings.NewReader(`{"directory": "batch"}`))
+	rec := httptest.NewRecorder()
+	exportRawFilesHandler(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q, want application/x-ndjson (body %q)", ct, rec.Body.String())
+	}
+
+	var types []string
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("bad NDJSON line %q: %v", scanner.Text(), err)
+		}
+		types = append(types, event["type"].(string))
+		events = append(events, event)
+	}
+	if want := []string{"start", "progress", "error", "progress", "done"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("event types = %v, want %v", types, want)
+	}
+	if failed := events[2]; failed["file"] != "100_IMG_0003.CR3" {
+		t.Errorf("error event = %v, want one for 100_IMG_0003.CR3", failed)
+	}
+	if last := events[3]; last["processed"] != 2.0 || last["copied"] != 1.0 {
+		t.Errorf("last progress event = %v, want 2 processed and 1 copied", last)
+	}
+	done := events[4]
+	if done["copied"] != 1.0 || done["failed"] != 1.0 || done["not_found"] != 1.0 || done["bytes_copied"] != float64(len("100_IMG_0001.CR3")) {
+		t.Errorf("done event = %v, want 1 copied from the session, 1 failed and 1 not found", done)
+	}
+	if _, err := os.Stat(filepath.Join(session, "selected", "raw", "100_IMG_0001.CR3")); err != nil {
+		t.Errorf("raw was not exported: %v", err)
+	}
+}
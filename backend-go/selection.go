@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// selectionStateFile records how a session's selection is stored and, in
+// virtual mode, which photos are selected.
+const selectionStateFile = ".selection.json"
+
+// Selection modes: how saving a selection puts a photo into selected/.
+const (
+	selectionCopy     = "copy"     // a full copy of the JPEG
+	selectionHardlink = "hardlink" // a hard link to the session's JPEG
+	selectionSymlink  = "symlink"  // a relative symlink, ../IMG_0001.JPG
+	selectionVirtual  = "virtual"  // nothing in selected/, only a list in selectionStateFile
+)
+
+// deselectedRawDir, inside selected/, receives the exported RAWs and sidecars
+// of photos taken out of the selection: the card may already be wiped, so
+// they may be the only copy. Selecting the photo again moves them back.
+const deselectedRawDir = ".deselected"
+
+var selectionModes = map[string]bool{
+	selectionCopy:     true,
+	selectionHardlink: true,
+	selectionSymlink:  true,
+	selectionVirtual:  true,
+}
+
+type selectionState struct {
+	Mode   string   `json:"mode"`
+	Photos []string `json:"photos,omitempty"` // virtual mode only
+	// Placed lists the files this app put into selected/. Only these are
+	// ever taken out again: anything else in selected/ was put there by
+	// hand and is left alone. It is missing from state files written before
+	// it was tracked; see loadSelection.
+	Placed []string `json:"placed"`
+}
+
+// selectionLocks serializes read-modify-write cycles on a session's
+// selection state.
+var selectionLocks sync.Map
+
+func lockSelection(directory string) func() {
+	lockAny, _ := selectionLocks.LoadOrStore(directory, &sync.Mutex{})
+	lock := lockAny.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// loadSelection reads a session's selection state. Sessions saved before
+// selection modes existed have no state file and were copied.
+func loadSelection(directory string) (selectionState, error) {
+	state := selectionState{Mode: selectionCopy}
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return state, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, selectionStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return state, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, err
+		}
+		if !selectionModes[state.Mode] {
+			return state, fmt.Errorf("%s: unknown selection mode %q", selectionStateFile, state.Mode)
+		}
+	}
+	if state.Placed == nil {
+		state.Placed = legacyPlacedFiles(dir)
+	}
+	return state, nil
+}
+
+// legacyPlacedFiles guesses which files in a session's selected/ the app put
+// there, for selections saved before that was tracked: those named after a
+// photo of the session, which is how the app names them.
+func legacyPlacedFiles(sourceDir string) []string {
+	placed := []string{}
+	entries, _ := os.ReadDir(filepath.Join(sourceDir, "selected"))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !isViewableFile(name) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(sourceDir, name)); err == nil {
+			placed = append(placed, name)
+		}
+	}
+	return placed
+}
+
+// sessionSelectionMode returns the mode a session's selection is stored in:
+// the one recorded in selectionStateFile, copy for a selected/ saved before
+// modes existed, or else the configured mode.
+func sessionSelectionMode(directory string) (string, error) {
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, selectionStateFile)); err == nil {
+		state, err := loadSelection(directory)
+		return state.Mode, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "selected")); err == nil {
+		return selectionCopy, nil
+	}
+	return configuredSelectionMode(), nil
+}
+
+func saveSelection(directory string, state selectionState) error {
+	dir, err := safePhotoPath(directory)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, filepath.Join(dir, selectionStateFile), data)
+}
+
+// selectedFiles returns, sorted, the names of a session's selected files
+// whatever the selection mode: the copies, hard links and symlinks in
+// selected/ plus the virtual selection list. Entries whose photo no longer
+// exists (a dangling symlink, a deleted photo in the virtual list) are left
+// out.
+func selectedFiles(directory string) ([]string, error) {
+	sourceDir, err := safePhotoPath(directory)
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadSelection(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	selectedDir := filepath.Join(sourceDir, "selected")
+	entries, err := os.ReadDir(selectedDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			if _, err := os.Stat(filepath.Join(selectedDir, name)); err != nil {
+				continue
+			}
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	for _, name := range state.Photos {
+		if seen[name] || !validDirName(name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, name)); err != nil {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// selectedJPEGs returns, sorted, the JPEGs among a session's selected files.
+func selectedJPEGs(directory string) ([]string, error) {
+	names, err := selectedFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+	var jpegs []string
+	for _, name := range names {
+		lowerName := strings.ToLower(name)
+		if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") {
+			jpegs = append(jpegs, name)
+		}
+	}
+	return jpegs, nil
+}
+
+// addToSelection adds session photos to the selection in the given mode and
+// returns how many were added. The mode is recorded for the session so later
+// saves without an explicit mode keep using it. A photo already linked into
+// selected/ is left as it is; a hard link that fails (e.g. on a filesystem
+// without them) falls back to a copy.
+func addToSelection(ctx context.Context, directory string, photos []string, mode string) (int, error) {
+	defer lockSelection(directory)()
+	sourceDir, err := safePhotoPath(directory)
+	if err != nil {
+		return 0, err
+	}
+	state, err := loadSelection(directory)
+	if err != nil {
+		return 0, err
+	}
+	added, err := addSelected(ctx, sourceDir, &state, photos, mode)
+	if err != nil {
+		return 0, err
+	}
+	state.Mode = mode
+	return added, saveSelection(directory, state)
+}
+
+// addSelected puts photos into selected/ (or state's virtual list) and
+// returns how many it could add. The caller holds the session's selection
+// lock and saves state.
+func addSelected(ctx context.Context, sourceDir string, state *selectionState, photos []string, mode string) (int, error) {
+	selectedDir := filepath.Join(sourceDir, "selected")
+	if mode != selectionVirtual && len(photos) > 0 {
+		if err := os.MkdirAll(selectedDir, 0755); err != nil {
+			return 0, err
+		}
+	}
+
+	inList := make(map[string]bool, len(state.Photos))
+	for _, name := range state.Photos {
+		inList[name] = true
+	}
+	isPlaced := make(map[string]bool, len(state.Placed))
+	for _, name := range state.Placed {
+		isPlaced[name] = true
+	}
+	placed := func(name string) {
+		if !isPlaced[name] {
+			isPlaced[name] = true
+			state.Placed = append(state.Placed, name)
+		}
+	}
+
+	added := 0
+	for _, filename := range photos {
+		if !validDirName(filename) {
+			log.Printf("Skipping invalid filename: %s", filename)
+			continue
+		}
+		sourcePath := filepath.Join(sourceDir, filename)
+		sourceInfo, err := os.Stat(sourcePath)
+		if err != nil {
+			log.Printf("Failed to open source file: %v", err)
+			continue
+		}
+		destinationPath := filepath.Join(selectedDir, filename)
+
+		if mode == selectionVirtual {
+			if !inList[filename] {
+				inList[filename] = true
+				state.Photos = append(state.Photos, filename)
+			}
+			added++
+			continue
+		}
+
+		// A link to the photo is already selected; anything else in the way
+		// (e.g. a copy when switching to links) is replaced.
+		if info, err := os.Stat(destinationPath); err == nil && os.SameFile(info, sourceInfo) {
+			placed(filename)
+			added++
+			continue
+		}
+		if err := linkOrCopySelected(ctx, sourcePath, destinationPath, filename, mode); err != nil {
+			log.Printf("Failed to add %s to selection: %v", filename, err)
+			continue
+		}
+		placed(filename)
+		added++
+	}
+	return added, nil
+}
+
+// linkOrCopySelected puts one photo into selected/ as a hard link, symlink
+// or copy.
+func linkOrCopySelected(ctx context.Context, sourcePath, destinationPath, filename, mode string) error {
+	switch mode {
+	case selectionHardlink, selectionSymlink:
+		if err := os.Remove(destinationPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if mode == selectionSymlink {
+			return os.Symlink(filepath.Join("..", filename), destinationPath)
+		}
+		err := os.Link(sourcePath, destinationPath)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to hard link %s, copying instead: %v", filename, err)
+	}
+	_, _, err := copyFileVerified(ctx, sourcePath, destinationPath)
+	return err
+}
+
+// selectionChanges reports what reconcileSelection did.
+type selectionChanges struct {
+	Added        int
+	Removed      int
+	Kept         int
+	RawsTrashed  int
+	RawsDeleted  int
+	RawsRestored int
+}
+
+// reconcileSelection makes a session's selection exactly the given photos.
+// Photos no longer wanted leave selected/ (or the virtual list) if the app
+// put them there (see selectionState.Placed), and their exported RAWs and
+// sidecars in selected/raw/ are moved to deselectedRawDir, or deleted when
+// deleteRaws is set. Newly wanted photos are added in mode, getting back any
+// RAWs moved aside earlier.
+func reconcileSelection(ctx context.Context, directory string, photos []string, mode string, deleteRaws bool) (selectionChanges, error) {
+	var changes selectionChanges
+	defer lockSelection(directory)()
+	sourceDir, err := safePhotoPath(directory)
+	if err != nil {
+		return changes, err
+	}
+	state, err := loadSelection(directory)
+	if err != nil {
+		return changes, err
+	}
+	current, err := selectedFiles(directory)
+	if err != nil {
+		return changes, err
+	}
+	isCurrent := make(map[string]bool, len(current))
+	for _, name := range current {
+		isCurrent[name] = true
+	}
+
+	wanted := make(map[string]bool, len(photos))
+	wantedBases := make(map[string]bool, len(photos))
+	var toAdd []string
+	for _, name := range photos {
+		if wanted[name] || !validDirName(name) {
+			continue
+		}
+		wanted[name] = true
+		wantedBases[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = true
+		if isCurrent[name] {
+			changes.Kept++
+		} else {
+			toAdd = append(toAdd, name)
+		}
+	}
+
+	// Take out of selected/ everything the app put there that is no longer
+	// wanted, dangling symlinks included, and drop it from the virtual list.
+	// Files put there by hand stay.
+	selectedDir := filepath.Join(sourceDir, "selected")
+	removedBases := make(map[string]bool)
+	stillPlaced := []string{}
+	for _, name := range state.Placed {
+		if wanted[name] {
+			stillPlaced = append(stillPlaced, name)
+			continue
+		}
+		if err := os.Remove(filepath.Join(selectedDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s from selection: %v", name, err)
+			stillPlaced = append(stillPlaced, name)
+			continue
+		}
+		if isCurrent[name] {
+			changes.Removed++
+		}
+		removedBases[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = true
+	}
+	state.Placed = stillPlaced
+	kept := state.Photos[:0]
+	for _, name := range state.Photos {
+		if wanted[name] {
+			kept = append(kept, name)
+			continue
+		}
+		if isCurrent[name] {
+			changes.Removed++
+		}
+		removedBases[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = true
+	}
+	state.Photos = kept
+
+	// A RAW is only moved aside when no wanted photo shares its base name
+	// (e.g. the JPEG was deselected but its RAW-only twin is still wanted).
+	renames := make(map[string]string)
+	rawDir := filepath.Join(selectedDir, "raw")
+	trashDir := filepath.Join(selectedDir, deselectedRawDir)
+	moveRaws := func(fromDir, toDir string, bases map[string]bool, restore bool) int {
+		entries, err := os.ReadDir(fromDir)
+		if err != nil {
+			return 0
+		}
+		moved := 0
+		for _, entry := range entries {
+			name := entry.Name()
+			base := strings.ToLower(companionStem(name)) // IMG_0001.CR3.xmp goes with IMG_0001
+			if entry.IsDir() || !bases[base] || (!restore && wantedBases[base]) {
+				continue
+			}
+			from := filepath.Join(fromDir, name)
+			if !restore && deleteRaws {
+				if err := os.Remove(from); err != nil {
+					log.Printf("Failed to delete deselected raw %s: %v", name, err)
+					continue
+				}
+				moved++
+				continue
+			}
+			if err := os.MkdirAll(toDir, 0755); err != nil {
+				log.Printf("Failed to create %s: %v", toDir, err)
+				return moved
+			}
+			to := filepath.Join(toDir, name)
+			if restore {
+				if _, err := os.Lstat(to); err == nil {
+					continue // exported again since
+				}
+			}
+			if err := os.Rename(from, to); err != nil {
+				log.Printf("Failed to move %s: %v", from, err)
+				continue
+			}
+			fromRel, _ := filepath.Rel(sourceDir, from)
+			toRel, _ := filepath.Rel(sourceDir, to)
+			renames[filepath.ToSlash(fromRel)] = filepath.ToSlash(toRel)
+			moved++
+		}
+		return moved
+	}
+	if deleteRaws {
+		changes.RawsDeleted = moveRaws(rawDir, "", removedBases, false)
+	} else {
+		changes.RawsTrashed = moveRaws(rawDir, trashDir, removedBases, false)
+	}
+	addedBases := make(map[string]bool, len(toAdd))
+	for _, name := range toAdd {
+		addedBases[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = true
+	}
+	changes.RawsRestored = moveRaws(trashDir, rawDir, addedBases, true)
+	if err := renameManifestEntries(directory, renames); err != nil {
+		log.Printf("Failed to update import manifest for %s: %v", directory, err)
+	}
+
+	if changes.Added, err = addSelected(ctx, sourceDir, &state, toAdd, mode); err != nil {
+		return changes, err
+	}
+	state.Mode = mode
+	return changes, saveSelection(directory, state)
+}
+
+// selectionHandler reads (GET) or replaces (POST) a session's selection.
+//
+// GET ?directory=... returns {"mode", "photos": [...]}.
+//
+// POST {"directory", "selected_files": [...], "mode"?, "delete_raws"?} makes
+// the selection exactly selected_files, and returns added, removed and kept
+// counts along with what happened to deselected photos' exported RAWs.
+func selectionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		directory := r.URL.Query().Get("directory")
+		if !validDirName(directory) {
+			http.Error(w, "Missing or invalid 'directory' query parameter", http.StatusBadRequest)
+			return
+		}
+		mode, err := sessionSelectionMode(directory)
+		if err != nil {
+			http.Error(w, "Failed to read selection state: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		photos, err := selectedFiles(directory)
+		if err != nil {
+			http.Error(w, "Failed to read selected photos: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if photos == nil {
+			photos = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"mode": mode, "photos": photos})
+
+	case http.MethodPost:
+		var data struct {
+			Directory     string   `json:"directory"`
+			SelectedFiles []string `json:"selected_files"`
+			Mode          string   `json:"mode"`
+			DeleteRaws    bool     `json:"delete_raws"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validDirName(data.Directory) || data.SelectedFiles == nil {
+			http.Error(w, "Missing 'directory' or 'selected_files' in request", http.StatusBadRequest)
+			return
+		}
+		if data.Mode != "" && !selectionModes[data.Mode] {
+			http.Error(w, "mode must be copy, hardlink, symlink or virtual", http.StatusBadRequest)
+			return
+		}
+		dir, err := safePhotoPath(data.Directory)
+		if err != nil {
+			http.Error(w, "Invalid directory", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(dir); err != nil {
+			http.Error(w, "Directory not found", http.StatusNotFound)
+			return
+		}
+		for _, photo := range data.SelectedFiles {
+			if !validDirName(photo) {
+				http.Error(w, "Invalid photo name: "+photo, http.StatusBadRequest)
+				return
+			}
+		}
+		mode := data.Mode
+		if mode == "" {
+			if mode, err = sessionSelectionMode(data.Directory); err != nil {
+				http.Error(w, "Failed to read selection state: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		changes, err := reconcileSelection(r.Context(), data.Directory, data.SelectedFiles, mode, data.DeleteRaws)
+		if err != nil {
+			http.Error(w, "Failed to save selection: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updateLibrarySession(data.Directory)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       fmt.Sprintf("Selection saved: %d added, %d removed, %d kept", changes.Added, changes.Removed, changes.Kept),
+			"mode":          mode,
+			"added":         changes.Added,
+			"removed":       changes.Removed,
+			"kept":          changes.Kept,
+			"raws_trashed":  changes.RawsTrashed,
+			"raws_deleted":  changes.RawsDeleted,
+			"raws_restored": changes.RawsRestored,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddToSelectionModes(t *testing.T) {
+	for _, mode := range []string{selectionCopy, selectionHardlink, selectionSymlink, selectionVirtual} {
+		t.Run(mode, func(t *testing.T) {
+			photoBaseDir = t.TempDir()
+			session := filepath.Join(photoBaseDir, "batch")
+			os.MkdirAll(session, 0755)
+			for _, name := range []string{"a.JPG", "b.JPG", "c.JPG"} {
+				os.WriteFile(filepath.Join(session, name), []byte(name), 0644)
+			}
+
+			added, err := addToSelection(context.Background(), "batch", []string{"a.JPG", "b.JPG", "missing.JPG", "../x.JPG"}, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != 2 {
+				t.Errorf("added = %d, want 2", added)
+			}
+			if got, _ := sessionSelectionMode("batch"); got != mode {
+				t.Errorf("sessionSelectionMode() = %q, want %q", got, mode)
+			}
+
+			selected := filepath.Join(session, "selected", "a.JPG")
+			switch mode {
+			case selectionHardlink:
+				a, _ := os.Stat(filepath.Join(session, "a.JPG"))
+				b, err := os.Stat(selected)
+				if err != nil || !os.SameFile(a, b) {
+					t.Errorf("selected/a.JPG is not a hard link to a.JPG: %v", err)
+				}
+			case selectionSymlink:
+				if target, err := os.Readlink(selected); err != nil || target != filepath.Join("..", "a.JPG") {
+					t.Errorf("Readlink(selected/a.JPG) = %q, %v; want ../a.JPG", target, err)
+				}
+			case selectionVirtual:
+				if _, err := os.Lstat(selected); !os.IsNotExist(err) {
+					t.Errorf("virtual selection wrote selected/a.JPG: %v", err)
+				}
+			}
+
+			// A deleted photo drops out of link and virtual selections alike.
+			os.Remove(filepath.Join(session, "b.JPG"))
+			want := []string{"a.JPG"}
+			if mode == selectionCopy || mode == selectionHardlink {
+				want = []string{"a.JPG", "b.JPG"}
+			}
+			got, err := selectedJPEGs("batch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("selectedJPEGs() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSessionSelectionModeDefaults(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	os.MkdirAll(filepath.Join(photoBaseDir, "new"), 0755)
+	os.MkdirAll(filepath.Join(photoBaseDir, "old", "selected"), 0755)
+
+	if got, _ := sessionSelectionMode("new"); got != configuredSelectionMode() {
+		t.Errorf("sessionSelectionMode(new) = %q, want the configured %q", got, configuredSelectionMode())
+	}
+	if got, _ := sessionSelectionMode("old"); got != selectionCopy {
+		t.Errorf("sessionSelectionMode(old) = %q, want copy for a selected/ without state", got)
+	}
+}
+
+func TestReconcileSelection(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	rawDir := filepath.Join(session, "selected", "raw")
+	os.MkdirAll(rawDir, 0755)
+	for _, name := range []string{"a.JPG", "b.JPG", "c.JPG"} {
+		os.WriteFile(filepath.Join(session, name), []byte(name), 0644)
+	}
+	ctx := context.Background()
+	if _, err := addToSelection(ctx, "batch", []string{"a.JPG", "b.JPG"}, selectionSymlink); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(rawDir, "b.CR3"), []byte("raw"), 0644)
+	os.WriteFile(filepath.Join(rawDir, "b.xmp"), []byte("xmp"), 0644)
+	recordManifestEntries("batch", []manifestEntry{{File: "selected/raw/b.CR3", Kind: manifestKindRawExport}})
+
+	changes, err := reconcileSelection(ctx, "batch", []string{"a.JPG", "c.JPG"}, selectionSymlink, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (selectionChanges{Added: 1, Removed: 1, Kept: 1, RawsTrashed: 2}); changes != want {
+		t.Errorf("reconcileSelection() = %+v, want %+v", changes, want)
+	}
+	if got, _ := selectedJPEGs("batch"); !reflect.DeepEqual(got, []string{"a.JPG", "c.JPG"}) {
+		t.Errorf("selectedJPEGs() = %v, want [a.JPG c.JPG]", got)
+	}
+	if _, err := os.Stat(filepath.Join(session, "selected", deselectedRawDir, "b.CR3")); err != nil {
+		t.Errorf("deselected raw was not moved aside: %v", err)
+	}
+	m, _ := loadManifest("batch")
+	if len(m.Entries) != 1 || m.Entries[0].File != "selected/.deselected/b.CR3" {
+		t.Errorf("manifest entries = %+v, want b.CR3 under selected/.deselected", m.Entries)
+	}
+
+	// Selecting b again brings its RAW back; deselecting c with delete_raws
+	// removes nothing else.
+	changes, err = reconcileSelection(ctx, "batch", []string{"a.JPG", "b.JPG"}, selectionSymlink, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (selectionChanges{Added: 1, Removed: 1, Kept: 1, RawsRestored: 2}); changes != want {
+		t.Errorf("reconcileSelection() = %+v, want %+v", changes, want)
+	}
+	if _, err := os.Stat(filepath.Join(rawDir, "b.CR3")); err != nil {
+		t.Errorf("reselected raw was not restored: %v", err)
+	}
+
+	changes, err = reconcileSelection(ctx, "batch", []string{}, selectionSymlink, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (selectionChanges{Removed: 2, RawsDeleted: 2}); changes != want {
+		t.Errorf("reconcileSelection() = %+v, want %+v", changes, want)
+	}
+	if entries, _ := os.ReadDir(rawDir); len(entries) != 0 {
+		t.Errorf("selected/raw still holds %d files after deleting deselected raws", len(entries))
+	}
+}
+
+func TestReconcileSelectionLeavesFilesPutThereByHand(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	session := filepath.Join(photoBaseDir, "batch")
+	selectedDir := filepath.Join(session, "selected")
+	os.MkdirAll(selectedDir, 0755)
+	for _, name := range []string{"a.JPG", "b.JPG", "c.CR3"} {
+		os.WriteFile(filepath.Join(session, name), []byte(name), 0644)
+	}
+	// A selection saved before the app tracked what it placed, plus a note
+	// and an edit dropped in by hand.
+	os.WriteFile(filepath.Join(selectedDir, "a.JPG"), []byte("a.JPG"), 0644)
+	os.WriteFile(filepath.Join(selectedDir, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(selectedDir, "a_edit.JPG"), []byte("edit"), 0644)
+	ctx := context.Background()
+	if _, err := addToSelection(ctx, "batch", []string{"c.CR3"}, selectionCopy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reconcileSelection(ctx, "batch", []string{"b.JPG", "c.CR3"}, selectionCopy, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(selectedDir)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	if want := []string{"a_edit.JPG", "b.JPG", "c.CR3", "notes.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("selected/ = %v, want %v", got, want)
+	}
+	if state, _ := loadSelection("batch"); !reflect.DeepEqual(state.Placed, []string{"c.CR3", "b.JPG"}) {
+		t.Errorf("placed = %v, want [c.CR3 b.JPG]", state.Placed)
+	}
+}
+
+func TestGetSelectedPhotosHandlerRejectsBadSessions(t *testing.T) {
+	photoBaseDir = t.TempDir()
+	for directory, want := range map[string]int{
+		"../etc":  http.StatusBadRequest,
+		".hidden": http.StatusBadRequest,
+		"missing": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		getSelectedPhotosHandler(rec, httptest.NewRequest(http.MethodGet, "/api/selected-photos?directory="+directory, nil))
+		if rec.Code != want {
+			t.Errorf("directory %q: status = %d, want %d", directory, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openUncached opens path for reading with the unified buffer cache turned
+// off for the descriptor, so reads come from the device.
+func openUncached(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1)
+	return f, nil
+}
@@ -0,0 +1,24 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// posixFadvDontNeed is POSIX_FADV_DONTNEED from <fcntl.h>.
+const posixFadvDontNeed = 4
+
+// openUncached opens path for reading after asking the kernel to drop the
+// file's clean pages from the page cache, so what follows is read from the
+// device rather than served from memory. Dirty pages can't be dropped: sync
+// a freshly written file first.
+func openUncached(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, posixFadvDontNeed, 0, 0)
+	return f, nil
+}
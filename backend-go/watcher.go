@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchDebounce is how long the library watcher waits after a change for
+// more to follow before acting, so copying a few hundred files by hand
+// indexes each session once rather than once per file.
+const watchDebounce = 500 * time.Millisecond
+
+// watchPollInterval is how often the library is polled for changes where
+// inotify isn't available.
+const watchPollInterval = 2 * time.Second
+
+// libraryWatcher collects the sessions changed outside the app (or by it)
+// and, once things settle, brings the library index and thumbnail cache up
+// to date and tells connected clients. The session "" stands for photoBaseDir
+// itself: sessions created, renamed or removed.
+type libraryWatcher struct {
+	mu       sync.Mutex
+	pending  map[string]bool
+	timer    *time.Timer
+	flushing sync.WaitGroup // flushes scheduled or running
+}
+
+func newLibraryWatcher() *libraryWatcher {
+	return &libraryWatcher{pending: make(map[string]bool)}
+}
+
+// changed records a change in a session, or with "" in photoBaseDir.
+func (lw *libraryWatcher) changed(directory string) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.pending[directory] = true
+	if lw.timer == nil {
+		lw.flushing.Add(1)
+		lw.timer = time.AfterFunc(watchDebounce, lw.flush)
+	} else if !lw.timer.Reset(watchDebounce) {
+		// The timer already fired and its flush is waiting for the lock;
+		// Reset schedules another one.
+		lw.flushing.Add(1)
+	}
+}
+
+func (lw *libraryWatcher) flush() {
+	defer lw.flushing.Done()
+	lw.mu.Lock()
+	pending := lw.pending
+	lw.pending = make(map[string]bool)
+	lw.timer = nil
+	lw.mu.Unlock()
+	applyLibraryChanges(pending)
+}
+
+// applyLibraryChanges indexes the given sessions again, drops the cached
+// thumbnails of files that went away or changed, generates thumbnails for
+// new and changed photos, and publishes what changed.
+func applyLibraryChanges(directories map[string]bool) {
+	// New sessions are indexed whole and reported as such; sessions already
+	// in the index are left to reindexLibrarySession, which reports what
+	// changed in them.
+	added, removed := syncLibrarySessions()
+	for _, directory := range removed {
+		if err := os.RemoveAll(filepath.Join(thumbnailCacheDir, directory)); err != nil {
+			log.Printf("Failed to delete thumbnail cache of %s: %v", directory, err)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("Library sessions changed: %d added, %d removed", len(added), len(removed))
+		publishEvent(map[string]interface{}{
+			"type":    "sessions_changed",
+			"added":   nonNil(added),
+			"removed": nonNil(removed),
+		})
+	}
+
+	thumbnails := make(map[string][]string)
+	for directory := range directories {
+		if directory == "" || !validDirName(directory) {
+			continue
+		}
+		changes := reindexLibrarySession(directory)
+		if changes.empty() {
+			continue
+		}
+		for _, name := range changes.Removed {
+			removeCachedThumbnails(directory, name)
+		}
+		if len(changes.Removed) > 0 {
+			if _, err := pruneCulling(directory); err != nil {
+				log.Printf("Failed to update culling state of %s: %v", directory, err)
+			}
+		}
+		for _, name := range changes.Modified {
+			removeCachedThumbnails(directory, name)
+		}
+		for _, name := range append(append([]string(nil), changes.Added...), changes.Modified...) {
+			if isViewableFile(name) {
+				thumbnails[directory] = append(thumbnails[directory], name)
+			}
+		}
+		log.Printf("Library change in %s: %d added, %d removed, %d modified", directory, len(changes.Added), len(changes.Removed), len(changes.Modified))
+		publishEvent(map[string]interface{}{
+			"type":              "session_changed",
+			"directory":         directory,
+			"added":             nonNil(changes.Added),
+			"removed":           nonNil(changes.Removed),
+			"modified":          nonNil(changes.Modified),
+			"selection_changed": changes.SelectionChanged,
+		})
+	}
+
+	// Thumbnails last, so clients hear about every change without waiting
+	// for them.
+	for directory, photos := range thumbnails {
+		preGenerateThumbnails(directory, photos)
+	}
+}
+
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
+
+// isViewableFile reports whether name is a file the photo list shows and
+// thumbnails are made for.
+func isViewableFile(name string) bool {
+	lowerName := strings.ToLower(name)
+	return strings.HasSuffix(lowerName, ".png") || strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") || strings.HasSuffix(lowerName, ".gif") || isRawFile(name)
+}
+
+// removeCachedThumbnails deletes the cached thumbnail and rotated RAW
+// preview of a session file.
+func removeCachedThumbnails(directory, filename string) {
+	for _, cached := range []string{
+		filepath.Join(thumbnailCacheDir, directory, filename),
+		filepath.Join(thumbnailCacheDir, directory, previewCacheDir, filename),
+	} {
+		if err := os.Remove(cached); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete thumbnail %s: %v", cached, err)
+		}
+	}
+}
+
+// watchedName reports whether a change to the file or folder name in the
+// session directory (or, with an empty directory, in photoBaseDir) can
+// matter: hidden files are the app's own, except the virtual selection.
+func watchedName(directory, name string) bool {
+	if directory == "" {
+		return validDirName(name)
+	}
+	return !strings.HasPrefix(name, ".") || name == selectionStateFile
+}
+
+// watchLibrary follows changes to photoBaseDir until ctx is done, through
+// inotify where the platform has it and by polling otherwise.
+func watchLibrary(ctx context.Context) {
+	lw := newLibraryWatcher()
+	err := watchLibraryNative(ctx, lw)
+	if err == nil {
+		log.Printf("Watching %s for changes", photoBaseDir)
+		return
+	}
+	log.Printf("Polling %s for changes every %v: %v", photoBaseDir, watchPollInterval, err)
+	go pollLibrary(ctx, lw, watchPollInterval)
+}
+
+// pollLibrary notices changes by the modification times of photoBaseDir, of
+// every session and of their selected/ folders, checked every interval.
+func pollLibrary(ctx context.Context, lw *libraryWatcher, interval time.Duration) {
+	seen := make(map[string]time.Time)
+	check := func(key, path string) bool {
+		info, err := os.Stat(path)
+		var modTime time.Time
+		if err == nil {
+			modTime = info.ModTime()
+		}
+		previous, known := seen[key]
+		seen[key] = modTime
+		return known && !previous.Equal(modTime)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if check("", photoBaseDir) {
+			lw.changed("")
+		}
+		dirs, _ := os.ReadDir(photoBaseDir)
+		for _, dir := range dirs {
+			if !dir.IsDir() || !validDirName(dir.Name()) {
+				continue
+			}
+			session := filepath.Join(photoBaseDir, dir.Name())
+			dirChanged := check(dir.Name(), session)
+			selectedChanged := check(dir.Name()+"/selected", filepath.Join(session, "selected"))
+			if dirChanged || selectedChanged {
+				lw.changed(dir.Name())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// inotifyMask is what the library watcher asks inotify for: files and
+// folders appearing, disappearing or finishing being written.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatcher watches photoBaseDir, every session in it and their
+// selected/ folders. Watches are keyed by the folder's path relative to
+// photoBaseDir: "", "<session>" or "<session>/selected".
+type inotifyWatcher struct {
+	fd    int
+	file  *os.File
+	lw    *libraryWatcher
+	wds   map[int32]string
+	paths map[string]int32
+}
+
+// watchLibraryNative starts watching photoBaseDir with inotify and reports
+// changes to lw until ctx is done. It fails if inotify can't be set up, e.g.
+// when the system's watch limit is used up.
+func watchLibraryNative(ctx context.Context, lw *libraryWatcher) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// A non-blocking descriptor makes reads go through the runtime poller, so
+	// closing the file ends a pending read.
+	w := &inotifyWatcher{
+		fd:    fd,
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		lw:    lw,
+		wds:   make(map[int32]string),
+		paths: make(map[string]int32),
+	}
+	if err := w.add(""); err != nil {
+		w.file.Close()
+		return err
+	}
+	dirs, err := os.ReadDir(photoBaseDir)
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && validDirName(dir.Name()) {
+			w.addSession(dir.Name())
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		w.file.Close()
+	}()
+	go w.run()
+	return nil
+}
+
+func (w *inotifyWatcher) add(rel string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, filepath.Join(photoBaseDir, rel), inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.wds[int32(wd)] = rel
+	w.paths[rel] = int32(wd)
+	return nil
+}
+
+func (w *inotifyWatcher) remove(rel string) {
+	wd, ok := w.paths[rel]
+	if !ok {
+		return
+	}
+	syscall.InotifyRmWatch(w.fd, uint32(wd))
+	delete(w.wds, wd)
+	delete(w.paths, rel)
+}
+
+// addSession watches a session and its selected/ folder, if it has one.
+func (w *inotifyWatcher) addSession(session string) {
+	if err := w.add(session); err != nil {
+		log.Printf("Failed to watch %s: %v", session, err)
+		return
+	}
+	if info, err := os.Stat(filepath.Join(photoBaseDir, session, "selected")); err == nil && info.IsDir() {
+		if err := w.add(session + "/selected"); err != nil {
+			log.Printf("Failed to watch %s/selected: %v", session, err)
+		}
+	}
+}
+
+func (w *inotifyWatcher) removeSession(session string) {
+	w.remove(session + "/selected")
+	w.remove(session)
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return // closed
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + nameLen
+			if off > n {
+				break
+			}
+			w.handle(wd, mask, strings.TrimRight(string(buf[start:off]), "\x00"))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost: look at everything.
+		w.lw.changed("")
+		for rel := range w.paths {
+			if rel != "" && !strings.Contains(rel, "/") {
+				w.lw.changed(rel)
+			}
+		}
+		return
+	}
+	rel, ok := w.wds[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.wds, wd)
+		if w.paths[rel] == wd {
+			delete(w.paths, rel)
+		}
+		return
+	}
+	isDir := mask&syscall.IN_ISDIR != 0
+	appeared := mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+	gone := mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0
+
+	session, sub, _ := strings.Cut(rel, "/")
+	switch {
+	case rel == "":
+		if !isDir || !watchedName("", name) {
+			return
+		}
+		if appeared {
+			w.addSession(name)
+			// Files may have landed before the watch was in place.
+			w.lw.changed(name)
+		} else if gone {
+			w.removeSession(name)
+		}
+		w.lw.changed("")
+	case sub == "":
+		if !watchedName(session, name) {
+			return
+		}
+		if isDir {
+			if name != "selected" {
+				return // export/ and other folders of the app's own
+			}
+			if appeared {
+				if err := w.add(session + "/selected"); err != nil {
+					log.Printf("Failed to watch %s/selected: %v", session, err)
+				}
+			} else if gone {
+				w.remove(session + "/selected")
+			}
+		}
+		w.lw.changed(session)
+	default:
+		if isDir || strings.HasPrefix(name, ".") {
+			return
+		}
+		w.lw.changed(session)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchLibraryNative has no native implementation here; watchLibrary polls.
+func watchLibraryNative(ctx context.Context, lw *libraryWatcher) error {
+	return errors.New("inotify is only available on Linux")
+}
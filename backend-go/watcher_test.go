@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event of the given type.
+func nextEvent(t *testing.T, events chan map[string]interface{}, eventType string) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event["type"] == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+			return nil
+		}
+	}
+}
+
+// testLibraryWatcher checks the library watcher started by start, which
+// returns once the watcher has stopped after ctx is done.
+func testLibraryWatcher(t *testing.T, start func(ctx context.Context, lw *libraryWatcher) (stopped <-chan struct{})) {
+	photoBaseDir = t.TempDir()
+	thumbnailCacheDir = filepath.Join(photoBaseDir, ".thumbnails")
+	session := filepath.Join(photoBaseDir, "trip")
+	os.MkdirAll(session, 0755)
+	os.WriteFile(filepath.Join(session, "a.JPG"), testJPEGTakenAt(t, "2025:11:01 14:30:45", "111"), 0644)
+	indexedSessionNames()
+
+	events := subscribeEvents()
+	defer unsubscribeEvents(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	lw := newLibraryWatcher()
+	stopped := start(ctx, lw)
+	defer func() {
+		// Let the watcher and its flushes wind down before the next test
+		// points photoBaseDir elsewhere.
+		cancel()
+		<-stopped
+		lw.flushing.Wait()
+	}()
+
+	// A photo dropped in by hand is indexed and gets a thumbnail.
+	os.WriteFile(filepath.Join(session, "b.JPG"), testJPEGTakenAt(t, "2025:11:01 14:31:00", "111"), 0644)
+	event := nextEvent(t, events, "session_changed")
+	if event["directory"] != "trip" || len(event["added"].([]string)) != 1 {
+		t.Errorf("session_changed = %v, want b.JPG added to trip", event)
+	}
+	if files, _, _ := indexedSessionFiles("trip"); len(files) != 2 {
+		t.Errorf("indexed files = %v, want a.JPG and b.JPG", files)
+	}
+
+	// A photo deleted by hand loses its cached thumbnail.
+	os.MkdirAll(filepath.Join(thumbnailCacheDir, "trip"), 0755)
+	os.WriteFile(filepath.Join(thumbnailCacheDir, "trip", "a.JPG"), []byte("thumb"), 0644)
+	os.Remove(filepath.Join(session, "a.JPG"))
+	event = nextEvent(t, events, "session_changed")
+	if removed := event["removed"].([]string); len(removed) != 1 || removed[0] != "a.JPG" {
+		t.Errorf("session_changed = %v, want a.JPG removed", event)
+	}
+	if _, err := os.Stat(filepath.Join(thumbnailCacheDir, "trip", "a.JPG")); !os.IsNotExist(err) {
+		t.Errorf("thumbnail of a deleted photo kept (err %v)", err)
+	}
+
+	// A new session shows up in the session list.
+	os.MkdirAll(filepath.Join(photoBaseDir, "party"), 0755)
+	event = nextEvent(t, events, "sessions_changed")
+	if added := event["added"].([]string); len(added) != 1 || added[0] != "party" {
+		t.Errorf("sessions_changed = %v, want party added", event)
+	}
+}
+
+func TestLibraryWatcherNative(t *testing.T) {
+	testLibraryWatcher(t, func(ctx context.Context, lw *libraryWatcher) <-chan struct{} {
+		if err := watchLibraryNative(ctx, lw); err != nil {
+			t.Skipf("no native watcher: %v", err)
+		}
+		return ctx.Done()
+	})
+}
+
+func TestLibraryWatcherPolling(t *testing.T) {
+	testLibraryWatcher(t, func(ctx context.Context, lw *libraryWatcher) <-chan struct{} {
+		stopped := make(chan struct{})
+		go func() {
+			pollLibrary(ctx, lw, 50*time.Millisecond)
+			close(stopped)
+		}()
+		// Let the first poll record the starting point.
+		time.Sleep(100 * time.Millisecond)
+		return stopped
+	})
+}
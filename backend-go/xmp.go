@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// XMP namespaces of the properties read and written in sidecars.
+const (
+	nsRDF   = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsXMP   = "http://ns.adobe.com/xap/1.0/"
+	nsXMPDM = "http://ns.adobe.com/xmp/1.0/DynamicMedia/"
+	nsDC    = "http://purl.org/dc/elements/1.1/"
+)
+
+// xmpCreatorTool marks sidecars written by this app. Sidecars without it were
+// written by an editor (and may hold develop settings), so they are never
+// overwritten.
+const xmpCreatorTool = "camera_rip"
+
+// maxXMPSize bounds how much of a sidecar is read; real ones are a few KB.
+const maxXMPSize = 1 << 20
+
+var errForeignXMP = errors.New("sidecar was not written by camera_rip")
+
+// xmpSidecarPaths returns the sidecar paths of a RAW file in the two naming
+// styles editors look for: Adobe's (IMG_0001.CR3 -> IMG_0001.xmp, read by
+// Lightroom and Bridge) and darktable's (IMG_0001.CR3.xmp).
+func xmpSidecarPaths(rawPath string) []string {
+	return []string{strings.TrimSuffix(rawPath, filepath.Ext(rawPath)) + ".xmp", rawPath + ".xmp"}
+}
+
+// encodeXMP renders a photo's culling state as an XMP packet. Ratings, labels
+// and keywords use the properties Lightroom, Bridge and darktable read:
+// xmp:Rating (-1 for rejected), xmp:Label, dc:subject and dc:description.
+// Pick/reject is also written as xmpDM:pick (1 or -1).
+func encodeXMP(c photoCull) []byte {
+	var b bytes.Buffer
+	attr := func(name, value string) {
+		fmt.Fprintf(&b, "\n    %s=\"", name)
+		xml.EscapeText(&b, []byte(value))
+		b.WriteString(`"`)
+	}
+
+	b.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"" + nsRDF + "\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"")
+	attr("xmlns:xmp", nsXMP)
+	attr("xmlns:xmpDM", nsXMPDM)
+	attr("xmlns:dc", nsDC)
+	attr("xmp:CreatorTool", xmpCreatorTool)
+	rating := c.Rating
+	if c.Flag == flagReject {
+		rating = -1
+	}
+	attr("xmp:Rating", strconv.Itoa(rating))
+	if c.Label != "" {
+		attr("xmp:Label", strings.ToUpper(c.Label[:1])+c.Label[1:])
+	}
+	switch c.Flag {
+	case flagPick:
+		attr("xmpDM:pick", "1")
+	case flagReject:
+		attr("xmpDM:pick", "-1")
+	}
+	b.WriteString(">\n")
+
+	if len(c.Keywords) > 0 {
+		b.WriteString("   <dc:subject>\n    <rdf:Bag>\n")
+		for _, k := range c.Keywords {
+			b.WriteString("     <rdf:li>")
+			xml.EscapeText(&b, []byte(k))
+			b.WriteString("</rdf:li>\n")
+		}
+		b.WriteString("    </rdf:Bag>\n   </dc:subject>\n")
+	}
+	if c.Caption != "" {
+		b.WriteString("   <dc:description>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">")
+		xml.EscapeText(&b, []byte(c.Caption))
+		b.WriteString("</rdf:li>\n    </rdf:Alt>\n   </dc:description>\n")
+	}
+
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>\n")
+	return b.Bytes()
+}
+
+// decodeXMP reads the culling state from an XMP packet, accepting both the
+// attribute and the element form of simple properties. It also returns the
+// xmp:CreatorTool, if any.
+func decodeXMP(data []byte) (photoCull, string, error) {
+	var c photoCull
+	var creator string
+	rejected := false
+
+	set := func(name xml.Name, value string) {
+		value = strings.TrimSpace(value)
+		switch name {
+		case xml.Name{Space: nsXMP, Local: "Rating"}:
+			if n, err := strconv.Atoi(value); err == nil {
+				if n < 0 {
+					rejected = true
+				} else if n <= 5 {
+					c.Rating = n
+				}
+			}
+		case xml.Name{Space: nsXMP, Local: "Label"}:
+			if label := strings.ToLower(value); cullingLabels[label] {
+				c.Label = label
+			}
+		case xml.Name{Space: nsXMPDM, Local: "pick"}:
+			switch value {
+			case "1":
+				c.Flag = flagPick
+			case "-1":
+				rejected = true
+			}
+		case xml.Name{Space: nsXMP, Local: "CreatorTool"}:
+			creator = value
+		}
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xml.Name
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return c, "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name == (xml.Name{Space: nsRDF, Local: "Description"}) {
+				for _, a := range t.Attr {
+					set(a.Name, a.Value)
+				}
+			}
+			stack = append(stack, t.Name)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return c, "", errors.New("unbalanced XMP")
+			}
+			stack = stack[:len(stack)-1]
+			value := strings.TrimSpace(text.String())
+			text.Reset()
+			if t.Name != (xml.Name{Space: nsRDF, Local: "li"}) {
+				set(t.Name, value)
+				continue
+			}
+			// rdf:li sits inside an rdf:Bag/Alt inside the property.
+			if len(stack) < 2 || value == "" {
+				continue
+			}
+			switch stack[len(stack)-2] {
+			case xml.Name{Space: nsDC, Local: "subject"}:
+				c.Keywords = append(c.Keywords, value)
+			case xml.Name{Space: nsDC, Local: "description"}:
+				if c.Caption == "" {
+					c.Caption = value
+				}
+			}
+		}
+	}
+	if rejected {
+		c.Flag = flagReject
+	}
+	return c, creator, nil
+}
+
+// readXMPSidecar reads the culling state from a sidecar file.
+func readXMPSidecar(path string) (photoCull, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return photoCull{}, "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxXMPSize+1))
+	if err != nil {
+		return photoCull{}, "", err
+	}
+	if len(data) > maxXMPSize {
+		return photoCull{}, "", fmt.Errorf("%s: sidecar larger than %d bytes", path, maxXMPSize)
+	}
+	return decodeXMP(data)
+}
+
+// writeXMPSidecar writes c as the sidecars of an exported RAW, under both
+// names of xmpSidecarPaths. A sidecar that another program wrote is left
+// alone (errForeignXMP, once the other name has been written); one written
+// earlier by this app is replaced, so changed ratings reach the editors on
+// re-export. Nothing is written for a photo without culling state and no
+// sidecar yet.
+func writeXMPSidecar(rawPath string, c photoCull) error {
+	var result error
+	for _, path := range xmpSidecarPaths(rawPath) {
+		if _, creator, err := readXMPSidecar(path); err == nil {
+			if creator != xmpCreatorTool {
+				result = errForeignXMP
+				continue
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		} else if c.isZero() {
+			continue
+		}
+		if err := writeFileAtomic(filepath.Dir(path), path, encodeXMP(c)); err != nil {
+			return err
+		}
+	}
+	return result
+}
+
+// findXMPSidecar returns the name of the sidecar of file among a directory's
+// entries, keyed by upper-cased name: either IMG_0001.XMP (Adobe style) or
+// IMG_0001.CR3.XMP (darktable style).
+func findXMPSidecar(names map[string]string, file string) (string, bool) {
+	upper := strings.ToUpper(file)
+	for _, candidate := range []string{strings.TrimSuffix(upper, filepath.Ext(upper)) + ".XMP", upper + ".XMP"} {
+		if name, ok := names[candidate]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestXMPRoundTrip(t *testing.T) {
+	for _, c := range []photoCull{
+		{Rating: 4, Label: "green", Flag: flagPick, Keywords: []string{"beach", "a & b"}, Caption: "Sunset <3"},
+		{Rating: 2, Flag: flagReject},
+		{},
+	} {
+		got, creator, err := decodeXMP(encodeXMP(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creator != xmpCreatorTool {
+			t.Errorf("creator = %q, want %q", creator, xmpCreatorTool)
+		}
+		// A rejected photo's stars aren't kept: xmp:Rating is -1.
+		if c.Flag == flagReject {
+			c.Rating = 0
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("decodeXMP(encodeXMP(%+v)) = %+v", c, got)
+		}
+	}
+}
+
+func TestDecodeXMPElementForm(t *testing.T) {
+	data := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <xmp:Rating>3</xmp:Rating>
+   <xmp:Label>Purple</xmp:Label>
+   <xmp:CreatorTool>darktable</xmp:CreatorTool>
+   <dc:subject><rdf:Seq><rdf:li>dog</rdf:li></rdf:Seq></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`)
+	got, creator, err := decodeXMP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := photoCull{Rating: 3, Label: "purple", Keywords: []string{"dog"}}
+	if !reflect.DeepEqual(got, want) || creator != "darktable" {
+		t.Errorf("decodeXMP = %+v, %q; want %+v, darktable", got, creator, want)
+	}
+}
+
+func TestWriteXMPSidecar(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "IMG_0001.CR3")
+	sidecar := filepath.Join(dir, "IMG_0001.xmp")
+	darktable := filepath.Join(dir, "IMG_0001.CR3.xmp")
+
+	// No state and no sidecar: nothing is written.
+	if err := writeXMPSidecar(raw, photoCull{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+		t.Fatalf("sidecar written for an unrated photo: %v", err)
+	}
+
+	// Our own sidecar is replaced when the rating changes.
+	if err := writeXMPSidecar(raw, photoCull{Rating: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXMPSidecar(raw, photoCull{Rating: 5}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{sidecar, darktable} {
+		if c, _, err := readXMPSidecar(path); err != nil || c.Rating != 5 {
+			t.Fatalf("readXMPSidecar(%s) = %+v, %v; want rating 5", filepath.Base(path), c, err)
+		}
+	}
+
+	// An editor's sidecar is kept.
+	foreign := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)
+	os.WriteFile(sidecar, foreign, 0644)
+	if err := writeXMPSidecar(raw, photoCull{Rating: 1}); err != errForeignXMP {
+		t.Fatalf("writeXMPSidecar over a foreign sidecar = %v, want errForeignXMP", err)
+	}
+	if data, _ := os.ReadFile(sidecar); string(data) != string(foreign) {
+		t.Errorf("foreign sidecar was overwritten: %s", data)
+	}
+	if c, _, _ := readXMPSidecar(darktable); c.Rating != 1 {
+		t.Errorf("darktable sidecar rating = %d, want 1 even though the Adobe one is foreign", c.Rating)
+	}
+}
+
+func TestFindXMPSidecar(t *testing.T) {
+	names := map[string]string{"IMG_0001.XMP": "IMG_0001.xmp", "IMG_0002.CR3.XMP": "IMG_0002.CR3.xmp"}
+	for file, want := range map[string]string{
+		"IMG_0001.CR3": "IMG_0001.xmp",
+		"img_0001.jpg": "IMG_0001.xmp",
+		"IMG_0002.CR3": "IMG_0002.CR3.xmp",
+		"IMG_0003.CR3": "",
+	} {
+		if got, _ := findXMPSidecar(names, file); got != want {
+			t.Errorf("findXMPSidecar(%q) = %q, want %q", file, got, want)
+		}
+	}
+}
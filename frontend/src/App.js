@@ -8,6 +8,10 @@ import RenameModal from './RenameModal';
 
 const API_URL = process.env.REACT_APP_API_URL || 'http://localhost:5001';
 
+// Import toggle values used when neither the user nor a camera profile's
+// import_defaults chose one.
+const APP_IMPORT_DEFAULTS = { skip_duplicates: true, import_videos: false, import_raws: false };
+
 const formatBytes = (bytes) => {
     if (!bytes) return '0 B';
     const units = ['B', 'KB', 'MB', 'GB', 'TB'];
@@ -20,6 +24,35 @@ const formatBytes = (bytes) => {
     return `${i === 0 || value >= 10 ? Math.round(value) : value.toFixed(1)} ${units[i]}`;
 };
 
+// Reads a newline-delimited JSON (NDJSON) response body, as streamed by the
+// import and raw export endpoints, calling handleEvent for every event.
+const readNDJSON = async (response, handleEvent) => {
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+    const handleLine = (line) => {
+        if (!line) return;
+        try {
+            handleEvent(JSON.parse(line));
+        } catch (e) {
+            // Ignore malformed lines
+        }
+    };
+    for (; ;) {
+        const { done, value } = await reader.read();
+        if (done) break;
+        buffer += decoder.decode(value, { stream: true });
+        let newlineIndex;
+        while ((newlineIndex = buffer.indexOf('\n')) >= 0) {
+            const line = buffer.slice(0, newlineIndex).trim();
+            buffer = buffer.slice(newlineIndex + 1);
+            handleLine(line);
+        }
+    }
+    // Handle any trailing buffered line without a newline.
+    handleLine(buffer.trim());
+};
+
 // Matches the backend's default new-import folder name (2006-01-02_15-04-05).
 const formatFolderTimestamp = (d) => {
     const pad = n => String(n).padStart(2, '0');
@@ -99,19 +132,25 @@ function App() {
     const [currentIndex, setCurrentIndex] = useState(0);
     const [selectedPhotos, setSelectedPhotos] = useState(new Set());
     const [savedPhotos, setSavedPhotos] = useState(new Set());
+    const [unsavedRemovals, setUnsavedRemovals] = useState(new Set()); // saved photos unselected since the last save
     const [deletedPhotos, setDeletedPhotos] = useState(new Set());
     const [isImporting, setIsImporting] = useState(false);
     const [importProgress, setImportProgress] = useState(null);
     const [sinceDate, setSinceDate] = useState('');
     const [untilDate, setUntilDate] = useState('');
-    const [skipDuplicates, setSkipDuplicates] = useState(true);
+    // Import toggles are null until the user changes them (see importToggle).
+    const [skipDuplicates, setSkipDuplicates] = useState(null);
     const [addToCurrentBatch, setAddToCurrentBatch] = useState(false);
-    const [importVideos, setImportVideos] = useState(false);
-    const [importRaws, setImportRaws] = useState(false);
+    const [importVideos, setImportVideos] = useState(null);
+    const [importRaws, setImportRaws] = useState(null);
+    const [cameraConfigs, setCameraConfigs] = useState([]);
     const [pinnedPhoto, setPinnedPhoto] = useState(null);
     const [exportStatus, setExportStatus] = useState({ selected_count: 0, raw_count: 0, missing_count: 0 });
     const [isExportingRaw, setIsExportingRaw] = useState(false);
+    const [exportPresets, setExportPresets] = useState([]);
+    const [exportingPreset, setExportingPreset] = useState(null);
     const [showDeleteModal, setShowDeleteModal] = useState(false);
+    const [deletePlan, setDeletePlan] = useState(null);
     const [isDeleting, setIsDeleting] = useState(false);
     const [sdCleanup, setSdCleanup] = useState(null);
     const [showSDCleanupModal, setShowSDCleanupModal] = useState(false);
@@ -128,10 +167,13 @@ function App() {
     const touchStartRef = useRef(null);
     const lastTapRef = useRef({ time: 0, x: 0, y: 0 });
     const [importPreview, setImportPreview] = useState(null);
+    const [cards, setCards] = useState([]);
+    const [selectedCard, setSelectedCard] = useState(''); // id of the card to work on; '' when none is connected
     const [isLoadingPreview, setIsLoadingPreview] = useState(false);
     const [showRenameModal, setShowRenameModal] = useState(false);
     const [isRenaming, setIsRenaming] = useState(false);
     const [photoMetadata, setPhotoMetadata] = useState(null);
+    const [culling, setCulling] = useState({});
     const [newFolderName, setNewFolderName] = useState(() => formatFolderTimestamp(new Date()));
     const [folderNameEdited, setFolderNameEdited] = useState(false);
 
@@ -148,6 +190,17 @@ function App() {
         return () => mq.removeListener(onChange);
     }, []);
 
+    // Export presets and camera profiles are defined in the server's config file.
+    useEffect(() => {
+        fetch(`${API_URL}/api/config`)
+            .then(res => (res.ok ? res.json() : null))
+            .then(data => {
+                setExportPresets(data?.export_presets || []);
+                setCameraConfigs(data?.cameras || []);
+            })
+            .catch(() => setExportPresets([]));
+    }, []);
+
     // Keep the destination folder prefill ticking with the current time until
     // the user touches it, so an untouched field always matches the moment
     // Import is clicked.
@@ -202,6 +255,45 @@ function App() {
         fetchDirectories();
     }, [fetchDirectories]);
 
+    // Connected cards. The selection sticks to its card while it stays
+    // connected and otherwise falls back to the first one.
+    const fetchCards = useCallback(() => {
+        fetch(`${API_URL}/api/cards`)
+            .then(res => res.json())
+            .then(data => {
+                const list = Array.isArray(data) ? data : [];
+                setCards(list);
+                setSelectedCard(prev => (list.some(card => card.id === prev) ? prev : (list[0] ? list[0].id : '')));
+            })
+            .catch(() => setCards([]));
+    }, []);
+
+    useEffect(() => {
+        fetchCards();
+    }, [fetchCards]);
+
+    // An import toggle the user hasn't touched shows the import_defaults of
+    // the camera profiles for the brands on the selected card, and is sent as
+    // null so the server applies each camera's own default per DCIM folder.
+    // Without a configured default the app's own is shown and sent.
+    const importToggle = (option, value) => {
+        if (value !== null) return { checked: value, sent: value };
+        const card = cards.find(c => c.id === selectedCard);
+        const configured = (card ? card.brands : [])
+            .map(brand => cameraConfigs.find(camera => camera.name === brand)?.import_defaults?.[option])
+            .find(v => v !== undefined && v !== null);
+        if (configured === undefined) {
+            return { checked: APP_IMPORT_DEFAULTS[option], sent: APP_IMPORT_DEFAULTS[option] };
+        }
+        return { checked: configured, sent: null };
+    };
+    const skipDuplicatesToggle = importToggle('skip_duplicates', skipDuplicates);
+    const importVideosToggle = importToggle('import_videos', importVideos);
+    const importRawsToggle = importToggle('import_raws', importRaws);
+    const sentSkipDuplicates = skipDuplicatesToggle.sent;
+    const sentImportVideos = importVideosToggle.sent;
+    const sentImportRaws = importRawsToggle.sent;
+
     const fetchImportPreview = useCallback(async () => {
         setIsLoadingPreview(true);
         try {
@@ -213,10 +305,11 @@ function App() {
                 body: JSON.stringify({
                     since: sinceDate,
                     until: untilDate,
-                    skip_duplicates: skipDuplicates,
+                    skip_duplicates: sentSkipDuplicates,
                     target_directory: addToCurrentBatch ? currentDirectory : '',
-                    import_videos: importVideos,
-                    import_raws: importRaws
+                    import_videos: sentImportVideos,
+                    import_raws: sentImportRaws,
+                    card: selectedCard
                 })
             });
             const data = await response.json();
@@ -229,28 +322,90 @@ function App() {
             setImportPreview(null);
         }
         setIsLoadingPreview(false);
-    }, [sinceDate, untilDate, skipDuplicates, addToCurrentBatch, currentDirectory, importVideos, importRaws]);
+    }, [sinceDate, untilDate, sentSkipDuplicates, addToCurrentBatch, currentDirectory, sentImportVideos, sentImportRaws, selectedCard]);
 
     // Detect trash (.Trashes, .Trash-1000) and OS metadata folders
     // (.fseventsd, .Spotlight-V100, ...) left on the SD card by macOS/Linux.
     const fetchSDCleanup = useCallback(() => {
-        fetch(`${API_URL}/api/sd-cleanup`)
+        fetch(`${API_URL}/api/sd-cleanup?card=${encodeURIComponent(selectedCard)}`)
             .then(res => res.json())
             .then(data => setSdCleanup(data && !data.error ? data : null))
             .catch(() => setSdCleanup(null));
-    }, []);
+    }, [selectedCard]);
 
     useEffect(() => {
         fetchImportPreview();
         fetchSDCleanup();
     }, [fetchImportPreview, fetchSDCleanup]);
 
+    // The server pushes changes to the library, including files added or
+    // deleted outside the app, and SD cards coming and going over /api/events.
+    // Events are queued so a burst of them isn't collapsed into the last one.
+    const [serverEvents, setServerEvents] = useState([]);
+    useEffect(() => {
+        if (typeof window.EventSource !== 'function') return;
+        const events = new EventSource(`${API_URL}/api/events`);
+        events.onmessage = (e) => {
+            try {
+                const event = JSON.parse(e.data);
+                setServerEvents(prev => [...prev, event]);
+            } catch (err) {
+                // Ignore malformed events
+            }
+        };
+        return () => events.close();
+    }, []);
+
+    useEffect(() => {
+        if (serverEvents.length === 0) return;
+        const handle = (serverEvent) => {
+            if (serverEvent.type === 'sessions_changed') {
+                fetchDirectories();
+                if ((serverEvent.removed || []).includes(currentDirectory)) {
+                    switchDirectory('');
+                }
+            } else if (serverEvent.type === 'session_changed' && serverEvent.directory === currentDirectory) {
+                fetch(`${API_URL}/api/photos?directory=${encodeURIComponent(currentDirectory)}`)
+                    .then(res => res.json())
+                    .then(data => {
+                        if (Array.isArray(data)) setPhotos(data);
+                    })
+                    .catch(() => {});
+                if (serverEvent.selection_changed) {
+                    fetch(`${API_URL}/api/selected-photos?directory=${encodeURIComponent(currentDirectory)}`)
+                        .then(res => res.json())
+                        .then(data => {
+                            if (Array.isArray(data)) setSavedPhotos(new Set(data));
+                        })
+                        .catch(() => {});
+                    fetchExportStatus();
+                }
+            } else if (serverEvent.type === 'card_inserted') {
+                toast.info(serverEvent.message);
+                // Bring up the import controls with a fresh preview of the card.
+                setIsSidebarCollapsed(false);
+                setSelectedCard(serverEvent.card.id);
+                fetchCards();
+                fetchImportPreview();
+                fetchSDCleanup();
+            } else if (serverEvent.type === 'card_removed') {
+                toast.info(serverEvent.message);
+                fetchCards();
+                fetchImportPreview();
+                fetchSDCleanup();
+            }
+        };
+        serverEvents.forEach(handle);
+        const handled = serverEvents.length;
+        setServerEvents(prev => prev.slice(handled));
+    }, [serverEvents, currentDirectory, fetchDirectories, fetchExportStatus, fetchCards, fetchImportPreview, fetchSDCleanup, switchDirectory]);
+
     const handleSDCleanup = async () => {
         setIsCleaningSD(true);
         setShowSDCleanupModal(false);
         const toastId = toast.loading("Cleaning up SD card...");
         try {
-            const response = await fetch(`${API_URL}/api/sd-cleanup`, { method: 'POST' });
+            const response = await fetch(`${API_URL}/api/sd-cleanup?card=${encodeURIComponent(selectedCard)}`, { method: 'POST' });
             if (response.ok) {
                 const data = await response.json();
                 const message = `Freed ${formatBytes(data.freed)} from SD card (${data.deleted} folder(s) removed${data.errors > 0 ? `, ${data.errors} errors` : ''})`;
@@ -279,11 +434,12 @@ function App() {
                 body: JSON.stringify({
                     since: sinceDate,
                     until: untilDate,
-                    skip_duplicates: skipDuplicates,
+                    skip_duplicates: sentSkipDuplicates,
                     target_directory: addToCurrentBatch ? currentDirectory : '',
                     new_directory_name: addToCurrentBatch ? '' : newFolderName.trim(),
-                    import_videos: importVideos,
-                    import_raws: importRaws
+                    import_videos: sentImportVideos,
+                    import_raws: sentImportRaws,
+                    card: selectedCard
                 })
             });
 
@@ -296,9 +452,6 @@ function App() {
             }
 
             // Success streams newline-delimited JSON progress events.
-            const reader = response.body.getReader();
-            const decoder = new TextDecoder();
-            let buffer = '';
             let doneEvent = null;
             let errorEvent = null;
 
@@ -311,34 +464,14 @@ function App() {
                     toast.update(toastId, { render: `Importing ${evt.copied} / ${evt.total}...`, isLoading: true });
                 } else if (evt.type === 'done') {
                     doneEvent = evt;
-                } else if (evt.type === 'error') {
+                } else if (evt.type === 'verify_failed') {
+                    toast.warn(evt.message, { autoClose: false });
+                } else if (evt.type === 'error' || evt.type === 'cancelled') {
                     errorEvent = evt;
                 }
             };
 
-            for (; ;) {
-                const { done, value } = await reader.read();
-                if (done) break;
-                buffer += decoder.decode(value, { stream: true });
-                let newlineIndex;
-                while ((newlineIndex = buffer.indexOf('\n')) >= 0) {
-                    const line = buffer.slice(0, newlineIndex).trim();
-                    buffer = buffer.slice(newlineIndex + 1);
-                    if (!line) continue;
-                    try {
-                        handleEvent(JSON.parse(line));
-                    } catch (e) {
-                        // Ignore malformed lines
-                    }
-                }
-            }
-            // Handle any trailing buffered line without a newline.
-            const tail = buffer.trim();
-            if (tail) {
-                try {
-                    handleEvent(JSON.parse(tail));
-                } catch (e) { /* ignore */ }
-            }
+            await readNDJSON(response, handleEvent);
 
             if (errorEvent) {
                 toast.update(toastId, { render: errorEvent.message || 'Import failed.', type: "error", isLoading: false, autoClose: 5000 });
@@ -396,6 +529,7 @@ function App() {
                 }
             }
             setSavedPhotos(saved);
+            setUnsavedRemovals(new Set());
 
             const inDirectory = new Set(photoList);
             const pending = readPendingSelections(currentDirectory);
@@ -404,6 +538,12 @@ function App() {
             setDeletedPhotos(new Set(restorable(pending.deleted)));
         });
 
+        setCulling({});
+        fetch(`${API_URL}/api/culling?directory=${encodeURIComponent(currentDirectory)}`)
+            .then(res => res.json())
+            .then(data => setCulling(data.photos || {}))
+            .catch(() => setCulling({}));
+
         fetchExportStatus();
     }, [currentDirectory, fetchExportStatus]);
 
@@ -417,7 +557,16 @@ function App() {
 
     const handleSelection = useCallback((photoName, select) => {
         if (savedPhotos.has(photoName)) {
-            return; // Cannot change selection for saved photos
+            if (!select) {
+                // Unselecting a saved photo takes it out of selected/ on the next save
+                setSavedPhotos(prevSaved => {
+                    const newSaved = new Set(prevSaved);
+                    newSaved.delete(photoName);
+                    return newSaved;
+                });
+                setUnsavedRemovals(prevRemovals => new Set(prevRemovals).add(photoName));
+            }
+            return;
         }
         setSelectedPhotos(prevSelected => {
             const newSelected = new Set(prevSelected);
@@ -461,7 +610,9 @@ function App() {
         const toastId = toast.loading("Saving...")
         const allFilesToSave = Array.from(new Set([...selectedPhotos, ...savedPhotos]));
 
-        fetch(`${API_URL}/api/save`, {
+        // The selection endpoint makes selected/ match exactly this list,
+        // removing photos that were unselected since the last save.
+        fetch(`${API_URL}/api/selection`, {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -479,6 +630,7 @@ function App() {
                     toast.update(toastId, { render: data.message, type: "success", isLoading: false, autoClose: 5000 });
                     // Move selected to saved and clear selected
                     setSavedPhotos(new Set(allFilesToSave));
+                    setUnsavedRemovals(new Set());
                     setSelectedPhotos(new Set());
                     fetchExportStatus(); // Update export status after save
                 }
@@ -497,28 +649,104 @@ function App() {
                 headers: {
                     'Content-Type': 'application/json',
                 },
-                body: JSON.stringify({ directory: currentDirectory })
+                body: JSON.stringify({ directory: currentDirectory, card: selectedCard })
             });
-            const data = await response.json();
-            if (response.ok) {
-                const message = `Exported ${data.copied} raw files (${data.skipped} already existed, ${data.not_found} not found)`;
-                toast.update(toastId, { render: message, type: "success", isLoading: false, autoClose: 5000 });
-                fetchExportStatus(); // Update export status after export
+            // Hard failures (nothing selected, bad request) return non-200 plain text.
+            if (!response.ok) {
+                const text = await response.text();
+                toast.update(toastId, { render: text.trim() || 'An unknown error occurred.', type: "error", isLoading: false, autoClose: 5000 });
+                setIsExportingRaw(false);
+                return;
+            }
+
+            let doneEvent = null;
+            let cancelledEvent = null;
+            await readNDJSON(response, (evt) => {
+                if (evt.type === 'start' || evt.type === 'progress') {
+                    const processed = evt.processed || 0;
+                    const rate = evt.bytes_per_second ? ` · ${formatBytes(evt.bytes_per_second)}/s` : '';
+                    toast.update(toastId, { render: `Exporting raw files ${processed} / ${evt.total} (${formatBytes(evt.bytes_copied)} of ${formatBytes(evt.total_bytes)}${rate})...`, isLoading: true });
+                } else if (evt.type === 'verify_failed') {
+                    toast.warn(evt.message, { autoClose: false });
+                } else if (evt.type === 'error') {
+                    toast.error(evt.message, { autoClose: false });
+                } else if (evt.type === 'done') {
+                    doneEvent = evt;
+                } else if (evt.type === 'cancelled') {
+                    cancelledEvent = evt;
+                }
+            });
+
+            if (doneEvent) {
+                toast.update(toastId, { render: doneEvent.message, type: "success", isLoading: false, autoClose: 5000 });
             } else {
-                toast.update(toastId, { render: data.error || 'An unknown error occurred.', type: "error", isLoading: false, autoClose: 5000 });
+                toast.update(toastId, { render: cancelledEvent?.message || 'Raw export was interrupted.', type: "error", isLoading: false, autoClose: 5000 });
             }
+            fetchExportStatus(); // Update export status after export
         } catch (err) {
             toast.update(toastId, { render: "Failed to export raw files.", type: "error", isLoading: false, autoClose: 5000 });
         }
         setIsExportingRaw(false);
     };
 
+    const handleExportPreset = async (preset) => {
+        setExportingPreset(preset);
+        const toastId = toast.loading(`Exporting with preset ${preset}...`);
+        try {
+            const response = await fetch(`${API_URL}/api/export-preset`, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify({ directory: currentDirectory, preset })
+            });
+            if (!response.ok) {
+                const text = await response.text();
+                toast.update(toastId, { render: text.trim() || 'An unknown error occurred.', type: "error", isLoading: false, autoClose: 5000 });
+                setExportingPreset(null);
+                return;
+            }
+
+            let doneEvent = null;
+            let cancelledEvent = null;
+            await readNDJSON(response, (evt) => {
+                if (evt.type === 'start' || evt.type === 'progress') {
+                    toast.update(toastId, { render: `Exporting with preset ${preset} ${evt.copied || 0} / ${evt.total}...`, isLoading: true });
+                } else if (evt.type === 'done') {
+                    doneEvent = evt;
+                } else if (evt.type === 'cancelled') {
+                    cancelledEvent = evt;
+                }
+            });
+
+            if (doneEvent) {
+                toast.update(toastId, { render: doneEvent.message, type: doneEvent.failed > 0 ? "warning" : "success", isLoading: false, autoClose: 5000 });
+            } else {
+                toast.update(toastId, { render: cancelledEvent?.message || 'Preset export was interrupted.', type: "error", isLoading: false, autoClose: 5000 });
+            }
+        } catch (err) {
+            toast.update(toastId, { render: "Failed to export with preset.", type: "error", isLoading: false, autoClose: 5000 });
+        }
+        setExportingPreset(null);
+    };
+
+    // Dry run: ask the server which card files have a verified library copy
+    // before the user confirms the deletion.
+    const openDeleteModal = () => {
+        setDeletePlan(null);
+        setShowDeleteModal(true);
+        fetch(`${API_URL}/api/delete-imported?card=${encodeURIComponent(selectedCard)}`)
+            .then(res => (res.ok ? res.json() : null))
+            .then(data => setDeletePlan(data))
+            .catch(() => setDeletePlan(null));
+    };
+
     const handleDeleteImported = async () => {
         setIsDeleting(true);
         setShowDeleteModal(false);
         const toastId = toast.loading("Deleting imported images from USB...");
         try {
-            const response = await fetch(`${API_URL}/api/delete-imported`, {
+            const response = await fetch(`${API_URL}/api/delete-imported?card=${encodeURIComponent(selectedCard)}`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -526,7 +754,7 @@ function App() {
             });
             const data = await response.json();
             if (response.ok) {
-                const message = `Deleted ${data.deleted} imported files${data.deleted_raw ? ` and ${data.deleted_raw} RAW files` : ''} from USB${data.errors > 0 ? ` (${data.errors} errors)` : ''}`;
+                const message = `Deleted ${data.deleted} imported files${data.deleted_raw ? ` and ${data.deleted_raw} RAW files` : ''} from USB${data.skipped > 0 ? `, kept ${data.skipped} not verified as imported` : ''}${data.errors > 0 ? ` (${data.errors} errors)` : ''}`;
                 toast.update(toastId, { render: message, type: "success", isLoading: false, autoClose: 5000 });
             } else {
                 toast.update(toastId, { render: data.error || 'An unknown error occurred.', type: "error", isLoading: false, autoClose: 5000 });
@@ -696,6 +924,26 @@ function App() {
         setCurrentIndex(newIndex);
     }, [currentIndex, filteredPhotos.length]);
 
+    // Star ratings live in the session's culling state on the server, so
+    // they survive reloads and can drive "save everything rated 3+".
+    const handleRating = useCallback(async (photoName, rating) => {
+        try {
+            const response = await fetch(`${API_URL}/api/culling`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ directory: currentDirectory, photos: [photoName], rating }),
+            });
+            if (!response.ok) {
+                toast.error(await response.text());
+                return;
+            }
+            const data = await response.json();
+            setCulling(prev => ({ ...prev, ...data.photos }));
+        } catch (error) {
+            toast.error('Failed to save rating');
+        }
+    }, [currentDirectory]);
+
     useEffect(() => {
         const handleKeyDown = (e) => {
             // Ignore shortcuts while typing in a form field (e.g. the rename input)
@@ -723,6 +971,8 @@ function App() {
                     if (next) setPinnedPhoto(null);
                     return next;
                 });
+            } else if (e.key >= '0' && e.key <= '5') {
+                handleRating(currentPhotoName, Number(e.key));
             } else if (e.key === 'ArrowRight' || e.key === 'k') {
                 navigate(1);
             } else if (e.key === 'ArrowLeft' || e.key === 'j') {
@@ -740,7 +990,7 @@ function App() {
         return () => {
             window.removeEventListener('keydown', handleKeyDown);
         };
-    }, [currentIndex, filteredPhotos, handleSelection, handleDeletion, navigate, pinnedPhoto, deletedPhotos, isFullscreen]);
+    }, [currentIndex, filteredPhotos, handleSelection, handleDeletion, handleRating, navigate, pinnedPhoto, deletedPhotos, isFullscreen]);
 
     const currentPhotoName = filteredPhotos.length > 0 && currentIndex < filteredPhotos.length
         ? filteredPhotos[currentIndex]
@@ -748,6 +998,7 @@ function App() {
     const isSelected = currentPhotoName ? selectedPhotos.has(currentPhotoName) : false;
     const isSaved = currentPhotoName ? savedPhotos.has(currentPhotoName) : false;
     const isDeleted = currentPhotoName ? deletedPhotos.has(currentPhotoName) : false;
+    const currentRating = currentPhotoName && culling[currentPhotoName] ? culling[currentPhotoName].rating || 0 : 0;
     const isPinnedSelected = pinnedPhoto ? selectedPhotos.has(pinnedPhoto) : false;
     const isPinnedSaved = pinnedPhoto ? savedPhotos.has(pinnedPhoto) : false;
     const isPinnedDeleted = pinnedPhoto ? deletedPhotos.has(pinnedPhoto) : false;
@@ -778,7 +1029,10 @@ function App() {
     }, [currentPhotoName, currentDirectory]);
 
     const metadataParts = photoMetadata
-        ? [photoMetadata.shutter_speed, photoMetadata.aperture, photoMetadata.iso, photoMetadata.focal_length].filter(Boolean)
+        ? [photoMetadata.shutter_speed, photoMetadata.aperture, photoMetadata.iso, photoMetadata.focal_length, photoMetadata.exposure_compensation].filter(Boolean)
+        : [];
+    const metadataDetails = photoMetadata
+        ? [photoMetadata.model, photoMetadata.lens_model, photoMetadata.capture_time, photoMetadata.gps && photoMetadata.gps.display].filter(Boolean)
         : [];
 
     // Touch gestures on the photo (mobile only): swipe left/right to
@@ -872,7 +1126,7 @@ function App() {
                 onClose={() => setShowDeleteModal(false)}
                 onConfirm={handleDeleteImported}
                 title="Delete Imported Images"
-                message="This will permanently delete all imported images from the USB/SD card. Only files that have been imported to your computer will be deleted. This action cannot be undone. Are you sure you want to continue?"
+                message={`This will permanently delete imported images from the USB/SD card. Only files whose size and checksum match a copy on your computer will be deleted${deletePlan ? ` (${deletePlan.to_delete} files; ${deletePlan.skipped} will be kept)` : ''}. This action cannot be undone. Are you sure you want to continue?`}
                 confirmText="Delete"
                 cancelText="Cancel"
                 confirmButtonClass="delete-confirm"
@@ -922,6 +1176,23 @@ function App() {
                             </p>
                         </div>
                     )}
+                    {cards.length > 1 && (
+                        <div className="date-picker-container">
+                            <label htmlFor="card-select">Card:</label>
+                            <select
+                                id="card-select"
+                                value={selectedCard}
+                                onChange={e => setSelectedCard(e.target.value)}
+                                className="date-picker"
+                            >
+                                {cards.map(card => (
+                                    <option key={card.id} value={card.id}>
+                                        {card.label}{card.brands.length > 0 ? ` (${card.brands.join(', ')})` : ''}{card.capacity ? ` — ${formatBytes(card.free)} free of ${formatBytes(card.capacity)}` : ''}
+                                    </option>
+                                ))}
+                            </select>
+                        </div>
+                    )}
                     <div className="date-range-container">
                         <div className="date-picker-container">
                             <label htmlFor="since-date">From:</label>
@@ -950,7 +1221,7 @@ function App() {
                         <label>
                             <input
                                 type="checkbox"
-                                checked={skipDuplicates}
+                                checked={skipDuplicatesToggle.checked}
                                 onChange={e => setSkipDuplicates(e.target.checked)}
                             />
                             <span>Skip already imported</span>
@@ -971,7 +1242,7 @@ function App() {
                         <label>
                             <input
                                 type="checkbox"
-                                checked={importVideos}
+                                checked={importVideosToggle.checked}
                                 onChange={e => setImportVideos(e.target.checked)}
                             />
                             <span>Import videos (.MP4)</span>
@@ -981,7 +1252,7 @@ function App() {
                         <label>
                             <input
                                 type="checkbox"
-                                checked={importRaws}
+                                checked={importRawsToggle.checked}
                                 onChange={e => setImportRaws(e.target.checked)}
                             />
                             <span>Import RAWs (.CR3, .ORF)</span>
@@ -1015,12 +1286,24 @@ function App() {
                                                 ))}
                                         </div>
                                     )}
+                                    {importPreview.companions_found > 0 && (
+                                        <div className="preview-stat">
+                                            <span className="preview-label">Companion files (WAV, THM, XMP, LRV):</span>
+                                            <span className="preview-value">{importPreview.companions} of {importPreview.companions_found}</span>
+                                        </div>
+                                    )}
                                     {importPreview.skipped_duplicates > 0 && (
                                         <div className="preview-stat">
                                             <span className="preview-label">Will skip (duplicates):</span>
                                             <span className="preview-value">{importPreview.skipped_duplicates}</span>
                                         </div>
                                     )}
+                                    {importPreview.name_collisions > 0 && (
+                                        <div className="preview-stat">
+                                            <span className="preview-label">Same name, different photo (imported):</span>
+                                            <span className="preview-value">{importPreview.name_collisions}</span>
+                                        </div>
+                                    )}
                                     {importPreview.skipped_by_date > 0 && (
                                         <div className="preview-stat">
                                             <span className="preview-label">Will skip (date filter):</span>
@@ -1104,7 +1387,7 @@ function App() {
                         </button>
                     )}
                     <button
-                        onClick={() => setShowDeleteModal(true)}
+                        onClick={openDeleteModal}
                         disabled={isDeleting}
                         className="delete-button"
                     >
@@ -1190,8 +1473,11 @@ function App() {
                                             <div className="photo-filename-overlay">
                                                 <div className="filename">{currentPhotoName}</div>
                                                 <div className="photo-position-overlay">{currentIndex + 1} / {filteredPhotos.length}</div>
+                                                {currentRating > 0 && (
+                                                    <div className="photo-rating-overlay">{'★'.repeat(currentRating)}</div>
+                                                )}
                                                 {metadataParts.length > 0 && (
-                                                    <div className="photo-metadata-overlay">{metadataParts.join(' · ')}</div>
+                                                    <div className="photo-metadata-overlay" title={metadataDetails.join('\n')}>{metadataParts.join(' · ')}</div>
                                                 )}
                                             </div>
                                         )}
@@ -1317,8 +1603,8 @@ function App() {
                     >
                         Fullscreen (f)
                     </button>
-                    <button onClick={handleSave} disabled={selectedPhotos.size === 0} className="save-button">
-                        Save {selectedPhotos.size} new selections
+                    <button onClick={handleSave} disabled={selectedPhotos.size === 0 && unsavedRemovals.size === 0} className="save-button">
+                        Save {selectedPhotos.size} new selections{unsavedRemovals.size > 0 ? `, ${unsavedRemovals.size} removals` : ''}
                     </button>
                     <button
                         onClick={handleExportRaw}
@@ -1326,6 +1612,21 @@ function App() {
                         className="export-raw-button">
                         {isExportingRaw ? 'Exporting...' : `Export Raw Files (${exportStatus.missing_count} missing)`}
                     </button>
+                    <a
+                        href={`${API_URL}/api/download-selection?directory=${encodeURIComponent(currentDirectory)}&raw=1&sidecars=1`}
+                        className={`download-selection-button ${exportStatus.selected_count === 0 ? 'disabled' : ''}`}
+                        download>
+                        Download Selection (ZIP)
+                    </a>
+                    {exportPresets.map(preset => (
+                        <button
+                            key={preset.name}
+                            onClick={() => handleExportPreset(preset.name)}
+                            disabled={exportStatus.selected_count === 0 || exportingPreset !== null}
+                            className="export-preset-button">
+                            {exportingPreset === preset.name ? 'Exporting...' : `Export ${preset.name}${preset.long_edge ? ` (${preset.long_edge}px)` : ''}`}
+                        </button>
+                    ))}
                     {carouselFilter === 'deleted' && deletedPhotos.size > 0 && (
                         <button
                             onClick={() => setShowDeletePhotosModal(true)}